@@ -0,0 +1,188 @@
+package turbo
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+const (
+	JWT_ALG_HS256 = "HS256"
+	JWT_ALG_RS256 = "RS256"
+)
+
+type AuthConfig struct {
+	// Shared secret that HS256 tokens are signed with
+	Secret []byte
+	// Public half of the key that RS256 tokens are signed with
+	PublicKey *rsa.PublicKey
+	// Checked against the iss and aud claims when set
+	Issuer   string
+	Audience string
+	// Clock skew tolerated when checking exp and nbf
+	Leeway time.Duration
+}
+
+// Who is on the other end of a Conn, according to their token
+type Identity struct {
+	Uid     string
+	Claims  map[string]interface{}
+	Expires time.Time
+}
+
+// When identity stops being accepted, allowing for the same clock skew its token was checked with
+func (config *AuthConfig) expiry(identity *Identity) time.Time {
+	return identity.Expires.Add(config.Leeway)
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+func LoadRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, errors.New("No PEM data found in '" + path + "'")
+	}
+	// Accept both PKIX and PKCS1 encodings
+	if key, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		if rsaKey, isRsa := key.(*rsa.PublicKey); isRsa {
+			return rsaKey, nil
+		}
+		return nil, errors.New("Key in '" + path + "' is not an RSA key")
+	}
+	return x509.ParsePKCS1PublicKey(block.Bytes)
+}
+
+func (config *AuthConfig) enabled() bool {
+	return len(config.Secret) > 0 || config.PublicKey != nil
+}
+
+// Checks the token's signature and claims, returning who it belongs to
+func (config *AuthConfig) verify(token string) (*Identity, error) {
+	if !config.enabled() {
+		return nil, errors.New("Auth is not configured on this server")
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("Token is malformed")
+	}
+
+	header := jwtHeader{}
+	if err := decodeJwtPart(parts[0], &header); err != nil {
+		return nil, errors.New("Token header is malformed")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("Token signature is malformed")
+	}
+	if err := config.verifySignature(header.Alg, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	claims := make(map[string]interface{})
+	if err := decodeJwtPart(parts[1], &claims); err != nil {
+		return nil, errors.New("Token claims are malformed")
+	}
+	return config.checkClaims(claims)
+}
+
+func (config *AuthConfig) verifySignature(alg string, signed string, signature []byte) error {
+	digest := sha256.Sum256([]byte(signed))
+
+	switch alg {
+	case JWT_ALG_HS256:
+		if len(config.Secret) == 0 {
+			return errors.New("HS256 tokens are not accepted")
+		}
+		mac := hmac.New(sha256.New, config.Secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("Token signature is invalid")
+		}
+	case JWT_ALG_RS256:
+		if config.PublicKey == nil {
+			return errors.New("RS256 tokens are not accepted")
+		}
+		if rsa.VerifyPKCS1v15(config.PublicKey, crypto.SHA256, digest[:], signature) != nil {
+			return errors.New("Token signature is invalid")
+		}
+	default:
+		return errors.New("Unsupported token algorithm '" + alg + "'")
+	}
+	return nil
+}
+
+func (config *AuthConfig) checkClaims(claims map[string]interface{}) (*Identity, error) {
+	now := time.Now()
+
+	exp, hasExp := claims["exp"].(float64)
+	if !hasExp {
+		return nil, errors.New("Token has no expiry")
+	}
+	expires := time.Unix(int64(exp), 0)
+	if now.After(expires.Add(config.Leeway)) {
+		return nil, errors.New("Token has expired")
+	}
+	if nbf, hasNbf := claims["nbf"].(float64); hasNbf {
+		if now.Add(config.Leeway).Before(time.Unix(int64(nbf), 0)) {
+			return nil, errors.New("Token is not valid yet")
+		}
+	}
+	if config.Issuer != "" && claims["iss"] != config.Issuer {
+		return nil, errors.New("Token has the wrong issuer")
+	}
+	if config.Audience != "" && !hasAudience(claims["aud"], config.Audience) {
+		return nil, errors.New("Token has the wrong audience")
+	}
+
+	identity := Identity{
+		Claims:  claims,
+		Expires: expires,
+	}
+	// Prefer an explicit uid, falling back on the standard subject
+	if uid, isString := claims["uid"].(string); isString {
+		identity.Uid = uid
+	} else if sub, isString := claims["sub"].(string); isString {
+		identity.Uid = sub
+	} else {
+		return nil, errors.New("Token has no uid or sub")
+	}
+	return &identity, nil
+}
+
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud.(type) {
+	case string:
+		return aud.(string) == audience
+	case []interface{}:
+		for _, entry := range aud.([]interface{}) {
+			if entry == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeJwtPart(part string, dest interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(decoded, dest)
+}
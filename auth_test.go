@@ -0,0 +1,156 @@
+package turbo
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func signTestToken(alg string, claims map[string]interface{}, sign func(string) []byte) string {
+	header, _ := json.Marshal(jwtHeader{Alg: alg, Typ: "JWT"})
+	body, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(body)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sign(signed))
+}
+
+func TestVerifyHS256(t *testing.T) {
+	config := AuthConfig{Secret: []byte("secret"), Issuer: "turbo"}
+	sign := func(signed string) []byte {
+		mac := hmac.New(sha256.New, config.Secret)
+		mac.Write([]byte(signed))
+		return mac.Sum(nil)
+	}
+	exp := float64(time.Now().Add(time.Hour).Unix())
+
+	identity, err := config.verify(signTestToken(JWT_ALG_HS256, map[string]interface{}{
+		"uid": "bob",
+		"iss": "turbo",
+		"exp": exp,
+	}, sign))
+	if err != nil {
+		t.Error("Valid token was rejected", err)
+		t.FailNow()
+	}
+	if identity.Uid != "bob" || identity.Claims["iss"] != "turbo" {
+		t.Error("Identity was wrong", identity)
+	}
+
+	expired := signTestToken(JWT_ALG_HS256, map[string]interface{}{
+		"uid": "bob",
+		"iss": "turbo",
+		"exp": float64(time.Now().Add(-time.Hour).Unix()),
+	}, sign)
+	if _, err := config.verify(expired); err == nil {
+		t.Error("Expired token was accepted")
+	}
+
+	wrongIssuer := signTestToken(JWT_ALG_HS256, map[string]interface{}{
+		"uid": "bob",
+		"iss": "someone else",
+		"exp": exp,
+	}, sign)
+	if _, err := config.verify(wrongIssuer); err == nil {
+		t.Error("Token with the wrong issuer was accepted")
+	}
+
+	forged := signTestToken(JWT_ALG_HS256, map[string]interface{}{
+		"uid": "bob",
+		"iss": "turbo",
+		"exp": exp,
+	}, func(signed string) []byte {
+		return []byte("not the signature")
+	})
+	if _, err := config.verify(forged); err == nil {
+		t.Error("Forged token was accepted")
+	}
+
+	unsigned := signTestToken("none", map[string]interface{}{
+		"uid": "bob",
+		"iss": "turbo",
+		"exp": exp,
+	}, func(signed string) []byte {
+		return nil
+	})
+	if _, err := config.verify(unsigned); err == nil {
+		t.Error("Unsigned token was accepted")
+	}
+}
+
+func TestVerifyRS256(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Error("Could not generate a key", err)
+		t.FailNow()
+	}
+	config := AuthConfig{PublicKey: &key.PublicKey}
+	token := signTestToken(JWT_ALG_RS256, map[string]interface{}{
+		"sub": "alice",
+		"exp": float64(time.Now().Add(time.Hour).Unix()),
+	}, func(signed string) []byte {
+		digest := sha256.Sum256([]byte(signed))
+		signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		return signature
+	})
+
+	identity, err := config.verify(token)
+	if err != nil {
+		t.Error("Valid token was rejected", err)
+		t.FailNow()
+	}
+	if identity.Uid != "alice" {
+		t.Error("Identity was wrong", identity)
+	}
+
+	// Only HS256 is configured, so the same token must fail
+	hmacOnly := AuthConfig{Secret: []byte("secret")}
+	if _, err := hmacOnly.verify(token); err == nil {
+		t.Error("RS256 token was accepted without a public key")
+	}
+}
+
+func TestIdentityChanges(t *testing.T) {
+	db := newTestDb(t)
+	rules, _ := ParseRules([]byte(`{"rules": {"private": {".read": "auth != null"}, "public": {".read": true}}}`))
+	hub := NewMsgHub(NewMsgBus(), db, &Config{Rules: rules, Auth: AuthConfig{Leeway: 200 * time.Millisecond}})
+	conn := newTestConn(hub, 1)
+	subscribe := func() {
+		hub.handleOn(&Msg{Cmd: MSG_CMD_ON, Path: "/private", Event: EVENT_TYPE_VALUE, Delta: true}, conn)
+		hub.handleOn(&Msg{Cmd: MSG_CMD_ON, Path: "/public", Event: EVENT_TYPE_VALUE}, conn)
+	}
+
+	// A token only let in by the leeway lasts as long as the leeway does
+	conn.authenticate(&Identity{Uid: "bob", Expires: time.Now().Add(-50 * time.Millisecond)})
+	subscribe()
+	time.Sleep(50 * time.Millisecond)
+	if conn.auth() == nil {
+		t.Error("Token was revoked inside its leeway")
+	}
+
+	// Once it runs out, so do the subscriptions it was the only way to read
+	for start := time.Now(); hub.bus.hasSubscribers(EVENT_TYPE_VALUE, "/private"); time.Sleep(5 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Error("Subscription outlived the token it was read with")
+			break
+		}
+	}
+	if len(conn.deltaPaths()) != 0 {
+		t.Error("Delta stream outlived the token it was read with", conn.deltaPaths())
+	}
+	if !hub.bus.hasSubscribers(EVENT_TYPE_VALUE, "/public") {
+		t.Error("Public subscription was dropped")
+	}
+
+	// Likewise for logging out
+	conn.authenticate(&Identity{Uid: "bob", Expires: time.Now().Add(time.Hour)})
+	subscribe()
+	hub.handleUnauth(&Msg{Cmd: MSG_CMD_UNAUTH}, conn)
+	if hub.bus.hasSubscribers(EVENT_TYPE_VALUE, "/private") {
+		t.Error("Subscription outlived unauth")
+	}
+}
@@ -0,0 +1,43 @@
+package turbo
+
+import (
+	"net/http"
+	"time"
+)
+
+type Config struct {
+	// Where the data lives; DbType is either sqlite3, pg or mysql
+	ConnectionString string
+	DbName           string
+	DbType           string
+	// Keys and expectations for the tokens sent with auth
+	Auth AuthConfig
+	// Security rules; New loads them from RulesFile when it is set
+	Rules     *Rules
+	RulesFile string
+	// Schemas by path pattern; New loads them from SchemasFile when it is set
+	Schemas     *Schemas
+	SchemasFile string
+	// How long dropped sessions are kept, and how many events they can replay
+	SessionTimeout   time.Duration
+	ReplayBufferSize int
+	// How long a dropped session waits for its client before running its disconnect ops
+	DisconnectGrace time.Duration
+	// What to do with conns that can't keep up
+	Backpressure BackpressureConfig
+	// How often conns are pinged, how long they may go without a pong or message, and how long a write may take
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+	WriteTimeout time.Duration
+	// Browser origins allowed to connect, or ORIGIN_ANY; same origin only when empty
+	AllowedOrigins []string
+	// Websocket subprotocols offered to clients, in order of preference
+	Subprotocols []string
+	// Runs before each upgrade; an error refuses the conn, and metadata is kept on it.
+	// An *Error's code picks the http status, anything else is a 403.
+	BeforeUpgrade func(req *http.Request) (metadata interface{}, err error)
+	// How much each conn, and each identity, may write and subscribe to
+	RateLimits RateLimitConfig
+	// How large and deeply nested msgs may be
+	Limits PayloadLimits
+}
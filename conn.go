@@ -5,20 +5,24 @@ import (
 	"log"
 	"net/http"
 	"sync"
+	"time"
 )
 
 const (
 	UPGRADER_READ_BUF_SIZE  = 1024
 	UPGRADER_WRITE_BUF_SIZE = 1024
+	// How long we wait on a close frame before hanging up anyway
+	CONN_CLOSE_TIMEOUT = time.Second
+	// Peers that go a whole pong timeout without a pong or message are taken for dead,
+	// so it should allow for a missed ping or two
+	CONN_PING_INTERVAL_DEFAULT = 30 * time.Second
+	CONN_PONG_TIMEOUT_DEFAULT  = 75 * time.Second
+	CONN_WRITE_TIMEOUT_DEFAULT = 10 * time.Second
 )
 
 var (
 	connectionIdCounter uint64
 	connectionIdMutex   = &sync.Mutex{}
-	upgrader            = &websocket.Upgrader{
-		ReadBufferSize:  UPGRADER_READ_BUF_SIZE,
-		WriteBufferSize: UPGRADER_WRITE_BUF_SIZE,
-	}
 )
 
 type Conn struct {
@@ -27,47 +31,111 @@ type Conn struct {
 	// The websocket Conn.
 	ws *websocket.Conn
 	// Buffered channel of outbound messages.
-	outbox chan []byte
-	// Event subscriptions
+	outbox *Outbox
+	// Buffered channel of inbound messages, handled in order by the worker
+	inbox chan *Msg
+	// Closed once the reader is done, which stops the pings
+	done chan bool
+	// Handed out in the welcome, so the client can pick up where it left off
+	session *Session
+	// Value subscriptions that get patches instead of whole values
+	deltas    map[Path]*deltaState
+	deltaLock sync.Mutex
+	// Event subscriptions, and how many there are for anyone to read
 	subscriptions map[*map[*Conn]bool]bool
+	subscribed    int64
+	// Rate limits, or nil for none
+	quota *connQuota
 	// Hub reference
 	hub *MsgHub
+	// Whatever Config.BeforeUpgrade returned for this Conn
+	metadata interface{}
+	// Writes to apply once this Conn is gone
+	disconnectOps  []*Msg
+	disconnectLock sync.Mutex
+	// Who this Conn has authenticated as, if anyone
+	identity  *Identity
+	authTimer *time.Timer
+	authLock  sync.Mutex
+	// What .info reports: whether the client has been welcomed and is still here,
+	// and how far its clock is behind ours, if it has said
+	connected   bool
+	clockOffset *int64
+	infoLock    sync.Mutex
 }
 
 func NewConn(hub *MsgHub, res http.ResponseWriter, req *http.Request) (*Conn, error) {
-	ws, err := upgrader.Upgrade(res, req, nil)
+	ws, err := hub.upgrader.Upgrade(res, req, nil)
 	if err != nil {
 		log.Println("Could not upgrade incoming Conn", err)
 		return nil, err
 	}
 	conn := Conn{
 		id:            newConnId(),
-		outbox:        make(chan []byte, 256),
+		outbox:        newOutbox(hub.config.Backpressure, hub.stats),
+		inbox:         make(chan *Msg, 256),
+		done:          make(chan bool),
 		ws:            ws,
 		subscriptions: make(map[*map[*Conn]bool]bool),
+		quota:         newConnQuota(hub.config.RateLimits, hub.config.Limits.MaxMessageSize),
 		hub:           hub,
 	}
+	conn.outbox.encode = conn.encodeDelta
+	conn.outbox.overflow = func() {
+		hub.closeConn(&conn, conn.outbox.config.CloseCode, "Too far behind on messages")
+	}
 	return &conn, nil
 }
 
 func (conn *Conn) reader() {
+	// Oversized frames close the conn before they are read into memory
+	conn.ws.SetReadLimit(conn.hub.config.Limits.MaxMessageSize)
+	// A peer that stops answering pings times out here, which unregisters it
+	conn.alive()
+	conn.ws.SetPongHandler(func(string) error {
+		conn.alive()
+		return nil
+	})
+	// Nothing else is accepted until the client has said hello
+	_, hello, err := conn.ws.ReadMessage()
+	if err == nil && conn.hub.handshake(conn, hello) {
+		conn.read()
+	}
+	close(conn.done)
+	close(conn.inbox)
+	conn.ws.Close()
+}
+
+func (conn *Conn) read() {
 	for {
 		_, message, err := conn.ws.ReadMessage()
 
 		if err != nil {
 			break
 		}
+		conn.alive()
 
 		conn.hub.route(&RawMsg{
 			Conn:    conn,
 			Payload: message,
 		})
 	}
-	conn.ws.Close()
+}
+
+// Handles this Conn's msgs one after another, so they apply and ack in order
+func (conn *Conn) worker() {
+	for msg := range conn.inbox {
+		conn.hub.safely(conn.hub.dispatch, msg, conn)
+	}
 }
 
 func (conn *Conn) writer() {
-	for message := range conn.outbox {
+	for {
+		message, open := conn.outbox.pop()
+		if !open {
+			break
+		}
+		conn.ws.SetWriteDeadline(time.Now().Add(conn.hub.config.WriteTimeout))
 		err := conn.ws.WriteMessage(websocket.TextMessage, message)
 
 		if err != nil {
@@ -77,6 +145,124 @@ func (conn *Conn) writer() {
 	conn.ws.Close()
 }
 
+// Pings the peer until the reader is done; the pongs keep the read deadline moving
+func (conn *Conn) pinger() {
+	ticker := time.NewTicker(conn.hub.config.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			// Control frames may be written alongside the writer
+			err := conn.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(conn.hub.config.WriteTimeout))
+			if err != nil {
+				return
+			}
+		case <-conn.done:
+			return
+		}
+	}
+}
+
+// Pushes back the read deadline, as the peer has just shown signs of life
+func (conn *Conn) alive() {
+	conn.ws.SetReadDeadline(time.Now().Add(conn.hub.config.PongTimeout))
+}
+
+// Attaches identity to this Conn until its token expires
+func (conn *Conn) authenticate(identity *Identity) {
+	conn.authLock.Lock()
+	defer conn.authLock.Unlock()
+
+	if conn.authTimer != nil {
+		conn.authTimer.Stop()
+	}
+	// Refreshing a token keeps the quota it was already counted against
+	if conn.hub != nil && (conn.identity == nil || conn.identity.Uid != identity.Uid) {
+		if conn.identity != nil {
+			conn.hub.leaveQuota(conn, conn.identity)
+		}
+		conn.hub.joinQuota(conn, identity)
+	}
+	conn.identity = identity
+	expires := identity.Expires
+	if conn.hub != nil {
+		expires = conn.hub.config.Auth.expiry(identity)
+	}
+	conn.authTimer = time.AfterFunc(expires.Sub(time.Now()), func() {
+		conn.authLock.Lock()
+		expired := conn.identity == identity
+		if expired {
+			conn.identity = nil
+			conn.authTimer = nil
+		}
+		conn.authLock.Unlock()
+
+		if expired && conn.hub != nil {
+			log.Printf("Connection #%d's auth token has expired.\n", conn.id)
+			conn.hub.leaveQuota(conn, identity)
+			conn.hub.sendAuthRevoked(conn)
+			conn.hub.recheckReads(conn)
+		}
+	})
+}
+
+func (conn *Conn) unauthenticate() {
+	conn.authLock.Lock()
+	defer conn.authLock.Unlock()
+
+	if conn.authTimer != nil {
+		conn.authTimer.Stop()
+		conn.authTimer = nil
+	}
+	if conn.hub != nil && conn.identity != nil {
+		conn.hub.leaveQuota(conn, conn.identity)
+	}
+	conn.identity = nil
+}
+
+func (conn *Conn) auth() *Identity {
+	conn.authLock.Lock()
+	defer conn.authLock.Unlock()
+	return conn.identity
+}
+
+func (conn *Conn) addDisconnectOp(msg *Msg) {
+	conn.disconnectLock.Lock()
+	conn.disconnectOps = append(conn.disconnectOps, msg)
+	conn.disconnectLock.Unlock()
+}
+
+// Drops the disconnect ops registered at path or beneath it
+func (conn *Conn) cancelDisconnectOps(path Path) {
+	conn.disconnectLock.Lock()
+	defer conn.disconnectLock.Unlock()
+
+	remaining := conn.disconnectOps[:0]
+	for _, op := range conn.disconnectOps {
+		if !op.Path.within(path) {
+			remaining = append(remaining, op)
+		}
+	}
+	conn.disconnectOps = remaining
+}
+
+// Queues ops after any of conn's own
+func (conn *Conn) addDisconnectOps(ops []*Msg) {
+	conn.disconnectLock.Lock()
+	conn.disconnectOps = append(conn.disconnectOps, ops...)
+	conn.disconnectLock.Unlock()
+}
+
+// Hands the disconnect ops over exactly once
+func (conn *Conn) takeDisconnectOps() []*Msg {
+	conn.disconnectLock.Lock()
+	defer conn.disconnectLock.Unlock()
+
+	ops := conn.disconnectOps
+	conn.disconnectOps = nil
+	return ops
+}
+
 func newConnId() uint64 {
 	var newId uint64
 
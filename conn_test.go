@@ -0,0 +1,67 @@
+package turbo
+
+import (
+	"github.com/gorilla/websocket"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeartbeat(t *testing.T) {
+	hub := NewMsgHub(NewMsgBus(), nil, &Config{PingInterval: 20 * time.Millisecond, PongTimeout: 100 * time.Millisecond})
+	go hub.listen()
+	turbo := &Turbo{bus: hub.bus, hub: hub}
+	server := httptest.NewServer(http.HandlerFunc(turbo.Handler))
+	defer server.Close()
+
+	dial := func() *websocket.Conn {
+		ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+		if err != nil {
+			t.Error("Could not connect", err)
+			t.FailNow()
+		}
+		ws.WriteMessage(websocket.TextMessage, []byte(`{"cmd": 20, "version": "1.0"}`))
+		if _, _, err := ws.ReadMessage(); err != nil {
+			t.Error("No welcome", err)
+			t.FailNow()
+		}
+		return ws
+	}
+
+	// Reading is what answers pings, so this one stays alive
+	live := dial()
+	defer live.Close()
+	liveErrs := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := live.ReadMessage(); err != nil {
+				liveErrs <- err
+				return
+			}
+		}
+	}()
+	// This one goes quiet, like a half-open connection
+	dead := dial()
+	defer dead.Close()
+
+	time.Sleep(400 * time.Millisecond)
+	dead.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		_, _, err := dead.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			t.Error("Silent conn was never dropped")
+		}
+		break
+	}
+	select {
+	case err := <-liveErrs:
+		t.Error("Conn answering pings was dropped", err)
+	default:
+	}
+}
@@ -2,43 +2,69 @@ package turbo
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 	"github.com/coopernurse/gorp"
 	_ "github.com/go-sql-driver/mysql"
 	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
-	"errors"
-	"fmt"
+	"log"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
-const {
-	ENTRY_TYPE_NIL = 0
+const (
+	ENTRY_TYPE_NIL     = 0
 	ENTRY_TYPE_BOOLEAN = 1
-	ENTRY_TYPE_FLOAT = 2
-	ENTRY_TYPE_STRING = 3
+	ENTRY_TYPE_FLOAT   = 2
+	ENTRY_TYPE_STRING  = 3
+	// Types from here on are kept alongside values rather than being part of them.
+	// Marks the last write at a path, for trans-sets to compare against
+	ENTRY_TYPE_REVISION = 4
+	// Carries the permissions of a node without a value of its own
+	ENTRY_TYPE_PERMS = 5
+	// Marks a node written as a non-empty array, so it reads back as one
+	ENTRY_TYPE_ARRAY = 6
 
-	ENTRIES_INDEX_QUERY = "CREATE INDEX path ON entries(path)"
-	SELECT_ENTRIES_LIKE = "SELECT * FROM entries WHERE path LIKE ^%s/ OR path LIKE ^%s$"
-}
+	// Escapes LIKE wildcards, since keys may hold underscores and percent signs
+	LIKE_ESCAPE = "!"
+
+	ENTRIES_INDEX_QUERY  = "CREATE INDEX entries_path ON entries(path)"
+	SELECT_VALUES_UNDER  = "SELECT * FROM entries WHERE (type < :revision OR type = :array) AND (path = :path OR path LIKE :prefix ESCAPE '" + LIKE_ESCAPE + "')"
+	SELECT_TYPE_AT       = "SELECT * FROM entries WHERE type = :type AND path = :path"
+	SELECT_PERMS_IN      = "SELECT * FROM entries WHERE type = :type AND path IN (%s)"
+	SELECT_PERMS_UNDER   = "SELECT * FROM entries WHERE type = :type AND path LIKE :prefix ESCAPE '" + LIKE_ESCAPE + "'"
+	SELECT_PERMS_AROUND  = "SELECT * FROM entries WHERE type = :type AND (path IN (%s) OR path LIKE :prefix ESCAPE '" + LIKE_ESCAPE + "')"
+	SELECT_REVISION      = "SELECT COALESCE(MAX(revision), 0) FROM entries WHERE type = :type AND (path IN (%s) OR path LIKE :prefix ESCAPE '" + LIKE_ESCAPE + "')"
+	SELECT_LAST_REVISION = "SELECT COALESCE(MAX(revision), 0) FROM entries WHERE type = :type"
+	// Whatever was at path or beneath it, and anything above it that was a single value; permissions stay
+	SELECT_REPLACED = "SELECT * FROM entries WHERE (type < :revision AND path IN (%s)) OR (type = :array AND path = :path) OR (type <> :perms AND path LIKE :prefix ESCAPE '" + LIKE_ESCAPE + "')"
+)
 
 type Entry struct {
-	Id          int64  `db:"id"`
-	Path        string `db:"path"`
-	Value		sql.NullString `db:"value"`
-	Type 		int `db:"type"`
-	Owner       int64  `db:"owner"`
-	Group       int64  `db:"group"`
-	Permissions uint8  `db:"perm"`
+	Id          int64          `db:"id"`
+	Path        string         `db:"path"`
+	Value       sql.NullString `db:"value"`
+	Type        int            `db:"type"`
+	Owner       int64          `db:"owner"`
+	Group       int64          `db:"group"`
+	Permissions uint8          `db:"perm"`
+	Revision    int64          `db:"revision"`
 }
 
+// Values are stored a leaf to a row, keyed by path
 type Database struct {
 	dbMap *gorp.DbMap
+	// How long each op takes, if anyone is counting
+	latency *histogramVec
 }
 
 // Db Type is either sqlite3, pg, mysql
 func NewDatabase(connString string, dbName string, dbType string) (*Database, error) {
 	db, connErr := sql.Open(dbType, connString)
-	if connErr {
+	if connErr != nil {
 		return nil, connErr
 	}
 
@@ -46,8 +72,10 @@ func NewDatabase(connString string, dbName string, dbType string) (*Database, er
 	switch dbType {
 	case "sqlite3":
 		dialect = gorp.SqliteDialect{}
+		// Every connection to an in-memory db gets a db of its own
+		db.SetMaxOpenConns(1)
 	case "mysql":
-		dialect = gorp.MySQLDialect{}
+		dialect = gorp.MySQLDialect{Engine: "InnoDB", Encoding: "UTF8"}
 	case "pg":
 		dialect = gorp.PostgresDialect{}
 	default:
@@ -59,14 +87,13 @@ func NewDatabase(connString string, dbName string, dbType string) (*Database, er
 	}
 
 	dbMap.AddTableWithName(Entry{}, "entries").SetKeys(true, "Id")
-	createTablesErr := dbmap.CreateTablesIfNotExists()
-	if createTablesErr {
+	createTablesErr := dbMap.CreateTablesIfNotExists()
+	if createTablesErr != nil {
 		return nil, createTablesErr
 	}
-
-	_, indexErr := dbMap.Exec(SQLITE_ENTRIES_INDEX_QUERY)
-	if indexErr {
-		return nil, indexErr
+	// Only there for speed, and already there on every start but the first
+	if _, indexErr := dbMap.Exec(ENTRIES_INDEX_QUERY); indexErr != nil {
+		log.Println("Couldn't index entries by path", indexErr)
 	}
 
 	newDb := Database{}
@@ -74,88 +101,410 @@ func NewDatabase(connString string, dbName string, dbType string) (*Database, er
 	return &newDb, nil
 }
 
-func (db *Database) get(path string) (map[string]interface{}, error) {
-	// Get all entries "LIKE" path
+// The value at path, put back together from its leaves, and its revision
+func (db *Database) get(path Path) (error, interface{}, int) {
+	defer db.latency.since(DB_OP_GET, time.Now())
 	var entries []Entry
-	_, selectErr := db.dbMap.Select(&entries, fmt.Sprintf(SELECT_ENTRIES_LIKE, path, path))
-	if selectErr {
-		return nil, selectErr
+	_, selectErr := db.dbMap.Select(&entries, SELECT_VALUES_UNDER, map[string]interface{}{
+		"revision": ENTRY_TYPE_REVISION,
+		"array":    ENTRY_TYPE_ARRAY,
+		"path":     string(path),
+		"prefix":   likePrefix(path),
+	})
+	if selectErr != nil {
+		return selectErr, nil, 0
+	}
+
+	var value interface{}
+	var arrays [][]string
+	depth := len(path.keys())
+	for _, entry := range entries {
+		if entry.Type == ENTRY_TYPE_ARRAY {
+			arrays = append(arrays, Path(entry.Path).keys()[depth:])
+			continue
+		}
+		leaf, decodeErr := entry.decode()
+		if decodeErr != nil {
+			return decodeErr, nil, 0
+		}
+		value = placeLeaf(value, Path(entry.Path).keys()[depth:], leaf)
+	}
+	// Deepest first, so each array's parent is still a map when its turn comes
+	sort.Slice(arrays, func(i, j int) bool { return len(arrays[i]) > len(arrays[j]) })
+	for _, keys := range arrays {
+		value = restoreArray(value, keys)
+	}
+
+	rev, revErr := db.revision(db.dbMap, path)
+	if revErr != nil {
+		return revErr, nil, 0
+	}
+	return nil, value, int(rev)
+}
+
+// Replaces whatever is at path with value; nil removes it
+func (db *Database) set(path Path, value interface{}) error {
+	return db.setAll(map[Path]interface{}{path: value})
+}
+
+// Replaces whatever is at each path with its value in one transaction, so either every value lands or none do
+func (db *Database) setAll(values map[Path]interface{}) error {
+	defer db.latency.since(DB_OP_SET, time.Now())
+	tx, beginErr := db.dbMap.Begin()
+	if beginErr != nil {
+		return beginErr
+	}
+	for path, value := range values {
+		leaves := make(map[Path]interface{})
+		flatten(path, value, leaves)
+		if setErr := db.replace(tx, path, leaves); setErr != nil {
+			tx.Rollback()
+			return setErr
+		}
+	}
+	return tx.Commit()
+}
+
+func (db *Database) replace(tx *gorp.Transaction, path Path, leaves map[Path]interface{}) error {
+	// Taken before the markers beneath path go, so revisions never run backwards
+	marker, markerErr := db.revisionMarker(tx, path)
+	if markerErr != nil {
+		return markerErr
+	}
+
+	// Values above path are single values that path is about to be written into
+	args := map[string]interface{}{
+		"revision": ENTRY_TYPE_REVISION,
+		"perms":    ENTRY_TYPE_PERMS,
+		"array":    ENTRY_TYPE_ARRAY,
+		"path":     string(path),
+		"prefix":   likePrefix(path),
+	}
+	names := pathArgs(path, args)
+	var replaced []Entry
+	if _, selectErr := tx.Select(&replaced, fmt.Sprintf(SELECT_REPLACED, strings.Join(names, ", ")), args); selectErr != nil {
+		return selectErr
+	}
+	deletes := make([]interface{}, len(replaced))
+	for i := range replaced {
+		deletes[i] = &replaced[i]
+	}
+	if _, deleteErr := tx.Delete(deletes...); deleteErr != nil {
+		return deleteErr
 	}
 
-	resultMap := make(map[string]interface{})
-	for i, entry := range entries {
-		switch entry.Type {
-		case ENTRY_TYPE_NIL:
-			resultMap[entry.Path] = nil
-		case ENTRY_TYPE_BOOLEAN:
-			if entry.Value.String == "true" {
-				resultMap[entry.Path] = true
-			} else {
-				resultMap[entry.Path] = false
-			}
-		case ENTRY_TYPE_FLOAT:
-			resultMap[entry.Path], _ = entry.Value.String.(float64)
-		case ENTRY_TYPE_STRING:
-			resultMap[entry.Path], _ = entry.Value.String
+	// Every leaf lands at, above or beneath path, so one query covers the permissions of all of them
+	permsEntries, permsErr := db.permsAround(tx, path)
+	if permsErr != nil {
+		return permsErr
+	}
+	entries := make([]interface{}, 0, len(leaves)+1)
+	for leafPath, leaf := range leaves {
+		entry, encodeErr := encodeEntry(leafPath, leaf)
+		if encodeErr != nil {
+			return encodeErr
 		}
+		// New entries take on the permissions of the node they land in
+		perms := nearestPerms(permsEntries, leafPath)
+		entry.Owner = perms.Owner
+		entry.Group = perms.Group
+		entry.Permissions = perms.Permissions
+		entries = append(entries, entry)
 	}
 
-	return resultMap, nil
-}
-
-func (db *Database) set(values map[string]interface{}) error {
-	entries := make(*Entry[], len(values), len(values))
-	i := 0
-	for key, value := range values {
-		entry := Entry{}
-		// Handle type and value first
-		switch value.(type) {
-		case bool:
-			entry.Type = ENTRY_TYPE_BOOLEAN
-			if value.(bool) {
-				entry.Value = sql.NullString{
-					String: "true",
-					Valid: true,
-				}
-			} else {
-				entry.Value = sql.NullString{
-					String: "false",
-					Valid: true,
-				}
-			}
-		case float64:
-			entry.Type = ENTRY_TYPE_FLOAT
-			floatVal, err := strconv.ParseFloat(value.(float64), 64)
-			if !err {
-				entry.Value = sql.NullString{
-					String: value,
-					Valid: true,
-				}
-			}
-		case string:
-			entry.Type = ENTRY_TYPE_STRING
-			entry.Value = sql.NullString{
-				String: value.(string),
-				Valid: true,
-			}
-		case nil:
-			entry.Type = ENTRY_TYPE_NIL
-			entry.Value = sql.NullString{
-				String: "",
-				Valid: false,
-			}
-		default:
+	if marker.Id == 0 {
+		entries = append(entries, marker)
+	} else if _, updateErr := tx.Update(marker); updateErr != nil {
+		return updateErr
+	}
+	return tx.Insert(entries...)
+}
+
+// The marker for a write at path, stamped with the next revision
+func (db *Database) revisionMarker(tx *gorp.Transaction, path Path) (*Entry, error) {
+	last, lastErr := tx.SelectInt(SELECT_LAST_REVISION, map[string]interface{}{"type": ENTRY_TYPE_REVISION})
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	marker := Entry{}
+	selectErr := tx.SelectOne(&marker, SELECT_TYPE_AT, map[string]interface{}{
+		"type": ENTRY_TYPE_REVISION,
+		"path": string(path),
+	})
+	if selectErr != nil && selectErr != sql.ErrNoRows {
+		return nil, selectErr
+	}
+	marker.Path = string(path)
+	marker.Type = ENTRY_TYPE_REVISION
+	marker.Revision = last + 1
+	return &marker, nil
+}
+
+// The value at path changes with any write at, above or beneath it, so its revision is the latest of those
+func (db *Database) revision(exec gorp.SqlExecutor, path Path) (int64, error) {
+	args := map[string]interface{}{
+		"type":   ENTRY_TYPE_REVISION,
+		"prefix": likePrefix(path),
+	}
+	names := pathArgs(path, args)
+	return exec.SelectInt(fmt.Sprintf(SELECT_REVISION, strings.Join(names, ", ")), args)
+}
+
+// The permissions in effect at path; the deepest explicitly set ones win
+func (db *Database) perms(path Path) (*NodePerms, error) {
+	defer db.latency.since(DB_OP_PERMS, time.Now())
+	return db.permsWith(db.dbMap, path)
+}
+
+func (db *Database) permsWith(exec gorp.SqlExecutor, path Path) (*NodePerms, error) {
+	var entries []Entry
+	args := map[string]interface{}{
+		"type": ENTRY_TYPE_PERMS,
+	}
+	names := pathArgs(path, args)
+	_, selectErr := exec.Select(&entries, fmt.Sprintf(SELECT_PERMS_IN, strings.Join(names, ", ")), args)
+	if selectErr != nil {
+		return nil, selectErr
+	}
+	return nearestPerms(entries, path), nil
+}
+
+// The explicitly set permissions at path, above it and beneath it
+func (db *Database) permsAround(exec gorp.SqlExecutor, path Path) ([]Entry, error) {
+	var entries []Entry
+	args := map[string]interface{}{
+		"type":   ENTRY_TYPE_PERMS,
+		"prefix": likePrefix(path),
+	}
+	names := pathArgs(path, args)
+	_, selectErr := exec.Select(&entries, fmt.Sprintf(SELECT_PERMS_AROUND, strings.Join(names, ", ")), args)
+	return entries, selectErr
+}
+
+// The permissions in effect at path out of the perms entries given; the deepest one at or above path wins
+func nearestPerms(entries []Entry, path Path) *NodePerms {
+	var nearest *Entry
+	for i := range entries {
+		if !path.within(Path(entries[i].Path)) {
 			continue
 		}
-		entry.Path = key
-		// TODO: owner, group, perms
-		entry.Owner = 0
-		entry.Group = 0
-		entry.Permissions = 0
-
-		entries[i] = &entry
-		i = i + 1
-	}
-	// Put it in the db
-	return db.dbMap.Insert(entries)
-}
\ No newline at end of file
+		if nearest == nil || len(entries[i].Path) > len(nearest.Path) {
+			nearest = &entries[i]
+		}
+	}
+	if nearest == nil {
+		return &NodePerms{Permissions: PERM_DEFAULT}
+	}
+	return &NodePerms{
+		Owner:       nearest.Owner,
+		Group:       nearest.Group,
+		Permissions: nearest.Permissions,
+	}
+}
+
+// The explicitly set permissions of every node beneath path
+func (db *Database) permsBeneath(path Path) (map[Path]*NodePerms, error) {
+	defer db.latency.since(DB_OP_PERMS, time.Now())
+	var entries []Entry
+	_, selectErr := db.dbMap.Select(&entries, SELECT_PERMS_UNDER, map[string]interface{}{
+		"type":   ENTRY_TYPE_PERMS,
+		"prefix": likePrefix(path),
+	})
+	if selectErr != nil {
+		return nil, selectErr
+	}
+	beneath := make(map[Path]*NodePerms, len(entries))
+	for _, entry := range entries {
+		beneath[Path(entry.Path)] = &NodePerms{
+			Owner:       entry.Owner,
+			Group:       entry.Group,
+			Permissions: entry.Permissions,
+		}
+	}
+	return beneath, nil
+}
+
+// Sets explicit permissions at path and restamps the entries beneath it
+func (db *Database) setPerms(path Path, perms *NodePerms) error {
+	defer db.latency.since(DB_OP_SET_PERMS, time.Now())
+	tx, beginErr := db.dbMap.Begin()
+	if beginErr != nil {
+		return beginErr
+	}
+	if setErr := db.stampPerms(tx, path, perms); setErr != nil {
+		tx.Rollback()
+		return setErr
+	}
+	return tx.Commit()
+}
+
+func (db *Database) stampPerms(tx *gorp.Transaction, path Path, perms *NodePerms) error {
+	entry := Entry{}
+	selectErr := tx.SelectOne(&entry, SELECT_TYPE_AT, map[string]interface{}{
+		"type": ENTRY_TYPE_PERMS,
+		"path": string(path),
+	})
+	entry.Path = string(path)
+	entry.Type = ENTRY_TYPE_PERMS
+	entry.Owner = perms.Owner
+	entry.Group = perms.Group
+	entry.Permissions = perms.Permissions
+	if selectErr == sql.ErrNoRows {
+		if insertErr := tx.Insert(&entry); insertErr != nil {
+			return insertErr
+		}
+	} else if selectErr != nil {
+		return selectErr
+	} else if _, updateErr := tx.Update(&entry); updateErr != nil {
+		return updateErr
+	}
+
+	var entries []Entry
+	_, selectErr = tx.Select(&entries, SELECT_VALUES_UNDER, map[string]interface{}{
+		"revision": ENTRY_TYPE_REVISION,
+		"array":    ENTRY_TYPE_ARRAY,
+		"path":     string(path),
+		"prefix":   likePrefix(path),
+	})
+	if selectErr != nil {
+		return selectErr
+	}
+	updates := make([]interface{}, len(entries))
+	for i := range entries {
+		entries[i].Owner = perms.Owner
+		entries[i].Group = perms.Group
+		entries[i].Permissions = perms.Permissions
+		updates[i] = &entries[i]
+	}
+	_, updateErr := tx.Update(updates...)
+	return updateErr
+}
+
+// Stands in among the leaves for a non-empty array, which is stored as a marker at its path
+type arrayMarker struct{}
+
+// Collects the leaves of value by path; empty objects and nulls have none
+func flatten(path Path, value interface{}, leaves map[Path]interface{}) {
+	switch value.(type) {
+	case map[string]interface{}:
+		for key, child := range value.(map[string]interface{}) {
+			flatten(path.child(key), child, leaves)
+		}
+	case []interface{}:
+		if len(value.([]interface{})) > 0 {
+			leaves[path] = arrayMarker{}
+		}
+		for i, child := range value.([]interface{}) {
+			flatten(path.child(strconv.Itoa(i)), child, leaves)
+		}
+	case nil:
+	default:
+		leaves[path] = value
+	}
+}
+
+// Puts leaf at keys within value, filling in the maps along the way; the maps are value's own, not copies
+func placeLeaf(value interface{}, keys []string, leaf interface{}) interface{} {
+	if len(keys) == 0 {
+		return leaf
+	}
+	root, isMap := value.(map[string]interface{})
+	if !isMap {
+		root = make(map[string]interface{})
+	}
+	node := root
+	for _, key := range keys[:len(keys)-1] {
+		child, isMap := node[key].(map[string]interface{})
+		if !isMap {
+			child = make(map[string]interface{})
+			node[key] = child
+		}
+		node = child
+	}
+	node[keys[len(keys)-1]] = leaf
+	return root
+}
+
+// Turns the map at keys within value back into the array it was written as
+func restoreArray(value interface{}, keys []string) interface{} {
+	if len(keys) == 0 {
+		return toArray(value)
+	}
+	parent, isMap := value.(map[string]interface{})
+	for _, key := range keys[:len(keys)-1] {
+		if !isMap {
+			return value
+		}
+		parent, isMap = parent[key].(map[string]interface{})
+	}
+	if child, found := parent[keys[len(keys)-1]]; isMap && found {
+		parent[keys[len(keys)-1]] = toArray(child)
+	}
+	return value
+}
+
+// node as an array if its keys run 0 to n-1; a write of some other key or a lone element leaves it an object
+func toArray(node interface{}) interface{} {
+	nodeMap, isMap := node.(map[string]interface{})
+	if !isMap {
+		return node
+	}
+	array := make([]interface{}, len(nodeMap))
+	for key, child := range nodeMap {
+		index, convErr := strconv.Atoi(key)
+		if convErr != nil || index < 0 || index >= len(array) || strconv.Itoa(index) != key {
+			return node
+		}
+		array[index] = child
+	}
+	return array
+}
+
+func encodeEntry(path Path, value interface{}) (*Entry, error) {
+	entry := Entry{Path: string(path)}
+	switch value.(type) {
+	case bool:
+		entry.Type = ENTRY_TYPE_BOOLEAN
+		entry.Value = sql.NullString{String: strconv.FormatBool(value.(bool)), Valid: true}
+	case float64:
+		entry.Type = ENTRY_TYPE_FLOAT
+		entry.Value = sql.NullString{String: strconv.FormatFloat(value.(float64), 'g', -1, 64), Valid: true}
+	case string:
+		entry.Type = ENTRY_TYPE_STRING
+		entry.Value = sql.NullString{String: value.(string), Valid: true}
+	case arrayMarker:
+		entry.Type = ENTRY_TYPE_ARRAY
+	default:
+		return nil, fmt.Errorf("Can't store a %T at '%s'", value, path)
+	}
+	return &entry, nil
+}
+
+func (entry *Entry) decode() (interface{}, error) {
+	switch entry.Type {
+	case ENTRY_TYPE_BOOLEAN:
+		return entry.Value.String == "true", nil
+	case ENTRY_TYPE_FLOAT:
+		return strconv.ParseFloat(entry.Value.String, 64)
+	case ENTRY_TYPE_STRING:
+		return entry.Value.String, nil
+	}
+	return nil, nil
+}
+
+// Adds path and each of its parents to args, returning their placeholders for an IN list
+func pathArgs(path Path, args map[string]interface{}) []string {
+	var names []string
+	path.cascade(false, func(currPath Path) {
+		name := "path" + strconv.Itoa(len(names))
+		args[name] = string(currPath)
+		names = append(names, ":"+name)
+	})
+	return names
+}
+
+// A LIKE pattern for everything beneath path
+func likePrefix(path Path) string {
+	escaped := strings.NewReplacer(LIKE_ESCAPE, LIKE_ESCAPE+LIKE_ESCAPE, "%", LIKE_ESCAPE+"%", "_", LIKE_ESCAPE+"_").Replace(string(path))
+	return strings.TrimSuffix(escaped, SLASH) + SLASH + "%"
+}
@@ -0,0 +1,89 @@
+package turbo
+
+import (
+	"reflect"
+	"testing"
+)
+
+// A fresh in-memory db, ending the test if it can't be opened
+func newTestDb(t *testing.T) *Database {
+	db, err := NewDatabase(":memory:", "test", "sqlite3")
+	if err != nil {
+		t.Error("Could not open the test database", err)
+		t.FailNow()
+	}
+	return db
+}
+
+func TestDatabase(t *testing.T) {
+	db := newTestDb(t)
+
+	db.set("/a", map[string]interface{}{
+		"b": 1.5,
+		"c": map[string]interface{}{"d": "x", "e": true},
+	})
+	// Wildcards in keys are only keys
+	db.set("/a_b", "other")
+	db.set("/a%25", "escaped")
+	expected := map[string]interface{}{
+		"b": 1.5,
+		"c": map[string]interface{}{"d": "x", "e": true},
+	}
+	if _, value, _ := db.get("/a"); !reflect.DeepEqual(value, expected) {
+		t.Error("Value did not survive the db", value)
+	}
+	if _, value, _ := db.get("/a/c/d"); value != "x" {
+		t.Error("Leaf was wrong", value)
+	}
+
+	// Arrays read back as arrays while their keys run 0 to n-1, and as objects once they don't
+	db.set("/l", map[string]interface{}{"m": []interface{}{"p", []interface{}{1.0, 2.0}}})
+	if _, value, _ := db.get("/l"); !reflect.DeepEqual(value, map[string]interface{}{"m": []interface{}{"p", []interface{}{1.0, 2.0}}}) {
+		t.Error("Arrays did not survive the db", value)
+	}
+	db.set("/l/m/0", nil)
+	if _, value, _ := db.get("/l/m"); !reflect.DeepEqual(value, map[string]interface{}{"1": []interface{}{1.0, 2.0}}) {
+		t.Error("Array with a hole was not an object", value)
+	}
+	db.set("/l/m", map[string]interface{}{"0": "q"})
+	if _, value, _ := db.get("/l/m"); !reflect.DeepEqual(value, map[string]interface{}{"0": "q"}) {
+		t.Error("Object replacing an array read back as one", value)
+	}
+
+	// Writing into a leaf replaces it, and writing a leaf replaces what was beneath
+	db.set("/a/b/deep", "y")
+	db.set("/a/c", 3.0)
+	expected = map[string]interface{}{
+		"b": map[string]interface{}{"deep": "y"},
+		"c": 3.0,
+	}
+	if _, value, _ := db.get("/a"); !reflect.DeepEqual(value, expected) {
+		t.Error("Writes did not replace what they covered", value)
+	}
+
+	// A value's revision moves with writes at, above and beneath it, and never backwards
+	_, _, before := db.get("/a/c")
+	db.set("/a_b", "moved")
+	if _, _, rev := db.get("/a/c"); rev != before {
+		t.Error("Unrelated write moved the revision", before, rev)
+	}
+	db.set("/a/c", 4.0)
+	_, _, afterSet := db.get("/a")
+	db.set("/", map[string]interface{}{"x": 1.0})
+	_, _, afterRoot := db.get("/x")
+	if afterSet <= before || afterRoot <= afterSet {
+		t.Error("Revisions did not move forward", before, afterSet, afterRoot)
+	}
+	if _, value, _ := db.get("/a"); value != nil {
+		t.Error("Writing the root left values behind", value)
+	}
+
+	db.setPerms("/x", &NodePerms{Owner: 3, Permissions: PERM_OWNER_READ})
+	if perms, _ := db.perms("/x/y"); perms.Owner != 3 || perms.Permissions != PERM_OWNER_READ {
+		t.Error("Perms were not inherited", perms)
+	}
+	db.set("/x", nil)
+	if perms, _ := db.perms("/x"); perms.Owner != 3 {
+		t.Error("Removing the value removed its perms", perms)
+	}
+}
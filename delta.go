@@ -0,0 +1,110 @@
+package turbo
+
+import (
+	"encoding/json"
+	"log"
+	"reflect"
+)
+
+// What a client was last sent for a value subscription it wants patches for
+type deltaState struct {
+	value interface{}
+	// False until the client has had a full value to patch against
+	known bool
+}
+
+// A value event as it comes out of the outbox, seq and all
+type deltaEvent struct {
+	Seq   uint64      `json:"seq,omitempty"`
+	Path  string      `json:"path"`
+	Event byte        `json:"eventType"`
+	Data  interface{} `json:"data"`
+	Patch bool        `json:"patch,omitempty"`
+}
+
+// The RFC 7386 merge patch that turns before into after
+func mergePatch(before interface{}, after interface{}) interface{} {
+	beforeMap, beforeIsMap := before.(map[string]interface{})
+	afterMap, afterIsMap := after.(map[string]interface{})
+	if !beforeIsMap || !afterIsMap {
+		return after
+	}
+	patch := make(map[string]interface{})
+	for key := range beforeMap {
+		if afterMap[key] == nil {
+			patch[key] = nil
+		}
+	}
+	for key, value := range afterMap {
+		if value != nil && !reflect.DeepEqual(beforeMap[key], value) {
+			patch[key] = mergePatch(beforeMap[key], value)
+		}
+	}
+	return patch
+}
+
+// Value events on path will be sent as patches from now on, once the client has a full value
+func (conn *Conn) trackDelta(path Path) {
+	conn.deltaLock.Lock()
+	defer conn.deltaLock.Unlock()
+	if conn.deltas == nil {
+		conn.deltas = make(map[Path]*deltaState)
+	}
+	conn.deltas[path] = &deltaState{}
+}
+
+func (conn *Conn) untrackDelta(path Path) {
+	conn.deltaLock.Lock()
+	defer conn.deltaLock.Unlock()
+	delete(conn.deltas, path)
+}
+
+// The paths conn gets patches for
+func (conn *Conn) deltaPaths() []Path {
+	conn.deltaLock.Lock()
+	defer conn.deltaLock.Unlock()
+	paths := make([]Path, 0, len(conn.deltas))
+	for path := range conn.deltas {
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// Carries on the delta subscriptions of a dropped conn, starting again from full values
+func (conn *Conn) resyncDeltas(dropped *Conn) {
+	for _, path := range dropped.deltaPaths() {
+		conn.trackDelta(path)
+	}
+}
+
+// Turns a value event into a patch against what the client was last sent, if it asked for patches.
+// Run by the outbox as each value event is written, so dropped and coalesced events don't count.
+func (conn *Conn) encodeDelta(valuePath string, payload []byte) []byte {
+	conn.deltaLock.Lock()
+	defer conn.deltaLock.Unlock()
+
+	state := conn.deltas[Path(valuePath)]
+	if state == nil {
+		return payload
+	}
+	evt := deltaEvent{}
+	if err := json.Unmarshal(payload, &evt); err != nil {
+		log.Println("Couldn't read a value event to patch", err)
+		return payload
+	}
+	if !state.known {
+		state.value = evt.Data
+		state.known = true
+		return payload
+	}
+	patch := mergePatch(state.value, evt.Data)
+	state.value = evt.Data
+	evt.Data = patch
+	evt.Patch = true
+	patched, err := json.Marshal(evt)
+	if err != nil {
+		log.Println("Couldn't marshal a patch event", err)
+		return payload
+	}
+	return patched
+}
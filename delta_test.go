@@ -0,0 +1,71 @@
+package turbo
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestMergePatch(t *testing.T) {
+	before := map[string]interface{}{
+		"a": 1.0,
+		"b": map[string]interface{}{"c": 2.0, "d": 3.0},
+		"e": []interface{}{1.0},
+	}
+	after := map[string]interface{}{
+		"a": 1.0,
+		"b": map[string]interface{}{"c": 2.0, "f": 4.0},
+		"e": []interface{}{1.0, 2.0},
+	}
+	expected := map[string]interface{}{
+		"b": map[string]interface{}{"d": nil, "f": 4.0},
+		"e": []interface{}{1.0, 2.0},
+	}
+	if patch := mergePatch(before, after); !reflect.DeepEqual(patch, expected) {
+		t.Error("Patch was wrong", patch)
+	}
+	if patch := mergePatch(before, nil); patch != nil {
+		t.Error("Deleting everything should patch with null", patch)
+	}
+	if patch := mergePatch("x", after); !reflect.DeepEqual(patch, after) {
+		t.Error("Replacing a primitive should patch with the new value", patch)
+	}
+}
+
+func TestDeltaEvents(t *testing.T) {
+	db := newTestDb(t)
+	hub := NewMsgHub(NewMsgBus(), db, nil)
+	conn := newTestConn(hub, 1)
+	conn.outbox.encode = conn.encodeDelta
+	db.set("/list", map[string]interface{}{"a": 1.0, "b": 2.0})
+
+	hub.handleOn(&Msg{Cmd: MSG_CMD_ON, Path: "/list", Event: EVENT_TYPE_VALUE, Delta: true}, conn)
+	evt := deltaEvent{}
+	json.Unmarshal(nextPayload(conn.outbox), &evt)
+	if evt.Patch || !reflect.DeepEqual(evt.Data, map[string]interface{}{"a": 1.0, "b": 2.0}) {
+		t.Error("Snapshot was not the whole value", evt)
+	}
+	// The ack that follows the snapshot
+	nextPayload(conn.outbox)
+
+	hub.write("/list", json.RawMessage(`{"a": 1, "c": 3}`), nil)
+	// Everything up to the newest value was coalesced away
+	evt = deltaEvent{}
+	json.Unmarshal(nextPayload(conn.outbox), &evt)
+	if !evt.Patch || !reflect.DeepEqual(evt.Data, map[string]interface{}{"b": nil, "c": 3.0}) {
+		t.Error("Change was not sent as a patch", evt)
+	}
+
+	// Without delta, the whole value is sent as before
+	hub.bus.unsubscribe(EVENT_TYPE_VALUE, "/list", conn)
+	conn.untrackDelta("/list")
+	hub.handleOn(&Msg{Cmd: MSG_CMD_ON, Path: "/list", Event: EVENT_TYPE_VALUE}, conn)
+	nextPayload(conn.outbox)
+	nextPayload(conn.outbox)
+	hub.write("/list", json.RawMessage(`{"a": 2}`), nil)
+	evt = deltaEvent{}
+	json.Unmarshal(nextPayload(conn.outbox), &evt)
+	if evt.Patch || !reflect.DeepEqual(evt.Data, map[string]interface{}{"a": 2.0}) {
+		t.Error("Plain subscription got a patch", evt)
+	}
+}
@@ -0,0 +1,34 @@
+package turbo
+
+// Why a command failed, as sent back in an Ack
+type Error struct {
+	// One of the MSG_ERR_* codes
+	Code    string         `json:"code"`
+	Message string         `json:"message"`
+	Details []*ErrorDetail `json:"details,omitempty"`
+}
+
+// A problem with one path, when a command touches several
+type ErrorDetail struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func NewError(code string, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+func (err *Error) Error() string {
+	return err.Code + ": " + err.Message
+}
+
+// Errors that didn't come from the hub itself are internal
+func asError(err error) *Error {
+	if err == nil {
+		return nil
+	}
+	if turboErr, isTurboErr := err.(*Error); isTurboErr {
+		return turboErr
+	}
+	return NewError(MSG_ERR_INTERNAL, err.Error())
+}
@@ -0,0 +1,110 @@
+package turbo
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Clients must speak the same major version; minor versions only add things
+	PROTOCOL_VERSION       = "1.0"
+	PROTOCOL_MAJOR_VERSION = 1
+
+	SESSION_TOKEN_BYTES = 16
+)
+
+// What this server can do beyond the basic commands
+var PROTOCOL_FEATURES = []string{
+	"query",
+	"shallow",
+	"transactions",
+	"onDisconnect",
+	"auth",
+	"resume",
+	"rules",
+	"perms",
+	"schemas",
+}
+
+// The server's answer to a hello
+type Welcome struct {
+	Type       byte     `json:"type"`
+	Version    string   `json:"version"`
+	Features   []string `json:"features"`
+	ServerTime int64    `json:"serverTime"`
+	Session    string   `json:"session"`
+	// Whether the session in the hello was picked up, so subscriptions needn't be sent again
+	Resumed bool `json:"resumed"`
+}
+
+// Checks the first frame of a conn is a hello we can talk to, and welcomes it.
+// Conns that fail the handshake are closed.
+func (hub *MsgHub) handshake(conn *Conn, payload []byte) bool {
+	msg := Msg{}
+	if err := json.Unmarshal(payload, &msg); err != nil || msg.Cmd != MSG_CMD_HELLO {
+		hub.closeConn(conn, websocket.CloseProtocolError, "Expected a hello")
+		return false
+	}
+	if major, ok := majorVersion(msg.Version); !ok || major != PROTOCOL_MAJOR_VERSION {
+		hub.closeConn(conn, websocket.CloseProtocolError, "Unsupported protocol version '"+msg.Version+"', this server speaks "+PROTOCOL_VERSION)
+		return false
+	}
+	log.Printf("Connection #%d said hello with version %s.\n", conn.id, msg.Version)
+	conn.observeClock(msg.Timestamp)
+
+	if msg.Session != "" {
+		welcome, err := hub.welcome(msg.Session, true)
+		if err == nil && hub.resumeSession(conn, msg.Session, msg.Seq, welcome) != nil {
+			// Subscriptions carried over from the dropped conn hear that we're back
+			hub.setConnected(conn, true)
+			return true
+		}
+	}
+	token, err := newSessionToken()
+	if err != nil {
+		log.Println("Couldn't make a session token", err)
+		hub.closeConn(conn, websocket.CloseInternalServerErr, "Could not start a session")
+		return false
+	}
+	welcome, err := hub.welcome(token, false)
+	if err != nil {
+		log.Println("Couldn't marshal the welcome", err)
+		hub.closeConn(conn, websocket.CloseInternalServerErr, "Could not welcome the client")
+		return false
+	}
+	conn.outbox.push(welcome)
+	conn.session = hub.startSession(conn, token)
+	hub.setConnected(conn, true)
+	return true
+}
+
+func (hub *MsgHub) welcome(token string, resumed bool) ([]byte, error) {
+	return json.Marshal(Welcome{
+		Type:       MSG_CMD_WELCOME,
+		Version:    PROTOCOL_VERSION,
+		Features:   PROTOCOL_FEATURES,
+		ServerTime: time.Now().UnixNano() / int64(time.Millisecond),
+		Session:    token,
+		Resumed:    resumed,
+	})
+}
+
+func majorVersion(version string) (int, bool) {
+	major, err := strconv.Atoi(strings.SplitN(version, DOT, 2)[0])
+	return major, err == nil
+}
+
+// Session tokens stand in for the conn on reconnect, so they must not be guessable
+func newSessionToken() (string, error) {
+	token := make([]byte, SESSION_TOKEN_BYTES)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
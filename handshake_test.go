@@ -0,0 +1,202 @@
+package turbo
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestHandshake(t *testing.T) {
+	hub := NewMsgHub(NewMsgBus(), nil, nil)
+	go hub.listen()
+	newConn := func(id uint64) *Conn {
+		conn := newTestConn(hub, id)
+		hub.registerConn(conn)
+		return conn
+	}
+	conn := newConn(1)
+	if !hub.handshake(conn, []byte(`{"cmd": 20, "version": "1.3"}`)) {
+		t.Error("Compatible hello was refused")
+	}
+	welcome := Welcome{}
+	json.Unmarshal(nextPayload(conn.outbox), &welcome)
+	if welcome.Type != MSG_CMD_WELCOME || welcome.Version != PROTOCOL_VERSION || welcome.ServerTime == 0 {
+		t.Error("Welcome was wrong", welcome)
+	}
+	if len(welcome.Session) != SESSION_TOKEN_BYTES*2 || conn.session == nil || welcome.Session != conn.session.token {
+		t.Error("Welcome had a bad session token", welcome.Session)
+	}
+
+	conn = newConn(2)
+	if hub.handshake(conn, []byte(`{"cmd": 20, "version": "2.0"}`)) || !closedWithin(conn.outbox, time.Second) {
+		t.Error("Hello from the future was not refused")
+	}
+	conn = newConn(3)
+	if hub.handshake(conn, []byte(`{"cmd": 3, "path": "/a", "data": 1}`)) || !closedWithin(conn.outbox, time.Second) {
+		t.Error("Conn that skipped the hello was not refused")
+	}
+}
+
+func TestSessionResume(t *testing.T) {
+	db := newTestDb(t)
+	hub := NewMsgHub(NewMsgBus(), db, &Config{ReplayBufferSize: 4})
+	go hub.listen()
+	newConn := func(id uint64) *Conn {
+		conn := newTestConn(hub, id)
+		hub.registerConn(conn)
+		return conn
+	}
+	type stampedEvent struct {
+		Seq  uint64      `json:"seq"`
+		Data interface{} `json:"data"`
+	}
+	// Sets clear the old value before sending the new one, so skip to the event we want
+	eventFor := func(conn *Conn, data string) stampedEvent {
+		for payload, open := conn.outbox.pop(); open; payload, open = conn.outbox.pop() {
+			evt := stampedEvent{}
+			json.Unmarshal(payload, &evt)
+			if evt.Data == data {
+				return evt
+			}
+		}
+		return stampedEvent{}
+	}
+	set := func(value string) {
+		hub.handleSet(&Msg{Cmd: MSG_CMD_SET, Path: "/chat", Data: json.RawMessage(`"` + value + `"`)}, newTestConn(nil, 0))
+	}
+
+	first := newConn(1)
+	hub.handshake(first, []byte(`{"cmd": 20, "version": "1.0"}`))
+	welcome := Welcome{}
+	json.Unmarshal(nextPayload(first.outbox), &welcome)
+	hub.handleOn(&Msg{Cmd: MSG_CMD_ON, Path: "/chat", Event: EVENT_TYPE_VALUE}, first)
+	set("a")
+	seen := eventFor(first, "a")
+	if seen.Seq < 2 {
+		t.Error("Events were not numbered", seen)
+	}
+
+	// Events carry on into the session while the client is away, and disconnect ops wait to see if it comes back
+	first.authenticate(&Identity{Uid: "bob", Expires: time.Now().Add(time.Hour)})
+	hub.handleOnDisconnect(&Msg{Cmd: MSG_CMD_ON_DISCONNECT_SET, Path: "/gone", Data: json.RawMessage(`true`)}, first)
+	hub.unregisterConn(first)
+	closedWithin(first.outbox, time.Second)
+	set("b")
+	if _, value, _ := db.get("/gone"); value != nil {
+		t.Error("Disconnect op ran while the session was parked", value)
+	}
+
+	second := newConn(2)
+	hub.handshake(second, []byte(fmt.Sprintf(`{"cmd": 20, "version": "1.0", "session": "%s", "seq": %d}`, welcome.Session, seen.Seq)))
+	resumed := Welcome{}
+	json.Unmarshal(nextPayload(second.outbox), &resumed)
+	if !resumed.Resumed || resumed.Session != welcome.Session {
+		t.Error("Session was not resumed", resumed)
+		t.FailNow()
+	}
+	// Replayed values are coalesced like any others
+	missed := stampedEvent{}
+	json.Unmarshal(nextPayload(second.outbox), &missed)
+	if missed.Seq <= seen.Seq || missed.Data != "b" {
+		t.Error("Missed event was not replayed", missed)
+	}
+	// The subscription came along with the session, along with who it was read as
+	set("c")
+	if evt := eventFor(second, "c"); evt.Seq == 0 {
+		t.Error("Subscription was not restored", evt)
+	}
+	if identity := second.auth(); identity == nil || identity.Uid != "bob" {
+		t.Error("Identity was not restored", identity)
+	}
+	if ops := second.takeDisconnectOps(); len(ops) != 1 {
+		t.Error("Disconnect ops were not handed over", ops)
+	}
+
+	// Once events have fallen out of the buffer, the client has to start over
+	hub.unregisterConn(second)
+	closedWithin(second.outbox, time.Second)
+	third := newConn(3)
+	hub.handshake(third, []byte(`{"cmd": 20, "version": "1.0", "session": "`+welcome.Session+`", "seq": 1}`))
+	fresh := Welcome{}
+	json.Unmarshal(nextPayload(third.outbox), &fresh)
+	if fresh.Resumed || fresh.Session == welcome.Session {
+		t.Error("Session was resumed without the events in between", fresh)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	db := newTestDb(t)
+	hub := NewMsgHub(NewMsgBus(), db, &Config{SessionTimeout: 100 * time.Millisecond})
+	go hub.listen()
+	newConn := func(id uint64, hello string) (*Conn, Welcome) {
+		conn := newTestConn(hub, id)
+		hub.registerConn(conn)
+		hub.handshake(conn, []byte(hello))
+		welcome := Welcome{}
+		json.Unmarshal(nextPayload(conn.outbox), &welcome)
+		return conn, welcome
+	}
+	hello := `{"cmd": 20, "version": "1.0"}`
+
+	// A session that is never resumed runs its disconnect ops once it expires
+	conn, _ := newConn(1, hello)
+	hub.handleOnDisconnect(&Msg{Cmd: MSG_CMD_ON_DISCONNECT_SET, Path: "/gone", Data: json.RawMessage(`true`)}, conn)
+	hub.unregisterConn(conn)
+	for start := time.Now(); ; time.Sleep(5 * time.Millisecond) {
+		if _, value, _ := db.get("/gone"); value == true {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Error("Disconnect ops never ran")
+			break
+		}
+	}
+
+	// Nor can a session be resumed once the identity it was read as has expired
+	conn, welcome := newConn(2, hello)
+	conn.authenticate(&Identity{Uid: "bob", Expires: time.Now().Add(20 * time.Millisecond)})
+	hub.unregisterConn(conn)
+	closedWithin(conn.outbox, time.Second)
+	time.Sleep(40 * time.Millisecond)
+	if _, fresh := newConn(3, `{"cmd": 20, "version": "1.0", "session": "`+welcome.Session+`", "seq": 0}`); fresh.Resumed {
+		t.Error("Session outlived its identity")
+	}
+}
+
+func TestDisconnectGrace(t *testing.T) {
+	db := newTestDb(t)
+	hub := NewMsgHub(NewMsgBus(), db, &Config{DisconnectGrace: 20 * time.Millisecond})
+	go hub.listen()
+	conn := newTestConn(hub, 1)
+	hub.registerConn(conn)
+	hub.handshake(conn, []byte(`{"cmd": 20, "version": "1.0"}`))
+	welcome := Welcome{}
+	json.Unmarshal(nextPayload(conn.outbox), &welcome)
+
+	// A client that drops and doesn't come back runs its disconnect ops long before its session expires
+	hub.handleOnDisconnect(&Msg{Cmd: MSG_CMD_ON_DISCONNECT_SET, Path: "/gone", Data: json.RawMessage(`true`)}, conn)
+	hub.unregisterConn(conn)
+	for start := time.Now(); ; time.Sleep(5 * time.Millisecond) {
+		if _, value, _ := db.get("/gone"); value == true {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Error("Disconnect ops did not run once the grace period was up")
+			break
+		}
+	}
+
+	// The session is still there to come back to, without the ops that already ran
+	resumed := newTestConn(hub, 2)
+	hub.registerConn(resumed)
+	hub.handshake(resumed, []byte(`{"cmd": 20, "version": "1.0", "session": "`+welcome.Session+`", "seq": 0}`))
+	back := Welcome{}
+	json.Unmarshal(nextPayload(resumed.outbox), &back)
+	if !back.Resumed {
+		t.Error("Session did not outlast the grace period", back)
+	}
+	if ops := resumed.takeDisconnectOps(); len(ops) != 0 {
+		t.Error("Disconnect ops were handed over after they ran", ops)
+	}
+}
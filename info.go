@@ -0,0 +1,70 @@
+package turbo
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	INFO_PATH               = "/.info"
+	INFO_CONNECTED          = "connected"
+	INFO_SERVER_TIME_OFFSET = "serverTimeOffset"
+	INFO_CONNECTION_ID      = "connectionId"
+)
+
+var errInfoReadOnly = NewError(MSG_ERR_PERMISSION_DENIED, "The .info subtree is read only")
+
+// The .info subtree is served by the hub for each conn and never touches the db
+func isInfoPath(path Path) bool {
+	return path.within(INFO_PATH)
+}
+
+func (hub *MsgHub) infoValue(path Path, conn *Conn) interface{} {
+	conn.infoLock.Lock()
+	info := map[string]interface{}{
+		INFO_CONNECTED:     conn.connected,
+		INFO_CONNECTION_ID: conn.id,
+	}
+	// Left out until the client has sent us a timestamp to go by
+	if conn.clockOffset != nil {
+		info[INFO_SERVER_TIME_OFFSET] = *conn.clockOffset
+	}
+	conn.infoLock.Unlock()
+
+	if path == INFO_PATH {
+		return info
+	}
+	return info[strings.TrimPrefix(string(path), INFO_PATH+SLASH)]
+}
+
+// Learns how far the client's clock is behind ours from a msg it timestamped
+func (conn *Conn) observeClock(timestamp int64) {
+	if timestamp <= 0 {
+		return
+	}
+	offset := time.Now().UnixNano()/int64(time.Millisecond) - timestamp
+	conn.infoLock.Lock()
+	conn.clockOffset = &offset
+	conn.infoLock.Unlock()
+}
+
+// Marks conn as connected or not, sending the change to whatever it has on .info.
+// Once the conn is gone there is nobody left to tell, so the client marks itself disconnected.
+func (hub *MsgHub) setConnected(conn *Conn, connected bool) {
+	conn.infoLock.Lock()
+	changed := conn.connected != connected
+	conn.connected = connected
+	conn.infoLock.Unlock()
+	if !changed || !connected {
+		return
+	}
+	for _, path := range []Path{INFO_PATH, Path(INFO_PATH).child(INFO_CONNECTED)} {
+		if hub.bus.isSubscribed(EVENT_TYPE_VALUE, path, conn) {
+			hub.sendEvent(conn, &ValueEvent{
+				Path:  path,
+				Event: EVENT_TYPE_VALUE,
+				Data:  hub.infoValue(path, conn),
+			})
+		}
+	}
+}
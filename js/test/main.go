@@ -17,7 +17,11 @@ func main() {
 	// Log config
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 	// Make a turbo instance
-	err, tbo := turbo.New("mongodb://bitbeam.info:27017", "test", "entries")
+	err, tbo := turbo.New(&turbo.Config{
+		ConnectionString: "./test.db",
+		DbName:           "test",
+		DbType:           "sqlite3",
+	})
 	if err != nil {
 		return
 	}
@@ -38,6 +42,7 @@ func main() {
 	}
 	// Register turbo handler
 	http.HandleFunc("/ws", tbo.Handler)
+	http.HandleFunc("/metrics", tbo.MetricsHandler)
 	// Register the static files
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir(staticPath))))
 	http.HandleFunc("/turbo.js", func(res http.ResponseWriter, req *http.Request) {
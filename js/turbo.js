@@ -11,7 +11,20 @@ var Turbo = (function() {
         MSG_CMD_TRANS_GET = 8,
         MSG_CMD_AUTH = 9,
         MSG_CMD_UNAUTH = 10,
-        MSG_CMD_ACK = 11;
+        MSG_CMD_ACK = 11,
+        MSG_CMD_GET = 12,
+        MSG_CMD_ON_DISCONNECT_SET = 13,
+        MSG_CMD_ON_DISCONNECT_UPDATE = 14,
+        MSG_CMD_ON_DISCONNECT_REMOVE = 15,
+        MSG_CMD_ON_DISCONNECT_CANCEL = 16,
+        MSG_CMD_AUTH_REVOKED = 17,
+        MSG_CMD_CHMOD = 18,
+        MSG_CMD_CHOWN = 19,
+        MSG_CMD_HELLO = 20,
+        MSG_CMD_WELCOME = 21,
+        MSG_CMD_PATCH = 22;
+
+    var PROTOCOL_VERSION = '1.0';
 
     var EVENT_TYPE_VALUE = 0,
         EVENT_TYPE_CHILD_ADDED = 1,
@@ -25,13 +38,29 @@ var Turbo = (function() {
         EVENT_TYPE_CHILD_MOVED_STR = 'child_moved',
         EVENT_TYPE_CHILD_REMOVED_STR = 'child_removed';
 
+    var ERR_PERMISSION_DENIED = 'permission_denied',
+        ERR_CONFLICT = 'conflict',
+        ERR_INVALID_DATA = 'invalid_data',
+        ERR_NOT_FOUND = 'not_found',
+        ERR_TOO_LARGE = 'too_large',
+        ERR_RATE_LIMITED = 'rate_limited',
+        ERR_INTERNAL = 'internal';
+
+    var INFO_CONNECTED_PATH = '/.info/connected';
+
     var _ws = undefined;
     var _listeners = {};
-    var _ack = 0;
+    // Acks for 0 answer msgs nobody waits on, such as resubscribes
+    var _ack = 1;
     var _ackCallbacks = {};
     var _token = undefined;
+    var _onAuthCancel = undefined;
     var _isOffline = true;
     var _offlineQueue = [];
+    var _session = undefined;
+    var _lastSeq = 0;
+    // The last whole value of each value subscription, for applying patches to
+    var _values = {};
 
     var _send = function _send(val) {
         console.log("Sending: ", val);
@@ -48,13 +77,22 @@ var Turbo = (function() {
         _ws = new WebSocket(url);
 
         _ws.onopen = function(evt) {
-            _isOffline = false;
-            if (onConnect) onConnect(evt);
+            // Nothing else goes out until the server has welcomed us
+            _ws.send(JSON.stringify({
+                'cmd': MSG_CMD_HELLO,
+                'version': PROTOCOL_VERSION,
+                'session': _session,
+                'seq': _lastSeq,
+                // Lets the server work out .info/serverTimeOffset
+                'timestamp': Date.now()
+            }));
             console.log('Connection opened.', evt);
         };
         _ws.onclose = function(evt) {
             _isOffline = true;
-            if (onClose) onClose();
+            // The server can't tell us this one
+            _dispatch(url, INFO_CONNECTED_PATH, EVENT_TYPE_VALUE, false);
+            if (onClose) onClose(evt.code, evt.reason);
             console.log('Connection closed.', evt);
         };
         _ws.onerror = function(evt) {
@@ -68,27 +106,36 @@ var Turbo = (function() {
             try {
                 var msg = JSON.parse(evt.data);
                 switch (msg.type) {
+                    case MSG_CMD_WELCOME:
+                        // A resumed session replays what we missed; otherwise we have to ask again
+                        var resubscribe = _session !== undefined && !msg.resumed;
+                        _session = msg.session;
+                        if (!msg.resumed) _lastSeq = 0;
+                        if (resubscribe) _resubscribe();
+                        _isOffline = false;
+                        while (_offlineQueue.length > 0) _ws.send(_offlineQueue.shift());
+                        if (onConnect) onConnect(msg);
+                        break;
                     case MSG_CMD_ACK:
                         if (_ackCallbacks[msg.ack]) {
-                            _ackCallbacks[msg.ack](msg.err, msg.res, msg.revision);
+                            _ackCallbacks[msg.ack](msg.err ? new TurboError(msg.err) : null, msg.data, msg.revision);
                             delete _ackCallbacks[msg.ack];
                         }
                         break;
+                    case MSG_CMD_AUTH_REVOKED:
+                        _token = undefined;
+                        if (_onAuthCancel) _onAuthCancel('Auth token expired');
+                        _onAuthCancel = undefined;
+                        break;
                     default:
-                        if (!msg.eventType || !msg.path) return; // Filter for 'on' events
-
-                        if (_listeners[msg.path] && _listeners[msg.path][msg.eventType]) {
-                            var listenerMap = _listeners[msg.path][msg.eventType];
-                            for (var listenerRef in listenerMap) {
-                                var listener;
-                                if (listener = listenerMap[listenerRef]) {
-                                    var context = listener.context || listenerRef;
-                                    if (listener.callback) {
-                                        listener.callback.call(context, new DataSnapShot(msg.value, this._url, msg.path));
-                                    }
-                                }
-                            }
+                        if (msg.eventType === undefined || !msg.path) return; // Filter for 'on' events
+                        if (msg.seq) _lastSeq = msg.seq;
+                        if (msg.eventType === EVENT_TYPE_VALUE) {
+                            if (msg.patch) msg.data = _applyMergePatch(_values[msg.path], msg.data);
+                            _values[msg.path] = msg.data;
                         }
+
+                        _dispatch(url, msg.path, msg.eventType, msg.data, msg.name);
                 }
             } catch (e) {
                 console.log('Could not process message; json parsing is failing', e);
@@ -96,6 +143,50 @@ var Turbo = (function() {
         };
     };
 
+    var _dispatch = function _dispatch(url, path, eventType, data, name) {
+        if (!_listeners[path] || !_listeners[path][eventType]) return;
+
+        var listenerMap = _listeners[path][eventType];
+        for (var listenerRef in listenerMap) {
+            var listener;
+            if (listener = listenerMap[listenerRef]) {
+                var context = listener.context || listenerRef;
+                if (listener.callback) {
+                    listener.callback.call(context, new DataSnapshot(data, url, name ? _joinPaths(path, name) : path));
+                }
+            }
+        }
+    };
+
+    // RFC 7386
+    var _applyMergePatch = function _applyMergePatch(target, patch) {
+        if (patch === null || typeof patch !== 'object' || Array.isArray(patch)) return patch;
+        var result = {};
+        if (target !== null && typeof target === 'object' && !Array.isArray(target)) {
+            for (var key in target) result[key] = target[key];
+        }
+        for (var key in patch) {
+            if (patch[key] === null) delete result[key];
+            else result[key] = _applyMergePatch(result[key], patch[key]);
+        }
+        return result;
+    };
+
+    var _resubscribe = function _resubscribe() {
+        for (var path in _listeners) {
+            for (var eventType in _listeners[path]) {
+                if (Object.keys(_listeners[path][eventType]).length === 0) continue;
+                _ws.send(JSON.stringify({
+                    'cmd': MSG_CMD_ON,
+                    'eventType': parseInt(eventType, 10),
+                    'path': path,
+                    'delta': parseInt(eventType, 10) === EVENT_TYPE_VALUE,
+                    'timestamp': Date.now()
+                }));
+            }
+        }
+    };
+
     var _disconnect = function _disconnect() {
         console.log('Disconnecting');
         _isOffline = true;
@@ -113,7 +204,7 @@ var Turbo = (function() {
             'ack': ack
         }));
         _ackCallbacks[ack] = function(err, newValue, rev) {
-            if (err === 'conflict') _attemptTransSet(path, newValue, rev, transform, done);
+            if (err && err.code === ERR_CONFLICT) _attemptTransSet(path, newValue, rev, transform, done);
             else if (err) done(err);
             else done(undefined, newValue);
         };
@@ -164,6 +255,29 @@ var Turbo = (function() {
         return path;
     };
 
+    // Percent escapes the characters the server won't take in a key, to match EscapeKey
+    var _escapeKey = function _escapeKey(key) {
+        return String(key).replace(/[\x00-\x1f\x7f%\/.#$\[\]]/g, function(char) {
+            var hex = char.charCodeAt(0).toString(16).toUpperCase();
+            return '%' + (hex.length < 2 ? '0' + hex : hex);
+        });
+    };
+
+    var _unescapeKey = function _unescapeKey(key) {
+        return String(key).replace(/%([0-9A-Fa-f]{2})/g, function(escape, hex) {
+            return String.fromCharCode(parseInt(hex, 16));
+        });
+    };
+
+    // Keys come from the server escaped, as they are in paths
+    var _unescapeKeys = function _unescapeKeys(value) {
+        if (value === null || typeof value !== 'object') return value;
+        if (Array.isArray(value)) return value.map(_unescapeKeys);
+        var result = {};
+        for (var key in value) result[_unescapeKey(key)] = _unescapeKeys(value[key]);
+        return result;
+    };
+
     var _joinPaths = function _joinPaths(base, ext) {
         base = _sanitizePath(base);
         return base + '/' + ext;
@@ -237,11 +351,21 @@ var Turbo = (function() {
 
         var self = this;
         var path = self._path;
+        var ack = _ack++;
         _send(JSON.stringify({
             'cmd': MSG_CMD_ON,
             'eventType': eventType,
-            'path': path
+            'path': path,
+            'ack': ack,
+            // We keep the last value around, so only changes need sending
+            'delta': eventType === EVENT_TYPE_VALUE,
+            // Lets the server work out .info/serverTimeOffset
+            'timestamp': Date.now()
         }));
+        // The server acks once the snapshot has been sent, or to refuse the subscription
+        _ackCallbacks[ack] = function(err) {
+            if (err && cancelCallback) cancelCallback.call(context, err);
+        };
 
         if (!_listeners[path]) _listeners[path] = {};
         if (!_listeners[path][eventType]) _listeners[path][eventType] = {};
@@ -254,7 +378,33 @@ var Turbo = (function() {
         return callback;
     };
 
-    Client.prototype.off = function(eventType, callback, context) {
+    Client.prototype.once = function(eventTypeStr, successCallback, failureCallback, context) {
+        if (_eventType(eventTypeStr) !== EVENT_TYPE_VALUE)
+            throw new Error('Turbo only supports once(...) for \'' + EVENT_TYPE_VALUE_STR + '\' right now');
+
+        if (!successCallback || typeof successCallback !== 'function') throw 'Callback was not a function';
+        if (failureCallback && !context && typeof failureCallback === 'object') {
+            context = failureCallback;
+            failureCallback = undefined;
+        }
+
+        var self = this;
+        var ack = _ack++;
+        _send(JSON.stringify({
+            'cmd': MSG_CMD_GET,
+            'path': self._path,
+            'ack': ack
+        }));
+        _ackCallbacks[ack] = function(err, value) {
+            if (err) {
+                if (failureCallback) failureCallback.call(context, err);
+            } else {
+                successCallback.call(context, new DataSnapshot(value, self._url, self._path));
+            }
+        };
+    };
+
+    Client.prototype.off = function(eventTypeStr, callback, context) {
         var eventType = _eventType(eventTypeStr);
         if (!eventType && eventType !== 0)
             throw 'Unsupported event type \'' + eventTypeStr + '\'';
@@ -268,6 +418,7 @@ var Turbo = (function() {
         if (!_listeners[path][eventType]) return;
         if (!_listeners[path][eventType][self]) return;
         delete _listeners[path][eventType][self];
+        if (eventType === EVENT_TYPE_VALUE) delete _values[path];
 
         _send(JSON.stringify({
             'cmd': MSG_CMD_OFF,
@@ -276,9 +427,14 @@ var Turbo = (function() {
         }));
     };
 
+    // childPath is one or more slash separated keys, each escaped on the way into the path
     Client.prototype.child = function(childPath) {
         if (!childPath) return this;
-        return new Client(this._url, _joinPaths(this._path, childPath));
+        var keys = String(childPath).split('/').filter(function(key) {
+            return key !== '';
+        });
+        if (keys.length === 0) return this;
+        return new Client(this._url, _joinPaths(this._path, keys.map(_escapeKey).join('/')));
     };
 
     Client.prototype.parent = function() {
@@ -326,8 +482,21 @@ var Turbo = (function() {
         _ackCallbacks[ack] = onComplete;
     };
 
+    // ops is a list of RFC 6902 operations, relative to this path
+    Client.prototype.patch = function(ops, onComplete) {
+        var self = this;
+        var ack = _ack++;
+        _send(JSON.stringify({
+            'cmd': MSG_CMD_PATCH,
+            'path': self._path,
+            'ops': ops,
+            'ack': ack
+        }));
+        _ackCallbacks[ack] = onComplete;
+    };
+
     Client.prototype.name = function() {
-        return this._path.split('/').pop();
+        return _unescapeKey(this._path.split('/').pop());
     };
 
     Client.prototype.setWithPriority = function(newVal, newPriority, onComplete) {
@@ -369,22 +538,22 @@ var Turbo = (function() {
         _send(JSON.stringify({
             'cmd': MSG_CMD_PUSH,
             'path': self._path,
-            'value': value,
+            'data': value,
             'ack': ack
         }));
         _ackCallbacks[ack] = onComplete;
     };
 
     Client.prototype.onDisconnect = function() {
-        throw 'Turbo does not support onDisconnect(...) right now';
+        return new OnDisconnect(this._path);
     };
 
-    Client.prototype.removeOnDisconnect = function() {
-        throw 'Turbo does not support removeOnDisconnect(...) right now';
+    Client.prototype.removeOnDisconnect = function(onComplete) {
+        this.onDisconnect().remove(onComplete);
     };
 
-    Client.prototype.setOnDisconnect = function(onDc) {
-        throw 'Turbo does not support setOnDisconnect(...) right now';
+    Client.prototype.setOnDisconnect = function(value, onComplete) {
+        this.onDisconnect().set(value, onComplete);
     };
 
     Client.prototype.auth = function(cred, onComplete, onCancel) {
@@ -394,7 +563,13 @@ var Turbo = (function() {
             'cred': cred,
             'ack': ack
         }));
-        _ackCallbacks[ack] = onComplete;
+        _ackCallbacks[ack] = function(err, claims) {
+            if (!err) {
+                _token = cred;
+                _onAuthCancel = onCancel;
+            }
+            if (onComplete) onComplete(err, claims);
+        };
     };
 
     Client.prototype.unauth = function(onComplete) {
@@ -408,10 +583,35 @@ var Turbo = (function() {
         }));
         _ackCallbacks[ack] = function(err, res) {
             _token = undefined;
-            onComplete(err, res);
+            _onAuthCancel = undefined;
+            if (onComplete) onComplete(err, res);
         };
     };
 
+    Client.prototype.chmod = function(permissions, onComplete) {
+        var ack = _ack++;
+        _send(JSON.stringify({
+            'cmd': MSG_CMD_CHMOD,
+            'path': this._path,
+            'permissions': permissions,
+            'ack': ack
+        }));
+        _ackCallbacks[ack] = onComplete;
+    };
+
+    Client.prototype.chown = function(owner, group, onComplete) {
+        var ack = _ack++;
+        var msg = {
+            'cmd': MSG_CMD_CHOWN,
+            'path': this._path,
+            'ack': ack
+        };
+        if (owner !== undefined && owner !== null) msg.owner = owner;
+        if (group !== undefined && group !== null) msg.group = group;
+        _send(JSON.stringify(msg));
+        _ackCallbacks[ack] = onComplete;
+    };
+
     Client.prototype.goOffline = function() {
         _disconnect();
     };
@@ -429,8 +629,62 @@ var Turbo = (function() {
         throw 'Turbo does not support enableLogging(...) right now';
     };
 
+    // Why the server refused a command; code is one of the ERR_* constants
+    function TurboError(err) {
+        this.name = 'TurboError';
+        this.code = err.code;
+        this.message = err.message;
+        this.details = err.details || [];
+    }
+
+    TurboError.prototype = Object.create(Error.prototype);
+    TurboError.prototype.constructor = TurboError;
+
+    TurboError.prototype.toString = function() {
+        return this.code + ': ' + this.message;
+    };
+
+    // Writes the server performs once this client's connection drops
+    function OnDisconnect(path) {
+        this._path = path;
+    }
+
+    OnDisconnect.prototype._register = function(msg, onComplete) {
+        var ack = _ack++;
+        msg.path = this._path;
+        msg.ack = ack;
+        _send(JSON.stringify(msg));
+        _ackCallbacks[ack] = onComplete;
+    };
+
+    OnDisconnect.prototype.set = function(value, onComplete) {
+        this._register({
+            'cmd': MSG_CMD_ON_DISCONNECT_SET,
+            'data': value
+        }, onComplete);
+    };
+
+    OnDisconnect.prototype.update = function(values, onComplete) {
+        this._register({
+            'cmd': MSG_CMD_ON_DISCONNECT_UPDATE,
+            'dataMap': values
+        }, onComplete);
+    };
+
+    OnDisconnect.prototype.remove = function(onComplete) {
+        this._register({
+            'cmd': MSG_CMD_ON_DISCONNECT_REMOVE
+        }, onComplete);
+    };
+
+    OnDisconnect.prototype.cancel = function(onComplete) {
+        this._register({
+            'cmd': MSG_CMD_ON_DISCONNECT_CANCEL
+        }, onComplete);
+    };
+
     function DataSnapshot(baseObj, url, path) {
-        this._baseObj = baseObj;
+        this._baseObj = _unescapeKeys(baseObj);
         this._url = url;
         this._path = path;
     }
@@ -440,8 +694,13 @@ var Turbo = (function() {
     };
 
     DataSnapshot.prototype.child = function(childName) {
-        return new DataSnapshot(this._baseObj[childName]);
-    }
+        // Its keys are unescaped already, so it skips the constructor
+        var child = Object.create(DataSnapshot.prototype);
+        child._baseObj = this._baseObj[childName];
+        child._url = this._url;
+        child._path = _joinPaths(this._path, _escapeKey(childName));
+        return child;
+    };
 
     DataSnapshot.prototype.forEach = function(childAction) {
         for (var child in this._baseObj) {
@@ -458,7 +717,7 @@ var Turbo = (function() {
     };
 
     DataSnapshot.prototype.name = function() {
-        return this._baseObj.split('/').pop();
+        return _unescapeKey(this._path.split('/').pop());
     };
 
     DataSnapshot.prototype.numChildren = function() {
@@ -477,5 +736,16 @@ var Turbo = (function() {
         //TODO: are we doing priority? if not this is the same as val()
     };
 
+    Client.Error = TurboError;
+    Client.ERR_PERMISSION_DENIED = ERR_PERMISSION_DENIED;
+    Client.ERR_CONFLICT = ERR_CONFLICT;
+    Client.ERR_INVALID_DATA = ERR_INVALID_DATA;
+    Client.ERR_NOT_FOUND = ERR_NOT_FOUND;
+    Client.ERR_TOO_LARGE = ERR_TOO_LARGE;
+    Client.ERR_RATE_LIMITED = ERR_RATE_LIMITED;
+    Client.ERR_INTERNAL = ERR_INTERNAL;
+    Client.escapeKey = _escapeKey;
+    Client.unescapeKey = _unescapeKey;
+
     return Client;
 })();
\ No newline at end of file
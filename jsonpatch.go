@@ -0,0 +1,278 @@
+package turbo
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	PATCH_OP_ADD     = "add"
+	PATCH_OP_REMOVE  = "remove"
+	PATCH_OP_REPLACE = "replace"
+	PATCH_OP_MOVE    = "move"
+	PATCH_OP_COPY    = "copy"
+	PATCH_OP_TEST    = "test"
+)
+
+// One RFC 6902 operation; paths are json pointers relative to the patched path
+type PatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+// Applies every op to a copy of doc, or none of them if any fails
+func applyPatch(doc interface{}, ops []*PatchOp) (interface{}, *Error) {
+	doc = deepCopy(doc)
+	for i, op := range ops {
+		var err *Error
+		doc, err = op.apply(doc)
+		if err != nil {
+			err.Message = "Op #" + strconv.Itoa(i) + " (" + op.Op + " " + op.Path + "): " + err.Message
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+func (op *PatchOp) apply(doc interface{}) (interface{}, *Error) {
+	tokens, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	switch op.Op {
+	case PATCH_OP_ADD, PATCH_OP_REPLACE, PATCH_OP_TEST:
+		var value interface{}
+		if op.Value == nil {
+			return nil, NewError(MSG_ERR_INVALID_DATA, "Missing value")
+		}
+		if jsonErr := json.Unmarshal(op.Value, &value); jsonErr != nil {
+			return nil, NewError(MSG_ERR_INVALID_DATA, jsonErr.Error())
+		}
+		if op.Op == PATCH_OP_ADD {
+			return pointerAdd(doc, tokens, value)
+		}
+		if op.Op == PATCH_OP_TEST {
+			current, err := pointerGet(doc, tokens)
+			if err != nil {
+				return nil, err
+			}
+			if !reflect.DeepEqual(current, value) {
+				return nil, NewError(MSG_ERR_TRANS_CONFLICT, "Test failed")
+			}
+			return doc, nil
+		}
+		if doc, err = pointerRemove(doc, tokens); err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, tokens, value)
+	case PATCH_OP_REMOVE:
+		return pointerRemove(doc, tokens)
+	case PATCH_OP_MOVE, PATCH_OP_COPY:
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		value, err := pointerGet(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == PATCH_OP_COPY {
+			return pointerAdd(doc, tokens, deepCopy(value))
+		}
+		// A value can't be moved inside itself
+		if len(from) < len(tokens) && reflect.DeepEqual(from, tokens[:len(from)]) {
+			return nil, NewError(MSG_ERR_INVALID_DATA, "Can't move a value into one of its children")
+		}
+		if doc, err = pointerRemove(doc, from); err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, tokens, value)
+	}
+	return nil, NewError(MSG_ERR_INVALID_DATA, "Unknown op '"+op.Op+"'")
+}
+
+// Splits a json pointer into its unescaped tokens
+func parsePointer(pointer string) ([]string, *Error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, SLASH) {
+		return nil, NewError(MSG_ERR_INVALID_DATA, "Pointer '"+pointer+"' must start with a slash")
+	}
+	tokens := strings.Split(pointer[1:], SLASH)
+	for i, token := range tokens {
+		tokens[i] = strings.Replace(strings.Replace(token, "~1", SLASH, -1), "~0", "~", -1)
+	}
+	return tokens, nil
+}
+
+func pointerGet(doc interface{}, tokens []string) (interface{}, *Error) {
+	for _, token := range tokens {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			child, exists := node[token]
+			if !exists {
+				return nil, NewError(MSG_ERR_NOT_FOUND, "No value at '"+token+"'")
+			}
+			doc = child
+		case []interface{}:
+			index, err := arrayIndex(token, len(node)-1)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[index]
+		default:
+			return nil, NewError(MSG_ERR_NOT_FOUND, "No value at '"+token+"'")
+		}
+	}
+	return doc, nil
+}
+
+func pointerAdd(doc interface{}, tokens []string, value interface{}) (interface{}, *Error) {
+	return pointerEdit(doc, tokens, value, func(parent interface{}, token string) (interface{}, *Error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			node[token] = value
+			return node, nil
+		case []interface{}:
+			index := len(node)
+			if token != "-" {
+				var err *Error
+				if index, err = arrayIndex(token, len(node)); err != nil {
+					return nil, err
+				}
+			}
+			node = append(node, nil)
+			copy(node[index+1:], node[index:])
+			node[index] = value
+			return node, nil
+		}
+		return nil, NewError(MSG_ERR_NOT_FOUND, "Can't add '"+token+"' to a primitive")
+	})
+}
+
+func pointerRemove(doc interface{}, tokens []string) (interface{}, *Error) {
+	return pointerEdit(doc, tokens, nil, func(parent interface{}, token string) (interface{}, *Error) {
+		switch node := parent.(type) {
+		case map[string]interface{}:
+			if _, exists := node[token]; !exists {
+				return nil, NewError(MSG_ERR_NOT_FOUND, "No value at '"+token+"'")
+			}
+			delete(node, token)
+			return node, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(node)-1)
+			if err != nil {
+				return nil, err
+			}
+			return append(node[:index], node[index+1:]...), nil
+		}
+		return nil, NewError(MSG_ERR_NOT_FOUND, "No value at '"+token+"'")
+	})
+}
+
+// Walks down to the parent of the last token, lets edit change it, and puts the result back in place.
+// Editing the whole document just replaces it.
+func pointerEdit(doc interface{}, tokens []string, whole interface{}, edit func(interface{}, string) (interface{}, *Error)) (interface{}, *Error) {
+	if len(tokens) == 0 {
+		return whole, nil
+	}
+	if len(tokens) == 1 {
+		return edit(doc, tokens[0])
+	}
+	child, err := pointerGet(doc, tokens[:1])
+	if err != nil {
+		return nil, err
+	}
+	child, err = pointerEdit(child, tokens[1:], whole, edit)
+	if err != nil {
+		return nil, err
+	}
+	// Slices may have moved, so the child is always put back
+	switch node := doc.(type) {
+	case map[string]interface{}:
+		node[tokens[0]] = child
+	case []interface{}:
+		index, _ := arrayIndex(tokens[0], len(node)-1)
+		node[index] = child
+	}
+	return doc, nil
+}
+
+func arrayIndex(token string, max int) (int, *Error) {
+	index, err := strconv.Atoi(token)
+	// Leading zeros aren't allowed
+	if err != nil || index < 0 || strconv.Itoa(index) != token {
+		return 0, NewError(MSG_ERR_INVALID_DATA, "'"+token+"' is not an array index")
+	}
+	if index > max {
+		return 0, NewError(MSG_ERR_NOT_FOUND, "Index "+token+" is out of bounds")
+	}
+	return index, nil
+}
+
+func deepCopy(value interface{}) interface{} {
+	switch node := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(node))
+		for key, child := range node {
+			copied[key] = deepCopy(child)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(node))
+		for i, child := range node {
+			copied[i] = deepCopy(child)
+		}
+		return copied
+	}
+	return value
+}
+
+// Applies msg.Ops to the value at msg.Path as one write; a failed test op leaves it untouched
+func (hub *MsgHub) handlePatch(msg *Msg, conn *Conn) {
+	if len(msg.Ops) == 0 {
+		hub.sendAck(conn, msg.Ack, NewError(MSG_ERR_INVALID_DATA, "A patch needs at least one op"), nil, 0)
+		return
+	}
+	if isInfoPath(msg.Path) {
+		hub.sendAck(conn, msg.Ack, errInfoReadOnly, nil, 0)
+		return
+	}
+
+	hub.locker.lock(msg.Path)
+	defer hub.locker.unlock(msg.Path)
+	err, before, _ := hub.db.get(msg.Path)
+	if err != nil {
+		hub.sendAck(conn, msg.Ack, asError(err), nil, 0)
+		return
+	}
+	after, patchErr := applyPatch(before, msg.Ops)
+	if patchErr != nil {
+		hub.sendAck(conn, msg.Ack, patchErr, nil, 0)
+		return
+	}
+	// Checked against the result, so rules see exactly what will be written
+	if !hub.canWrite(conn, msg.Path, after) {
+		hub.sendPermissionDenied(conn, msg)
+		return
+	}
+	if violations := hub.validateWrite(msg.Path, after); len(violations) > 0 {
+		hub.sendInvalidData(conn, msg, violations)
+		return
+	}
+	data, jsonErr := json.Marshal(after)
+	if jsonErr != nil {
+		hub.sendAck(conn, msg.Ack, NewError(MSG_ERR_INVALID_DATA, jsonErr.Error()), nil, 0)
+		return
+	}
+	if setErr := hub.commit(msg.Path, after, data); setErr != nil {
+		hub.sendAck(conn, msg.Ack, asError(setErr), nil, 0)
+		return
+	}
+	hub.sendAck(conn, msg.Ack, nil, nil, 0)
+}
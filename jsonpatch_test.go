@@ -0,0 +1,138 @@
+package turbo
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestApplyPatch(t *testing.T) {
+	cases := []struct {
+		doc    string
+		ops    string
+		result string
+		code   string
+	}{
+		{`{"foo": "bar"}`, `[{"op": "add", "path": "/baz", "value": "qux"}]`, `{"foo": "bar", "baz": "qux"}`, ""},
+		{`{"foo": ["bar", "baz"]}`, `[{"op": "add", "path": "/foo/1", "value": "qux"}]`, `{"foo": ["bar", "qux", "baz"]}`, ""},
+		{`{"foo": ["bar"]}`, `[{"op": "add", "path": "/foo/-", "value": "baz"}]`, `{"foo": ["bar", "baz"]}`, ""},
+		{`{"foo": "bar", "baz": "qux"}`, `[{"op": "remove", "path": "/baz"}]`, `{"foo": "bar"}`, ""},
+		{`{"foo": ["bar", "qux", "baz"]}`, `[{"op": "remove", "path": "/foo/1"}]`, `{"foo": ["bar", "baz"]}`, ""},
+		{`{"foo": "bar", "baz": "qux"}`, `[{"op": "replace", "path": "/baz", "value": "boo"}]`, `{"foo": "bar", "baz": "boo"}`, ""},
+		{`{"foo": {"bar": "baz", "waldo": "fred"}, "qux": {"corge": "grault"}}`, `[{"op": "move", "from": "/foo/waldo", "path": "/qux/thud"}]`,
+			`{"foo": {"bar": "baz"}, "qux": {"corge": "grault", "thud": "fred"}}`, ""},
+		{`{"foo": ["all", "grass", "cows", "eat"]}`, `[{"op": "move", "from": "/foo/1", "path": "/foo/3"}]`, `{"foo": ["all", "cows", "eat", "grass"]}`, ""},
+		{`{"foo": {"bar": 1}}`, `[{"op": "copy", "from": "/foo", "path": "/baz"}, {"op": "add", "path": "/baz/bar", "value": 2}]`,
+			`{"foo": {"bar": 1}, "baz": {"bar": 2}}`, ""},
+		{`{"a/b": 1, "m~n": 2}`, `[{"op": "test", "path": "/a~1b", "value": 1}, {"op": "remove", "path": "/m~0n"}]`, `{"a/b": 1}`, ""},
+		{`{"foo": "bar"}`, `[{"op": "replace", "path": "", "value": 5}]`, `5`, ""},
+		{`null`, `[{"op": "add", "path": "", "value": {"a": 1}}, {"op": "add", "path": "/b", "value": null}]`, `{"a": 1, "b": null}`, ""},
+		{`{"baz": "qux"}`, `[{"op": "test", "path": "/baz", "value": "bar"}]`, ``, MSG_ERR_TRANS_CONFLICT},
+		{`{"baz": "qux"}`, `[{"op": "add", "path": "/a", "value": 1}, {"op": "test", "path": "/baz", "value": "bar"}]`, ``, MSG_ERR_TRANS_CONFLICT},
+		{`{"foo": "bar"}`, `[{"op": "remove", "path": "/baz"}]`, ``, MSG_ERR_NOT_FOUND},
+		{`{"foo": "bar"}`, `[{"op": "add", "path": "/baz/bat", "value": "qux"}]`, ``, MSG_ERR_NOT_FOUND},
+		{`{"foo": [1]}`, `[{"op": "add", "path": "/foo/01", "value": 2}]`, ``, MSG_ERR_INVALID_DATA},
+		{`{"foo": {"bar": 1}}`, `[{"op": "move", "from": "/foo", "path": "/foo/bar"}]`, ``, MSG_ERR_INVALID_DATA},
+		{`{"foo": "bar"}`, `[{"op": "add", "path": "/baz"}]`, ``, MSG_ERR_INVALID_DATA},
+		{`{"foo": "bar"}`, `[{"op": "frob", "path": "/foo"}]`, ``, MSG_ERR_INVALID_DATA},
+		{`{"foo": "bar"}`, `[{"op": "remove", "path": "foo"}]`, ``, MSG_ERR_INVALID_DATA},
+	}
+	for _, c := range cases {
+		var doc interface{}
+		var ops []*PatchOp
+		json.Unmarshal([]byte(c.doc), &doc)
+		json.Unmarshal([]byte(c.ops), &ops)
+		original := deepCopy(doc)
+
+		result, err := applyPatch(doc, ops)
+		if c.code != "" {
+			if err == nil || err.Code != c.code {
+				t.Error("Expected", c.ops, "to fail with", c.code, "but got", err)
+			}
+		} else {
+			var expected interface{}
+			json.Unmarshal([]byte(c.result), &expected)
+			if err != nil || !reflect.DeepEqual(result, expected) {
+				t.Error("Expected", c.ops, "to give", c.result, "but got", result, err)
+			}
+		}
+		if !reflect.DeepEqual(doc, original) {
+			t.Error("Patching", c.ops, "changed the original document", doc)
+		}
+	}
+}
+
+func TestHandlePatch(t *testing.T) {
+	db := newTestDb(t)
+	hub := NewMsgHub(NewMsgBus(), db, nil)
+	conn := newTestConn(hub, 1)
+	db.set("/doc", map[string]interface{}{"a": 1.0, "b": 2.0})
+	hub.bus.subscribe(EVENT_TYPE_VALUE, "/doc", conn)
+	hub.bus.subscribe(EVENT_TYPE_CHILD_ADDED, "/doc", conn)
+
+	// Returns the ack, along with the events that came before it
+	patch := func(path Path, ops string) (Ack, []ValueEvent) {
+		msg := Msg{Cmd: MSG_CMD_PATCH, Path: path, Ack: 1}
+		json.Unmarshal([]byte(ops), &msg.Ops)
+		hub.handlePatch(&msg, conn)
+		events := []ValueEvent{}
+		for {
+			payload := nextPayload(conn.outbox)
+			ack := Ack{}
+			json.Unmarshal(payload, &ack)
+			if ack.Type == MSG_CMD_ACK {
+				return ack, events
+			}
+			evt := ValueEvent{}
+			json.Unmarshal(payload, &evt)
+			events = append(events, evt)
+		}
+	}
+
+	// A failed test throws away the ops before it
+	ack, events := patch("/doc", `[{"op": "remove", "path": "/a"}, {"op": "test", "path": "/b", "value": 3}]`)
+	if ackCode(ack) != MSG_ERR_TRANS_CONFLICT {
+		t.Error("Failed test op was not a conflict", ack.Error)
+	}
+	if _, val, _ := db.get("/doc"); !reflect.DeepEqual(val, map[string]interface{}{"a": 1.0, "b": 2.0}) {
+		t.Error("Failed patch was partly applied", val)
+	}
+	if len(events) > 0 {
+		t.Error("Failed patch published events", events)
+	}
+
+	ack, events = patch("/doc", `[{"op": "test", "path": "/b", "value": 2}, {"op": "move", "from": "/a", "path": "/c"}]`)
+	if ack.Error != nil {
+		t.Error("Patch failed", ack.Error)
+	}
+	if _, val, _ := db.get("/doc"); !reflect.DeepEqual(val, map[string]interface{}{"b": 2.0, "c": 1.0}) {
+		t.Error("Patch was not applied", val)
+	}
+	var sawValue, sawChild bool
+	for _, evt := range events {
+		if evt.Event == EVENT_TYPE_VALUE && reflect.DeepEqual(evt.Data, map[string]interface{}{"b": 2.0, "c": 1.0}) {
+			sawValue = true
+		}
+		if evt.Event == EVENT_TYPE_CHILD_ADDED && evt.Name == "c" && evt.Data == 1.0 {
+			sawChild = true
+		}
+	}
+	if !sawValue || !sawChild {
+		t.Error("Patch did not publish its value and child events", events)
+	}
+
+	// Arrays come back out of the db as arrays, so appending to one adds an element
+	db.set("/doc/list", []interface{}{"x"})
+	if ack, _ = patch("/doc", `[{"op": "add", "path": "/list/-", "value": "y"}]`); ack.Error != nil {
+		t.Error("Append failed", ack.Error)
+	}
+	if _, val, _ := db.get("/doc/list"); !reflect.DeepEqual(val, []interface{}{"x", "y"}) {
+		t.Error("Append did not extend the array", val)
+	}
+
+	// The .info subtree can't be patched
+	ack, _ = patch("/.info/connected", `[{"op": "remove", "path": ""}]`)
+	if ackCode(ack) != MSG_ERR_PERMISSION_DENIED {
+		t.Error("Patching .info was not denied", ack.Error)
+	}
+}
@@ -0,0 +1,118 @@
+package turbo
+
+import (
+	"github.com/gorilla/websocket"
+	"strconv"
+)
+
+const (
+	LIMIT_MESSAGE_SIZE_DEFAULT = 1 << 20
+	LIMIT_DEPTH_DEFAULT        = 32
+	LIMIT_KEYS_DEFAULT         = 1000
+	LIMIT_PATH_LENGTH_DEFAULT  = 768
+)
+
+// Bounds on what a single msg may carry; zero picks the default
+type PayloadLimits struct {
+	// Bytes in one websocket frame
+	MaxMessageSize int64
+	// Levels of nesting in data, dataMap and patch values
+	MaxDepth int
+	// Properties in a dataMap, and ops in a patch
+	MaxKeys int
+	// Characters in a path
+	MaxPathLength int
+}
+
+func (limits PayloadLimits) orDefaults() PayloadLimits {
+	if limits.MaxMessageSize == 0 {
+		limits.MaxMessageSize = LIMIT_MESSAGE_SIZE_DEFAULT
+	}
+	if limits.MaxDepth == 0 {
+		limits.MaxDepth = LIMIT_DEPTH_DEFAULT
+	}
+	if limits.MaxKeys == 0 {
+		limits.MaxKeys = LIMIT_KEYS_DEFAULT
+	}
+	if limits.MaxPathLength == 0 {
+		limits.MaxPathLength = LIMIT_PATH_LENGTH_DEFAULT
+	}
+	return limits
+}
+
+// How deeply raw json nests, and how many properties its outermost object has.
+// Scans the bytes rather than unmarshalling, so oversized data is caught before it is built.
+func jsonShape(raw []byte) (depth int, keys int) {
+	level := 0
+	inString, escaped := false, false
+	for _, char := range raw {
+		if inString {
+			if escaped {
+				escaped = false
+			} else if char == '\\' {
+				escaped = true
+			} else if char == '"' {
+				inString = false
+			}
+			continue
+		}
+		switch char {
+		case '"':
+			inString = true
+		case '{', '[':
+			level++
+			if level > depth {
+				depth = level
+			}
+		case '}', ']':
+			level--
+		case ':':
+			// Each property has exactly one colon outside of strings
+			if level == 1 {
+				keys++
+			}
+		}
+	}
+	return depth, keys
+}
+
+// Checks msg against the payload limits before any of its data is unmarshalled or written
+func (hub *MsgHub) checkLimits(msg *Msg) *Error {
+	limits := hub.config.Limits
+	if len(msg.Path) > limits.MaxPathLength {
+		return NewError(MSG_ERR_TOO_LARGE, "Paths may be at most "+strconv.Itoa(limits.MaxPathLength)+" characters long")
+	}
+	if depth, _ := jsonShape(msg.Data); depth > limits.MaxDepth {
+		return hub.tooDeep()
+	}
+	depth, keys := jsonShape(msg.DataMap)
+	// The dataMap's own level doesn't count against its values
+	if depth > limits.MaxDepth+1 {
+		return hub.tooDeep()
+	}
+	if keys > limits.MaxKeys {
+		return NewError(MSG_ERR_TOO_LARGE, "Updates may have at most "+strconv.Itoa(limits.MaxKeys)+" properties")
+	}
+	if len(msg.Ops) > limits.MaxKeys {
+		return NewError(MSG_ERR_TOO_LARGE, "Patches may have at most "+strconv.Itoa(limits.MaxKeys)+" ops")
+	}
+	for _, op := range msg.Ops {
+		if depth, _ := jsonShape(op.Value); depth > limits.MaxDepth {
+			return hub.tooDeep()
+		}
+	}
+	return nil
+}
+
+func (hub *MsgHub) tooDeep() *Error {
+	return NewError(MSG_ERR_TOO_LARGE, "Data may be nested at most "+strconv.Itoa(hub.config.Limits.MaxDepth)+" levels deep")
+}
+
+// Frames that got past the read limit some other way are refused outright
+func (hub *MsgHub) checkMessageSize(conn *Conn, payload []byte) bool {
+	if int64(len(payload)) <= hub.config.Limits.MaxMessageSize {
+		return true
+	}
+	hub.closeConn(conn, websocket.CloseMessageTooBig, "Messages may be at most "+strconv.FormatInt(hub.config.Limits.MaxMessageSize, 10)+" bytes")
+	return false
+}
@@ -0,0 +1,59 @@
+package turbo
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJsonShape(t *testing.T) {
+	cases := []struct {
+		raw   string
+		depth int
+		keys  int
+	}{
+		{``, 0, 0},
+		{`5`, 0, 0},
+		{`{"a": 1, "b": {"c": [1, 2]}}`, 3, 2},
+		{`[[[]]]`, 3, 0},
+		// Brackets and colons inside strings don't count
+		{`{"a:{[": "}]\"{:", "b": "x"}`, 1, 2},
+	}
+	for _, c := range cases {
+		depth, keys := jsonShape([]byte(c.raw))
+		if depth != c.depth || keys != c.keys {
+			t.Error("Shape of", c.raw, "should be", c.depth, c.keys, "but was", depth, keys)
+		}
+	}
+}
+
+func TestPayloadLimits(t *testing.T) {
+	hub := NewMsgHub(NewMsgBus(), nil, &Config{Limits: PayloadLimits{MaxMessageSize: 256, MaxDepth: 3, MaxKeys: 2, MaxPathLength: 10}})
+	go hub.listen()
+	conn := newTestConn(hub, 1)
+	hub.registerConn(conn)
+
+	cases := []*Msg{
+		{Cmd: MSG_CMD_SET, Path: "/a/very/long/path", Data: json.RawMessage(`1`)},
+		{Cmd: MSG_CMD_SET, Path: "/a", Data: json.RawMessage(`{"b": {"c": {"d": {}}}}`)},
+		{Cmd: MSG_CMD_UPDATE, Path: "/a", DataMap: json.RawMessage(`{"b": 1, "c": 2, "d": 3}`)},
+		{Cmd: MSG_CMD_UPDATE, Path: "/a", DataMap: json.RawMessage(`{"b": [[[[1]]]]}`)},
+		{Cmd: MSG_CMD_PATCH, Path: "/a", Ops: []*PatchOp{{Op: PATCH_OP_ADD, Path: "/b", Value: json.RawMessage(`[[[[]]]]`)}}},
+	}
+	for i, msg := range cases {
+		msg.Ack = i
+		hub.dispatch(msg, conn)
+		ack := Ack{}
+		json.Unmarshal(nextPayload(conn.outbox), &ack)
+		if ack.Ack != i || ackCode(ack) != MSG_ERR_TOO_LARGE {
+			t.Error("Oversized msg", i, "was not refused", ack.Error)
+		}
+	}
+
+	// Frames over the size limit are not even parsed
+	hub.route(&RawMsg{Conn: conn, Payload: []byte(`{"cmd": 3, "path": "/a", "data": "` + strings.Repeat("x", 256) + `"}`)})
+	if !closedWithin(conn.outbox, time.Second) {
+		t.Error("Oversized frame did not close the conn")
+	}
+}
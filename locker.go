@@ -2,96 +2,117 @@ package turbo
 
 import (
 	"sync"
+	"time"
 )
 
 type Lock struct {
-	main   *sync.Mutex
-	queue  *sync.Mutex
-	count  uint
-	key    string
-	locker *Locker
+	main  *sync.RWMutex
+	count uint
+	key   Path
 }
 
 type Locker struct {
-	locks map[string]*Lock
+	// Guards locks and the lock counts
+	queue *sync.Mutex
+	locks map[Path]*Lock
+	// Time spent waiting for locks, if anyone is counting
+	wait *histogram
 }
 
 func NewLocker() *Locker {
 	return &Locker{
-		locks: make(map[string]*Lock),
+		queue: &sync.Mutex{},
+		locks: make(map[Path]*Lock),
 	}
 }
 
-func (locker *Locker) lock(path string) {
-	cascadePath(path, false, func(currPath string) {
+func (locker *Locker) lock(path Path) {
+	defer locker.wait.since(time.Now())
+	path.cascade(false, func(currPath Path) {
 		locker.lockOne(currPath)
 	})
 }
 
-func (locker *Locker) unlock(path string) {
-	cascadePath(path, false, func(currPath string) {
+func (locker *Locker) unlock(path Path) {
+	path.cascade(false, func(currPath Path) {
 		locker.unlockOne(currPath)
 	})
 }
 
-func (locker *Locker) lockOne(key string) {
-	if locker.locks[key] == nil {
-		locker.locks[key] = &Lock{
-			main:   &sync.Mutex{},
-			queue:  &sync.Mutex{},
-			count:  0,
-			key:    key,
-			locker: locker,
-		}
-	}
-	locker.locks[key].lock()
+// Shared counterpart of lock; readers of a path only exclude writers
+func (locker *Locker) rlock(path Path) {
+	defer locker.wait.since(time.Now())
+	path.cascade(false, func(currPath Path) {
+		locker.rlockOne(currPath)
+	})
 }
 
-func (locker *Locker) unlockOne(key string) {
-	if locker.locks[key] == nil {
+func (locker *Locker) runlock(path Path) {
+	path.cascade(false, func(currPath Path) {
+		locker.runlockOne(currPath)
+	})
+}
+
+func (locker *Locker) lockOne(key Path) {
+	// Do the mutal exclusion
+	locker.enqueue(key).main.Lock()
+}
+
+func (locker *Locker) unlockOne(key Path) {
+	lock := locker.find(key)
+	if lock == nil {
 		return
 	}
-	locker.locks[key].unlock()
+	// Undo the mutal exclusion
+	lock.main.Unlock()
+	locker.dequeue(lock)
 }
 
-func (lock *Lock) lock() {
-	// Make sure the mutex queue exists
-	if lock.queue == nil {
-		lock.queue = &sync.Mutex{}
-	}
+func (locker *Locker) rlockOne(key Path) {
+	// Only exclude writers
+	locker.enqueue(key).main.RLock()
+}
 
-	lock.queue.Lock()
-	// Make sure the main mutex exists
-	if lock.main == nil {
-		lock.main = &sync.Mutex{}
+func (locker *Locker) runlockOne(key Path) {
+	lock := locker.find(key)
+	if lock == nil {
+		return
 	}
-	// Check if the lock.locker knows this lock exists
-	if lock.locker.locks[lock.key] == nil {
-		lock.locker.locks[lock.key] = lock
+	lock.main.RUnlock()
+	locker.dequeue(lock)
+}
+
+func (locker *Locker) find(key Path) *Lock {
+	locker.queue.Lock()
+	defer locker.queue.Unlock()
+	return locker.locks[key]
+}
+
+// Registers interest in a lock, creating it if nobody holds it yet
+func (locker *Locker) enqueue(key Path) *Lock {
+	locker.queue.Lock()
+	defer locker.queue.Unlock()
+
+	lock := locker.locks[key]
+	if lock == nil {
+		lock = &Lock{
+			main:  &sync.RWMutex{},
+			count: 0,
+			key:   key,
+		}
+		locker.locks[key] = lock
 	}
 	lock.count += 1
-	lock.queue.Unlock()
-	// Do the mutal exclusion
-	lock.main.Lock()
+	return lock
 }
 
-func (lock *Lock) unlock() {
-	if lock.main == nil || lock.queue == nil {
-		return
-	}
-	// Undo the mutal exclusion
-	lock.main.Unlock()
-	// Drop from the queue
-	lock.queue.Lock()
+// Drops interest in a lock; the last one out disposes of it
+func (locker *Locker) dequeue(lock *Lock) {
+	locker.queue.Lock()
+	defer locker.queue.Unlock()
+
 	lock.count -= 1
 	if lock.count <= 0 {
-		// Remove this lock from the lock.locker
-		delete(lock.locker.locks, lock.key)
-		// Dispose of the mutexes
-		lock.queue.Unlock()
-		lock.main = nil
-		lock.queue = nil
-	} else {
-		lock.queue.Unlock()
+		delete(locker.locks, lock.key)
 	}
 }
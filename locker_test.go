@@ -1,15 +1,16 @@
 package turbo
-/*
+
 import (
 	"sync"
 	"testing"
+	"time"
 )
 
 func TestLocker(t *testing.T) {
 	initialWg := &sync.WaitGroup{}
 	finalWg := &sync.WaitGroup{}
 	locker := NewLocker()
-	str := "this is a test string"
+	str := Path("this is a test string")
 
 	initialWg.Add(100)
 	finalWg.Add(100)
@@ -24,5 +25,37 @@ func TestLocker(t *testing.T) {
 		})()
 	}
 	finalWg.Wait()
+
+	if len(locker.locks) != 0 {
+		t.Error("Locker did not dispose of its locks", len(locker.locks))
+	}
+}
+
+func TestReadLock(t *testing.T) {
+	locker := NewLocker()
+	written := make(chan bool)
+
+	// Two readers can hold the same path at once
+	locker.rlock("/a/b")
+	locker.rlock("/a/b")
+	// A write to a parent path has to wait for both of them
+	go (func() {
+		locker.lock("/a")
+		written <- true
+		locker.unlock("/a")
+	})()
+
+	locker.runlock("/a/b")
+	select {
+	case <-written:
+		t.Error("Writer got the lock while a reader still held it")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	locker.runlock("/a/b")
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Error("Writer never got the lock")
+	}
 }
-*/
@@ -0,0 +1,290 @@
+package turbo
+
+import (
+	"bufio"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	METRICS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+	DB_OP_GET       = "get"
+	DB_OP_SET       = "set"
+	DB_OP_PERMS     = "perms"
+	DB_OP_SET_PERMS = "set_perms"
+
+	// The error label of acks that carried no error
+	ACK_OK = "none"
+)
+
+var (
+	// How many conns a publish reached
+	FANOUT_BUCKETS = []float64{0, 1, 2, 5, 10, 25, 50, 100, 250, 1000}
+	// Seconds spent waiting on a lock or the db
+	LATENCY_BUCKETS = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+	cmdNames = map[byte]string{
+		MSG_CMD_ON:                   "on",
+		MSG_CMD_OFF:                  "off",
+		MSG_CMD_SET:                  "set",
+		MSG_CMD_UPDATE:               "update",
+		MSG_CMD_REMOVE:               "remove",
+		MSG_CMD_TRANS_SET:            "trans_set",
+		MSG_CMD_PUSH:                 "push",
+		MSG_CMD_TRANS_GET:            "trans_get",
+		MSG_CMD_AUTH:                 "auth",
+		MSG_CMD_UNAUTH:               "unauth",
+		MSG_CMD_GET:                  "get",
+		MSG_CMD_ON_DISCONNECT_SET:    "on_disconnect_set",
+		MSG_CMD_ON_DISCONNECT_UPDATE: "on_disconnect_update",
+		MSG_CMD_ON_DISCONNECT_REMOVE: "on_disconnect_remove",
+		MSG_CMD_ON_DISCONNECT_CANCEL: "on_disconnect_cancel",
+		MSG_CMD_CHMOD:                "chmod",
+		MSG_CMD_CHOWN:                "chown",
+		MSG_CMD_PATCH:                "patch",
+	}
+	ackCodes = []string{
+		ACK_OK,
+		MSG_ERR_TRANS_CONFLICT,
+		MSG_ERR_PERMISSION_DENIED,
+		MSG_ERR_INVALID_DATA,
+		MSG_ERR_NOT_FOUND,
+		MSG_ERR_TOO_LARGE,
+		MSG_ERR_RATE_LIMITED,
+		MSG_ERR_INTERNAL,
+	}
+)
+
+// Counts observations into fixed buckets; a nil histogram ignores them
+type histogram struct {
+	bounds []float64
+	// One count per bound, plus one for everything above the last
+	counts []uint64
+	sum    float64
+	count  uint64
+	lock   sync.Mutex
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (hist *histogram) observe(value float64) {
+	if hist == nil {
+		return
+	}
+	bucket := sort.SearchFloat64s(hist.bounds, value)
+	hist.lock.Lock()
+	hist.counts[bucket]++
+	hist.sum += value
+	hist.count++
+	hist.lock.Unlock()
+}
+
+func (hist *histogram) since(start time.Time) {
+	if hist != nil {
+		hist.observe(time.Since(start).Seconds())
+	}
+}
+
+// A histogram for each value of one label, all made up front
+type histogramVec struct {
+	label      string
+	histograms map[string]*histogram
+}
+
+func newHistogramVec(label string, values []string, bounds []float64) *histogramVec {
+	vec := histogramVec{
+		label:      label,
+		histograms: make(map[string]*histogram, len(values)),
+	}
+	for _, value := range values {
+		vec.histograms[value] = newHistogram(bounds)
+	}
+	return &vec
+}
+
+func (vec *histogramVec) since(value string, start time.Time) {
+	if vec != nil {
+		vec.histograms[value].since(start)
+	}
+}
+
+// What the hub has been up to, for scraping by Prometheus
+type Metrics struct {
+	connections int64
+	// Msgs dispatched, by cmd
+	messages [256]uint64
+	// Acks sent, by error code
+	acks      map[string]*uint64
+	conflicts uint64
+	fanout    *histogram
+	lockWait  *histogram
+	dbLatency *histogramVec
+	// The outboxes of registered conns, for their depths
+	outboxes   map[*Outbox]bool
+	outboxLock sync.Mutex
+}
+
+func NewMetrics() *Metrics {
+	metrics := Metrics{
+		acks:      make(map[string]*uint64, len(ackCodes)),
+		fanout:    newHistogram(FANOUT_BUCKETS),
+		lockWait:  newHistogram(LATENCY_BUCKETS),
+		dbLatency: newHistogramVec("op", []string{DB_OP_GET, DB_OP_SET, DB_OP_PERMS, DB_OP_SET_PERMS}, LATENCY_BUCKETS),
+		outboxes:  make(map[*Outbox]bool),
+	}
+	for _, code := range ackCodes {
+		metrics.acks[code] = new(uint64)
+	}
+	return &metrics
+}
+
+func (metrics *Metrics) connected(conn *Conn) {
+	atomic.AddInt64(&metrics.connections, 1)
+	metrics.outboxLock.Lock()
+	metrics.outboxes[conn.outbox] = true
+	metrics.outboxLock.Unlock()
+}
+
+func (metrics *Metrics) disconnected(conn *Conn) {
+	atomic.AddInt64(&metrics.connections, -1)
+	metrics.outboxLock.Lock()
+	delete(metrics.outboxes, conn.outbox)
+	metrics.outboxLock.Unlock()
+}
+
+func (metrics *Metrics) received(cmd byte) {
+	atomic.AddUint64(&metrics.messages[cmd], 1)
+}
+
+func (metrics *Metrics) acked(ackErr *Error) {
+	code := ACK_OK
+	if ackErr != nil {
+		code = ackErr.Code
+	}
+	counter := metrics.acks[code]
+	if counter == nil {
+		counter = metrics.acks[MSG_ERR_INTERNAL]
+	}
+	atomic.AddUint64(counter, 1)
+}
+
+func (metrics *Metrics) conflicted() {
+	atomic.AddUint64(&metrics.conflicts, 1)
+}
+
+// The total and the largest number of msgs waiting in the outboxes
+func (metrics *Metrics) outboxDepths() (total int, largest int) {
+	metrics.outboxLock.Lock()
+	defer metrics.outboxLock.Unlock()
+	for outbox := range metrics.outboxes {
+		depth := outbox.depth()
+		total += depth
+		if depth > largest {
+			largest = depth
+		}
+	}
+	return total, largest
+}
+
+// Writes every metric in the Prometheus text format
+func (hub *MsgHub) writeMetrics(out io.Writer) error {
+	metrics := hub.metrics
+	writer := bufio.NewWriter(out)
+	header := func(name string, kind string, help string) {
+		writer.WriteString("# HELP " + name + " " + help + "\n# TYPE " + name + " " + kind + "\n")
+	}
+	sample := func(name string, labels string, value string) {
+		if labels != "" {
+			name += "{" + labels + "}"
+		}
+		writer.WriteString(name + " " + value + "\n")
+	}
+	formatCount := func(value uint64) string {
+		return strconv.FormatUint(value, 10)
+	}
+
+	header("turbo_connections", "gauge", "Conns registered with the hub.")
+	sample("turbo_connections", "", strconv.FormatInt(atomic.LoadInt64(&metrics.connections), 10))
+
+	header("turbo_messages_total", "counter", "Msgs dispatched, by cmd.")
+	for cmd := range metrics.messages {
+		if count := atomic.LoadUint64(&metrics.messages[cmd]); count > 0 {
+			name, known := cmdNames[byte(cmd)]
+			if !known {
+				name = strconv.Itoa(cmd)
+			}
+			sample("turbo_messages_total", `cmd="`+name+`"`, formatCount(count))
+		}
+	}
+
+	header("turbo_acks_total", "counter", "Acks sent, by error code.")
+	for _, code := range ackCodes {
+		sample("turbo_acks_total", `error="`+code+`"`, formatCount(atomic.LoadUint64(metrics.acks[code])))
+	}
+
+	header("turbo_transaction_conflicts_total", "counter", "Trans-sets refused because the revision had moved on.")
+	sample("turbo_transaction_conflicts_total", "", formatCount(atomic.LoadUint64(&metrics.conflicts)))
+
+	header("turbo_publish_fanout", "histogram", "Conns reached by each publish.")
+	writeHistogram(sample, "turbo_publish_fanout", "", metrics.fanout)
+
+	total, largest := metrics.outboxDepths()
+	header("turbo_outbox_messages", "gauge", "Msgs waiting in outboxes across all conns.")
+	sample("turbo_outbox_messages", "", strconv.Itoa(total))
+	header("turbo_outbox_messages_max", "gauge", "Msgs waiting in the fullest outbox.")
+	sample("turbo_outbox_messages_max", "", strconv.Itoa(largest))
+
+	stats := hub.stats.snapshot()
+	header("turbo_outbox_dropped_total", "counter", "Msgs dropped for conns that couldn't keep up.")
+	sample("turbo_outbox_dropped_total", "", formatCount(stats.Dropped))
+	header("turbo_outbox_coalesced_total", "counter", "Value events replaced by newer ones before they were sent.")
+	sample("turbo_outbox_coalesced_total", "", formatCount(stats.Coalesced))
+	header("turbo_outbox_disconnected_total", "counter", "Conns dropped for falling behind.")
+	sample("turbo_outbox_disconnected_total", "", formatCount(stats.Disconnected))
+
+	header("turbo_lock_wait_seconds", "histogram", "Time spent waiting for path locks.")
+	writeHistogram(sample, "turbo_lock_wait_seconds", "", metrics.lockWait)
+
+	header("turbo_db_seconds", "histogram", "Time taken by db calls, by op.")
+	ops := make([]string, 0, len(metrics.dbLatency.histograms))
+	for op := range metrics.dbLatency.histograms {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		writeHistogram(sample, "turbo_db_seconds", metrics.dbLatency.label+`="`+op+`"`, metrics.dbLatency.histograms[op])
+	}
+
+	return writer.Flush()
+}
+
+// Buckets are cumulative in the text format
+func writeHistogram(sample func(string, string, string), name string, labels string, hist *histogram) {
+	hist.lock.Lock()
+	counts := append([]uint64(nil), hist.counts...)
+	sum, count := hist.sum, hist.count
+	hist.lock.Unlock()
+
+	if labels != "" {
+		labels += ","
+	}
+	var cumulative uint64
+	for i, bound := range hist.bounds {
+		cumulative += counts[i]
+		sample(name+"_bucket", labels+`le="`+strconv.FormatFloat(bound, 'g', -1, 64)+`"`, strconv.FormatUint(cumulative, 10))
+	}
+	sample(name+"_bucket", labels+`le="+Inf"`, strconv.FormatUint(count, 10))
+	sample(name+"_sum", strings.TrimSuffix(labels, ","), strconv.FormatFloat(sum, 'g', -1, 64))
+	sample(name+"_count", strings.TrimSuffix(labels, ","), strconv.FormatUint(count, 10))
+}
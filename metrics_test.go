@@ -0,0 +1,104 @@
+package turbo
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	hist := newHistogram([]float64{1, 5})
+	for _, value := range []float64{0, 1, 3, 7} {
+		hist.observe(value)
+	}
+	var nilHist *histogram
+	nilHist.observe(1)
+
+	samples := map[string]string{}
+	writeHistogram(func(name string, labels string, value string) {
+		samples[name+"{"+labels+"}"] = value
+	}, "h", `op="x"`, hist)
+	expected := map[string]string{
+		`h_bucket{op="x",le="1"}`:    "2",
+		`h_bucket{op="x",le="5"}`:    "3",
+		`h_bucket{op="x",le="+Inf"}`: "4",
+		`h_sum{op="x"}`:              "11",
+		`h_count{op="x"}`:            "4",
+	}
+	for sample, value := range expected {
+		if samples[sample] != value {
+			t.Error("Sample", sample, "was", samples[sample], "not", value)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	db := newTestDb(t)
+	bus := NewMsgBus()
+	hub := NewMsgHub(bus, db, nil)
+	go hub.listen()
+	turbo := &Turbo{bus: bus, hub: hub}
+	conn := newTestConn(hub, 1)
+	hub.registerConn(conn)
+	send := func(msg *Msg) {
+		hub.dispatch(msg, conn)
+		for {
+			ack := Ack{}
+			json.Unmarshal(nextPayload(conn.outbox), &ack)
+			if ack.Type == MSG_CMD_ACK {
+				return
+			}
+		}
+	}
+
+	send(&Msg{Cmd: MSG_CMD_ON, Path: "/counted", Event: EVENT_TYPE_VALUE})
+	send(&Msg{Cmd: MSG_CMD_SET, Path: "/counted", Data: json.RawMessage(`1`)})
+	send(&Msg{Cmd: MSG_CMD_SET, Path: "/counted.bad", Data: json.RawMessage(`1`)})
+	send(&Msg{Cmd: MSG_CMD_TRANS_SET, Path: "/counted", Data: json.RawMessage(`2`), Revision: 99})
+	// Leave something waiting in the outbox
+	hub.bus.publish(EVENT_TYPE_VALUE, "/elsewhere", []byte(`{}`))
+	conn.outbox.push([]byte(`{}`))
+
+	for start := time.Now(); atomic.LoadInt64(&hub.metrics.connections) != 1; {
+		if time.Since(start) > time.Second {
+			t.Error("Conn was never counted")
+			t.FailNow()
+		}
+		time.Sleep(time.Millisecond)
+	}
+	recorder := httptest.NewRecorder()
+	turbo.MetricsHandler(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if recorder.Header().Get("Content-Type") != METRICS_CONTENT_TYPE {
+		t.Error("Wrong content type", recorder.Header().Get("Content-Type"))
+	}
+	body := recorder.Body.String()
+	for _, line := range []string{
+		"# TYPE turbo_connections gauge",
+		"turbo_connections 1",
+		`turbo_messages_total{cmd="on"} 1`,
+		`turbo_messages_total{cmd="set"} 2`,
+		`turbo_messages_total{cmd="trans_set"} 1`,
+		`turbo_acks_total{error="none"} 2`,
+		`turbo_acks_total{error="invalid_data"} 1`,
+		`turbo_acks_total{error="conflict"} 1`,
+		`turbo_acks_total{error="rate_limited"} 0`,
+		"turbo_transaction_conflicts_total 1",
+		"turbo_outbox_messages 1",
+		"turbo_outbox_messages_max 1",
+		"# TYPE turbo_lock_wait_seconds histogram",
+		`turbo_db_seconds_bucket{op="set",le="+Inf"} 1`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Error("Metrics were missing", line)
+		}
+	}
+	if strings.Contains(body, "turbo_lock_wait_seconds_count 0\n") {
+		t.Error("Lock waits were not timed")
+	}
+	if !strings.Contains(body, `turbo_publish_fanout_bucket{le="0"} `) || strings.Contains(body, "turbo_publish_fanout_count 0\n") {
+		t.Error("Publishes were not counted")
+	}
+}
@@ -16,6 +16,25 @@ const (
 	MSG_CMD_AUTH      = 9
 	MSG_CMD_UNAUTH    = 10
 	MSG_CMD_ACK       = 11
+	MSG_CMD_GET       = 12
+
+	MSG_CMD_ON_DISCONNECT_SET    = 13
+	MSG_CMD_ON_DISCONNECT_UPDATE = 14
+	MSG_CMD_ON_DISCONNECT_REMOVE = 15
+	MSG_CMD_ON_DISCONNECT_CANCEL = 16
+
+	// Sent by the server when an auth token expires
+	MSG_CMD_AUTH_REVOKED = 17
+
+	MSG_CMD_CHMOD = 18
+	MSG_CMD_CHOWN = 19
+
+	// The opening exchange of every connection
+	MSG_CMD_HELLO   = 20
+	MSG_CMD_WELCOME = 21
+
+	// RFC 6902 ops against the value at a path
+	MSG_CMD_PATCH = 22
 
 	EVENT_TYPE_VALUE         = 0
 	EVENT_TYPE_CHILD_ADDED   = 1
@@ -24,28 +43,55 @@ const (
 	EVENT_TYPE_CHILD_REMOVED = 4
 	EVENT_TYPES              = 5
 
-	MSG_ERR_TRANS_CONFLICT = "conflict"
+	MSG_ERR_TRANS_CONFLICT    = "conflict"
+	MSG_ERR_PERMISSION_DENIED = "permission_denied"
+	MSG_ERR_INVALID_DATA      = "invalid_data"
+	MSG_ERR_NOT_FOUND         = "not_found"
+	MSG_ERR_TOO_LARGE         = "too_large"
+	MSG_ERR_RATE_LIMITED      = "rate_limited"
+	MSG_ERR_INTERNAL          = "internal"
 )
 
 type Msg struct {
 	Cmd      byte            `json:"cmd"`
-	Path     string          `json:"path"`
+	Path     Path            `json:"path"`
 	Event    byte            `json:"eventType"`
 	Data     json.RawMessage `json:"data"`
 	DataMap  json.RawMessage `json:"dataMap"`
 	Ack      int             `json:"ack"`
 	Revision int             `json:"revision"`
+	Shallow  bool            `json:"shallow"`
+	// Value subscriptions can ask for merge patches instead of whole values
+	Delta bool   `json:"delta"`
+	Query *Query `json:"query"`
+	// JSON Patch ops for MSG_CMD_PATCH
+	Ops []*PatchOp `json:"ops"`
+	// Node permissions for chmod and chown
+	Permissions *uint8 `json:"permissions"`
+	Owner       *int64 `json:"owner"`
+	Group       *int64 `json:"group"`
+	// Auth token
+	Cred string `json:"cred"`
+	// The client's clock in ms, used to work out .info/serverTimeOffset
+	Timestamp int64 `json:"timestamp"`
+	// Protocol version, plus the session token and last seq seen when resuming, sent with hello
+	Version string `json:"version"`
+	Session string `json:"session"`
+	Seq     uint64 `json:"seq"`
+	// How many bytes the msg took up on the wire
+	size int
 }
 
 type ValueEvent struct {
-	Path  string      `json:"path"`
+	Path  Path        `json:"path"`
 	Event byte        `json:"eventType"`
+	Name  string      `json:"name,omitempty"`
 	Data  interface{} `json:"data"`
 }
 
 type Ack struct {
 	Type     byte        `json:"type"`
-	Error    string      `json:"err"`
+	Error    *Error      `json:"err"`
 	Data     interface{} `json:"data"`
 	Value    interface{} `json:"value"`
 	Ack      int         `json:"ack"`
@@ -5,152 +5,237 @@ import (
 )
 
 type MsgBus struct {
-	evtMaps   map[*PathTreeNode]*[EVENT_TYPES]*map[*Conn]bool
-	pathTree  *PathTree
-	pathLocks map[string]*sync.Mutex
+	evtMaps  map[*PathTreeNode]*[EVENT_TYPES]*map[*Conn]bool
+	pathTree *PathTree
+	// Where each conn set lives, so it can be cleaned up once it empties
+	owners map[*map[*Conn]bool]subscriptionOwner
+	// Guards everything above, along with each conn's subscriptions
+	lock sync.RWMutex
+	// How many conns each publish reaches, if anyone is counting
+	fanout *histogram
+}
+
+type subscriptionOwner struct {
+	node *PathTreeNode
+	evt  byte
+}
+
+// An event a conn listens for, and where
+type subscription struct {
+	evt  byte
+	path Path
 }
 
 func NewMsgBus() *MsgBus {
 	bus := MsgBus{
-		evtMaps:   make(map[*PathTreeNode]*[EVENT_TYPES]*map[*Conn]bool),
-		pathTree:  NewPathTree(),
-		pathLocks: make(map[string]*sync.Mutex),
+		evtMaps:  make(map[*PathTreeNode]*[EVENT_TYPES]*map[*Conn]bool),
+		pathTree: NewPathTree(),
+		owners:   make(map[*map[*Conn]bool]subscriptionOwner),
 	}
 	return &bus
 }
 
-func (bus *MsgBus) subscribe(evt byte, path string, conn *Conn) {
-	var evtMap [EVENT_TYPES]*map[*Conn]bool
-	var connSet map[*Conn]bool
-	var node *PathTreeNode
+func (bus *MsgBus) subscribe(evt byte, path Path, conn *Conn) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
 
-	node = bus.pathTree.put(path)
-	if _, exists := bus.evtMaps[node]; !exists {
-		var lock *sync.Mutex
-		if bus.pathLocks[path] != nil {
-			lock = bus.pathLocks[path]
-		} else {
-			lock = &sync.Mutex{}
-			bus.pathLocks[path] = lock
-		}
-		lock.Lock()
-
-		if _, exists := bus.evtMaps[node]; !exists {
-			evtMap = [EVENT_TYPES]*map[*Conn]bool{}
-			bus.evtMaps[node] = &evtMap
-		}
-		delete(bus.pathLocks, path)
-
-		lock.Unlock()
-	} else {
-		evtMap = *(bus.evtMaps[node])
+	node := bus.pathTree.put(path)
+	evtMap := bus.evtMaps[node]
+	if evtMap == nil {
+		evtMap = &[EVENT_TYPES]*map[*Conn]bool{}
+		bus.evtMaps[node] = evtMap
 	}
+	connSet := evtMap[evt]
+	if connSet == nil {
+		created := make(map[*Conn]bool)
+		connSet = &created
+		evtMap[evt] = connSet
+		bus.owners[connSet] = subscriptionOwner{node, evt}
+	}
+	if !(*connSet)[conn] {
+		(*connSet)[conn] = true
+		// Each conn in each of its sets holds the node in the tree
+		node.refs++
+	}
+	conn.subscriptions[connSet] = true
+	conn.subscriptionsChanged()
+}
 
-	if evtMap[evt] == nil {
-		var lock *sync.Mutex
-		if bus.pathLocks[path] != nil {
-			lock = bus.pathLocks[path]
-		} else {
-			lock = &sync.Mutex{}
-			bus.pathLocks[path] = lock
-		}
-		lock.Lock()
-
-		connSet = make(map[*Conn]bool)
-		evtMap[evt] = &connSet
-		delete(bus.pathLocks, path)
+func (bus *MsgBus) unsubscribe(evt byte, path Path, conn *Conn) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
 
-		lock.Unlock()
-	} else {
-		connSet = *(evtMap[evt])
+	if connSet := bus.connSet(evt, path); connSet != nil {
+		bus.leave(connSet, conn)
 	}
-
-	connSet[conn] = true
-	conn.subscriptions[&connSet] = true
+	conn.subscriptionsChanged()
 }
 
-func (bus *MsgBus) unsubscribe(evt byte, path string, conn *Conn) {
-	var evtMap [EVENT_TYPES]*map[*Conn]bool
-	var connSet map[*Conn]bool
-	var node *PathTreeNode
-
-	node = bus.pathTree.get(path)
+// The conns subscribed to evt at path, or nil; the caller must hold the lock
+func (bus *MsgBus) connSet(evt byte, path Path) *map[*Conn]bool {
+	node := bus.pathTree.get(path)
 	if node == nil {
-		return
+		return nil
 	}
-
-	if _, exists := bus.evtMaps[node]; !exists {
-		return
-	} else {
-		evtMap = *(bus.evtMaps[node])
+	evtMap := bus.evtMaps[node]
+	if evtMap == nil {
+		return nil
 	}
+	return evtMap[evt]
+}
 
-	if evtMap[evt] == nil {
+// Takes conn out of connSet, dropping whatever is left unused; the caller must hold the lock
+func (bus *MsgBus) leave(connSet *map[*Conn]bool, conn *Conn) {
+	delete(conn.subscriptions, connSet)
+	if !(*connSet)[conn] {
 		return
-	} else {
-		connSet = *(evtMap[evt])
 	}
-
-	if _, exists := connSet[conn]; !exists {
-		return
-	} else {
-		delete(connSet, conn)
-		delete(conn.subscriptions, &connSet)
+	delete(*connSet, conn)
+	owner := bus.owners[connSet]
+	if len(*connSet) == 0 {
+		delete(bus.owners, connSet)
+		bus.evtMaps[owner.node][owner.evt] = nil
+	}
+	owner.node.refs--
+	if owner.node.refs == 0 {
+		delete(bus.evtMaps, owner.node)
+		// The root holds the tree together, so it stays
+		if owner.node.path != ROOT_PATH {
+			owner.node.remove()
+		}
 	}
 }
 
-func (bus *MsgBus) publish(evt byte, path string, msg []byte) {
-	var evtMap [EVENT_TYPES]*map[*Conn]bool
-	var connSet map[*Conn]bool
-	var node *PathTreeNode
-
-	node = bus.pathTree.get(path)
-	if node == nil {
-		return
+func (bus *MsgBus) publish(evt byte, path Path, msg []byte) {
+	// Delivery can block on a slow conn, so it happens outside the lock
+	bus.lock.RLock()
+	var conns []*Conn
+	if connSet := bus.connSet(evt, path); connSet != nil {
+		conns = make([]*Conn, 0, len(*connSet))
+		for conn := range *connSet {
+			conns = append(conns, conn)
+		}
 	}
+	bus.lock.RUnlock()
+	bus.fanout.observe(float64(len(conns)))
 
-	if _, exists := bus.evtMaps[node]; !exists {
-		return
-	} else {
-		evtMap = *(bus.evtMaps[node])
+	// Value events for a path supersede each other
+	valuePath := ""
+	if evt == EVENT_TYPE_VALUE {
+		valuePath = string(path)
 	}
-
-	if evtMap[evt] == nil {
-		return
-	} else {
-		connSet = *(evtMap[evt])
+	for _, conn := range conns {
+		conn.deliver(msg, valuePath)
 	}
+}
+
+// Everything conn is subscribed to
+func (bus *MsgBus) subscriptionsOf(conn *Conn) []subscription {
+	bus.lock.RLock()
+	defer bus.lock.RUnlock()
 
-	for conn, _ := range connSet {
-		conn.outbox <- msg
+	subscriptions := make([]subscription, 0, len(conn.subscriptions))
+	for connSet := range conn.subscriptions {
+		owner := bus.owners[connSet]
+		subscriptions = append(subscriptions, subscription{evt: owner.evt, path: owner.node.path})
 	}
+	return subscriptions
 }
 
 func (bus *MsgBus) unsubscribeAll(conn *Conn) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
 	for subscription := range conn.subscriptions {
-		delete(*subscription, conn)
-		delete(conn.subscriptions, subscription)
+		bus.leave(subscription, conn)
 	}
+	conn.subscriptionsChanged()
 }
 
-func (bus *MsgBus) hasSubscribers(evt byte, path string) bool {
-	var evtMap [EVENT_TYPES]*map[*Conn]bool
-	var node *PathTreeNode
+// Hands every subscription of one Conn over to another
+func (bus *MsgBus) transfer(from *Conn, to *Conn) {
+	bus.lock.Lock()
+	defer bus.lock.Unlock()
+
+	for subscription := range from.subscriptions {
+		delete(*subscription, from)
+		delete(from.subscriptions, subscription)
+		if (*subscription)[to] {
+			// to already held the node through this set
+			bus.owners[subscription].node.refs--
+		}
+		(*subscription)[to] = true
+		to.subscriptions[subscription] = true
+	}
+	from.subscriptionsChanged()
+	to.subscriptionsChanged()
+}
 
-	node = bus.pathTree.get(path)
-	if node == nil {
-		return false
+func (bus *MsgBus) hasSubscribers(evt byte, path Path) bool {
+	bus.lock.RLock()
+	defer bus.lock.RUnlock()
+
+	connSet := bus.connSet(evt, path)
+	return connSet != nil && len(*connSet) > 0
+}
+
+// Whether anyone is subscribed to the children of path
+func (bus *MsgBus) hasChildSubscribers(path Path) bool {
+	return bus.hasSubscribers(EVENT_TYPE_CHILD_ADDED, path) ||
+		bus.hasSubscribers(EVENT_TYPE_CHILD_CHANGED, path) ||
+		bus.hasSubscribers(EVENT_TYPE_CHILD_REMOVED, path)
+}
+
+// Whether conn itself is subscribed to evt at path
+func (bus *MsgBus) isSubscribed(evt byte, path Path, conn *Conn) bool {
+	bus.lock.RLock()
+	defer bus.lock.RUnlock()
+
+	connSet := bus.connSet(evt, path)
+	return connSet != nil && (*connSet)[conn]
+}
+
+// The paths above path that someone is subscribed to, nearest first
+func (bus *MsgBus) watchedAncestors(path Path) []Path {
+	bus.lock.RLock()
+	defer bus.lock.RUnlock()
+	var paths []Path
+	for _, node := range bus.pathTree.ancestors(path) {
+		if bus.evtMaps[node] != nil {
+			paths = append(paths, node.path)
+		}
 	}
+	return paths
+}
+
+// The paths beneath path that someone is subscribed to, deepest first
+func (bus *MsgBus) watchedDescendants(path Path) []Path {
+	bus.lock.RLock()
+	defer bus.lock.RUnlock()
+	var paths []Path
+	for _, node := range bus.pathTree.descendants(path) {
+		if bus.evtMaps[node] != nil {
+			paths = append(paths, node.path)
+		}
+	}
+	return paths
+}
 
-	if _, exists := bus.evtMaps[node]; !exists {
-		return false
-	} else {
-		evtMap = *(bus.evtMaps[node])
+// Calls visit for path, if it is watched, and every watched path beneath it, deepest first.
+// The tree is read up front, so visit is free to publish.
+func (bus *MsgBus) cascade(path Path, visit func(path Path)) {
+	var paths []Path
+	bus.lock.RLock()
+	found := bus.pathTree.descendants(path)
+	if node := bus.pathTree.get(path); node != nil && node.parent != nil {
+		found = append(found, node)
+	}
+	for _, node := range found {
+		paths = append(paths, node.path)
 	}
+	bus.lock.RUnlock()
 
-	if evtMap[evt] == nil {
-		return false
-	} else {
-		return len(*evtMap[evt]) > 0
+	for _, path := range paths {
+		visit(path)
 	}
 }
@@ -1,20 +1,16 @@
 package turbo
 
 import (
+	"fmt"
+	"runtime"
 	"sync"
 	"testing"
 )
 
 func TestSubscribe(t *testing.T) {
 	bus := NewMsgBus()
-	conn := Conn{
-		id:            1,
-		ws:            nil,
-		outbox:        make(chan []byte, 256),
-		subscriptions: make(map[*map[*Conn]bool]bool),
-		hub:           nil,
-	}
-	paths := map[string]byte{
+	conn := newTestConn(nil, 1)
+	paths := map[Path]byte{
 		"/a/b/c":       EVENT_TYPE_VALUE,
 		"/a/b/c/d":     EVENT_TYPE_CHILD_ADDED,
 		"/a/b":         EVENT_TYPE_CHILD_CHANGED,
@@ -23,7 +19,7 @@ func TestSubscribe(t *testing.T) {
 	}
 
 	for path, evt := range paths {
-		bus.subscribe(evt, path, &conn)
+		bus.subscribe(evt, path, conn)
 	}
 
 	if len(bus.evtMaps) != 5 {
@@ -55,7 +51,7 @@ func TestSubscribe(t *testing.T) {
 			connSet = *(evtMap[evt])
 		}
 
-		if _, exists := connSet[&conn]; !exists {
+		if _, exists := connSet[conn]; !exists {
 			t.Error("Event map did not register for", path)
 		}
 	}
@@ -64,29 +60,17 @@ func TestSubscribe(t *testing.T) {
 func TestPublish(t *testing.T) {
 	bus := NewMsgBus()
 
-	conn1 := Conn{
-		id:            1,
-		ws:            nil,
-		outbox:        make(chan []byte, 256),
-		subscriptions: make(map[*map[*Conn]bool]bool),
-		hub:           nil,
-	}
-	conn2 := Conn{
-		id:            2,
-		ws:            nil,
-		outbox:        make(chan []byte, 256),
-		subscriptions: make(map[*map[*Conn]bool]bool),
-		hub:           nil,
-	}
+	conn1 := newTestConn(nil, 1)
+	conn2 := newTestConn(nil, 2)
 
-	paths1 := map[string]byte{
+	paths1 := map[Path]byte{
 		"/a/b/c":       EVENT_TYPE_VALUE,
 		"/a/b/c/d":     EVENT_TYPE_CHILD_ADDED,
 		"/a/b":         EVENT_TYPE_CHILD_CHANGED,
 		"/a/b/c/d/e/f": EVENT_TYPE_CHILD_REMOVED,
 		"/1/2/3":       EVENT_TYPE_CHILD_MOVED,
 	}
-	paths2 := map[string]byte{
+	paths2 := map[Path]byte{
 		"/a/b/c":   EVENT_TYPE_VALUE,
 		"/x/y":     EVENT_TYPE_CHILD_ADDED,
 		"/a/b":     EVENT_TYPE_CHILD_CHANGED,
@@ -95,11 +79,11 @@ func TestPublish(t *testing.T) {
 	}
 
 	for path, evt := range paths1 {
-		bus.subscribe(evt, path, &conn1)
+		bus.subscribe(evt, path, conn1)
 	}
 
 	for path, evt := range paths2 {
-		bus.subscribe(evt, path, &conn2)
+		bus.subscribe(evt, path, conn2)
 	}
 
 	bus.publish(EVENT_TYPE_VALUE, "/a/b/c", []byte("test1"))
@@ -111,17 +95,13 @@ func TestPublish(t *testing.T) {
 	bus.publish(EVENT_TYPE_CHILD_MOVED, "/1/2/3", []byte("test7"))
 
 	for i := 0; i < 5; i++ {
-		select {
-		case <-conn1.outbox:
-		default:
+		if tryPop(conn1.outbox) == nil {
 			t.Error("Outbox closed on conn1")
 		}
 	}
 
 	for i := 0; i < 5; i++ {
-		select {
-		case <-conn2.outbox:
-		default:
+		if tryPop(conn2.outbox) == nil {
 			t.Error("Outbox closed on conn2")
 		}
 	}
@@ -129,24 +109,18 @@ func TestPublish(t *testing.T) {
 
 func TestUnsubscribe(t *testing.T) {
 	bus := NewMsgBus()
-	conn := Conn{
-		id:            1,
-		ws:            nil,
-		outbox:        make(chan []byte, 256),
-		subscriptions: make(map[*map[*Conn]bool]bool),
-		hub:           nil,
-	}
-	bus.subscribe(EVENT_TYPE_VALUE, "/a", &conn)
-	bus.subscribe(EVENT_TYPE_VALUE, "/a/b", &conn)
-	bus.subscribe(EVENT_TYPE_VALUE, "/a/b/c", &conn)
-	bus.subscribe(EVENT_TYPE_VALUE, "/a/b/c/d", &conn)
-	bus.subscribe(EVENT_TYPE_VALUE, "/a/b/c/d/e", &conn)
-
-	bus.unsubscribe(EVENT_TYPE_VALUE, "/a", &conn)
-	bus.unsubscribe(EVENT_TYPE_VALUE, "/a/b", &conn)
-	bus.unsubscribe(EVENT_TYPE_VALUE, "/a/b/c", &conn)
-	bus.unsubscribe(EVENT_TYPE_VALUE, "/a/b/c/d", &conn)
-	bus.unsubscribe(EVENT_TYPE_VALUE, "/a/b/c/d/e", &conn)
+	conn := newTestConn(nil, 1)
+	bus.subscribe(EVENT_TYPE_VALUE, "/a", conn)
+	bus.subscribe(EVENT_TYPE_VALUE, "/a/b", conn)
+	bus.subscribe(EVENT_TYPE_VALUE, "/a/b/c", conn)
+	bus.subscribe(EVENT_TYPE_VALUE, "/a/b/c/d", conn)
+	bus.subscribe(EVENT_TYPE_VALUE, "/a/b/c/d/e", conn)
+
+	bus.unsubscribe(EVENT_TYPE_VALUE, "/a", conn)
+	bus.unsubscribe(EVENT_TYPE_VALUE, "/a/b", conn)
+	bus.unsubscribe(EVENT_TYPE_VALUE, "/a/b/c", conn)
+	bus.unsubscribe(EVENT_TYPE_VALUE, "/a/b/c/d", conn)
+	bus.unsubscribe(EVENT_TYPE_VALUE, "/a/b/c/d/e", conn)
 
 	if bus.hasSubscribers(EVENT_TYPE_VALUE, "/a") {
 		t.Error("/a had subscribers")
@@ -172,15 +146,9 @@ func TestSubscribeConcurrency(t *testing.T) {
 
 	wg.Add(goRoutineCount)
 	for i := 0; i < goRoutineCount; i++ {
-		conn := Conn{
-			id:            uint64(i + 1),
-			ws:            nil,
-			outbox:        make(chan []byte, 256),
-			subscriptions: make(map[*map[*Conn]bool]bool),
-			hub:           nil,
-		}
+		conn := newTestConn(nil, uint64(i+1))
 		go (func() {
-			bus.subscribe(EVENT_TYPE_VALUE, "/a/b/c", &conn)
+			bus.subscribe(EVENT_TYPE_VALUE, "/a/b/c", conn)
 			wg.Done()
 		})()
 	}
@@ -198,3 +166,89 @@ func TestSubscribeConcurrency(t *testing.T) {
 		t.Error("Node was nil")
 	}
 }
+
+func TestUnsubscribeCleansUp(t *testing.T) {
+	bus := NewMsgBus()
+	newConn := func(id uint64) *Conn {
+		return newTestConn(nil, id)
+	}
+	first, second := newConn(1), newConn(2)
+	bus.subscribe(EVENT_TYPE_VALUE, "/a/b", first)
+	bus.subscribe(EVENT_TYPE_CHILD_ADDED, "/a/b", first)
+	bus.subscribe(EVENT_TYPE_VALUE, "/a/b/c", first)
+	bus.subscribe(EVENT_TYPE_VALUE, "/a/b", second)
+
+	// A node stays while anyone still uses it
+	bus.unsubscribe(EVENT_TYPE_VALUE, "/a/b", first)
+	bus.unsubscribe(EVENT_TYPE_CHILD_ADDED, "/a/b", first)
+	if bus.pathTree.get("/a/b") == nil || !bus.hasSubscribers(EVENT_TYPE_VALUE, "/a/b") {
+		t.Error("Node was dropped while still subscribed to")
+	}
+	// Children of a dropped node move up to its parent
+	bus.unsubscribe(EVENT_TYPE_VALUE, "/a/b", second)
+	if bus.pathTree.get("/a/b") != nil {
+		t.Error("Unused node was left in the tree")
+	}
+	if node := bus.pathTree.get("/a/b/c"); node == nil || node.parent.path != "/" {
+		t.Error("Child of the dropped node was lost")
+	}
+
+	// Handing over subscriptions keeps them alive, and unsubscribing everything drops them
+	bus.subscribe(EVENT_TYPE_VALUE, "/a/b/c", second)
+	bus.transfer(first, second)
+	if len(first.subscriptions) != 0 || second.subscriptionCount() != 1 {
+		t.Error("Transfer miscounted subscriptions", len(first.subscriptions), second.subscriptionCount())
+	}
+	bus.unsubscribeAll(second)
+	if len(bus.evtMaps) != 0 || len(bus.owners) != 0 || len(bus.pathTree.refs) > 1 {
+		t.Error("Bus kept maps after everyone left", len(bus.evtMaps), len(bus.owners), len(bus.pathTree.refs))
+	}
+}
+
+func TestBusMemory(t *testing.T) {
+	bus := NewMsgBus()
+	conns := make([]*Conn, 10)
+	for i := range conns {
+		conns[i] = newTestConn(nil, uint64(i+1))
+	}
+	// Every round subscribes to paths nobody has used before, then lets them go
+	round := func(r int) {
+		var wg sync.WaitGroup
+		for c, conn := range conns {
+			wg.Add(1)
+			go func(c int, conn *Conn) {
+				defer wg.Done()
+				for i := 0; i < 500; i++ {
+					path := Path(fmt.Sprintf("/rooms/%d/%d/%d", r, c, i))
+					bus.subscribe(byte(i%EVENT_TYPES), path, conn)
+					bus.subscribe(EVENT_TYPE_VALUE, path.child("messages"), conn)
+					if i%2 == 0 {
+						bus.unsubscribe(EVENT_TYPE_VALUE, path.child("messages"), conn)
+					}
+				}
+				bus.unsubscribeAll(conn)
+			}(c, conn)
+		}
+		wg.Wait()
+	}
+	heap := func() uint64 {
+		var stats runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&stats)
+		return stats.HeapAlloc
+	}
+
+	round(0)
+	before := heap()
+	for r := 1; r <= 20; r++ {
+		round(r)
+	}
+	after := heap()
+	if len(bus.evtMaps) != 0 || len(bus.owners) != 0 || len(bus.pathTree.refs) > 1 {
+		t.Error("Bus kept maps after every round", len(bus.evtMaps), len(bus.owners), len(bus.pathTree.refs))
+	}
+	// 20 rounds of 10000 subscriptions would leave megabytes behind if anything leaked
+	if after > before+512*1024 {
+		t.Error("Memory grew from", before, "to", after)
+	}
+}
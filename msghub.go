@@ -2,8 +2,13 @@ package turbo
 
 import (
 	"encoding/json"
+	"github.com/gorilla/websocket"
 	"log"
-	"strings"
+	"reflect"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
 )
 
 type MsgHub struct {
@@ -19,16 +24,73 @@ type MsgHub struct {
 	db *Database
 	// Locker for transactions
 	locker *Locker
+	// Server configuration
+	config *Config
+	// Security rules, or nil to allow everything
+	rules *Rules
+	// Schemas, or nil to accept any data
+	schemas *Schemas
+	// Sessions by token, including those whose Conn has dropped
+	sessions    map[string]*Session
+	sessionLock sync.Mutex
+	// What the outboxes have had to do to keep up
+	stats *BackpressureStats
+	// Upgrades requests to websockets for this hub alone
+	upgrader *websocket.Upgrader
+	// Rate limits shared by the conns of each identity, by uid
+	quotas    map[string]*quota
+	quotaLock sync.Mutex
+	// Counts and timings for the metrics endpoint
+	metrics *Metrics
 }
 
-func NewMsgHub(bus *MsgBus, db *Database) *MsgHub {
+func NewMsgHub(bus *MsgBus, db *Database, config *Config) *MsgHub {
+	if config == nil {
+		config = &Config{}
+	}
+	if config.SessionTimeout == 0 {
+		config.SessionTimeout = SESSION_TIMEOUT_DEFAULT
+	}
+	if config.ReplayBufferSize == 0 {
+		config.ReplayBufferSize = SESSION_REPLAY_SIZE_DEFAULT
+	}
+	if config.DisconnectGrace == 0 {
+		config.DisconnectGrace = DISCONNECT_GRACE_DEFAULT
+	}
+	if config.PingInterval == 0 {
+		config.PingInterval = CONN_PING_INTERVAL_DEFAULT
+	}
+	if config.PongTimeout == 0 {
+		config.PongTimeout = CONN_PONG_TIMEOUT_DEFAULT
+	}
+	if config.WriteTimeout == 0 {
+		config.WriteTimeout = CONN_WRITE_TIMEOUT_DEFAULT
+	}
+	config.Limits = config.Limits.orDefaults()
+	metrics := NewMetrics()
+	locker := NewLocker()
+	locker.wait = metrics.lockWait
+	if bus != nil {
+		bus.fanout = metrics.fanout
+	}
+	if db != nil {
+		db.latency = metrics.dbLatency
+	}
 	hub := MsgHub{
 		registration:   make(chan *Conn),
 		unregistration: make(chan *Conn),
 		connections:    make(map[uint64]*Conn),
 		bus:            bus,
 		db:             db,
-		locker:         NewLocker(),
+		locker:         locker,
+		config:         config,
+		rules:          config.Rules,
+		schemas:        config.Schemas,
+		sessions:       make(map[string]*Session),
+		stats:          &BackpressureStats{},
+		upgrader:       newUpgrader(config),
+		quotas:         make(map[string]*quota),
+		metrics:        metrics,
 	}
 	return &hub
 }
@@ -39,13 +101,30 @@ func (hub *MsgHub) listen() {
 		// There is a Conn 'c' in the registration queue
 		case conn := <-hub.registration:
 			hub.connections[conn.id] = conn
+			hub.metrics.connected(conn)
 			log.Printf("Connection #%d connected.\n", conn.id)
 		// There is a Conn 'c' in the unregistration queue
 		case conn := <-hub.unregistration:
+			// Connections can be unregistered by more than one party
+			if _, exists := hub.connections[conn.id]; !exists {
+				continue
+			}
 			delete(hub.connections, conn.id)
-			hub.bus.unsubscribeAll(conn)
-			close(conn.outbox)
-			conn.ws.Close()
+			hub.metrics.disconnected(conn)
+			hub.setConnected(conn, false)
+			// Sessions keep listening for the client to come back to, and hold off on its disconnect ops for a grace period
+			if conn.session != nil {
+				hub.parkSession(conn)
+			} else {
+				hub.bus.unsubscribeAll(conn)
+				// Run whatever the client left behind
+				go hub.runDisconnectOps(conn, conn.takeDisconnectOps())
+			}
+			conn.unauthenticate()
+			conn.outbox.close()
+			if conn.ws != nil {
+				conn.ws.Close()
+			}
 			log.Printf("Connection #%d was killed.\n", conn.id)
 		}
 	}
@@ -59,300 +138,723 @@ func (hub *MsgHub) unregisterConn(conn *Conn) {
 	hub.unregistration <- conn
 }
 
+// Tells the client why it is being dropped, then drops it
+func (hub *MsgHub) closeConn(conn *Conn, code int, reason string) {
+	log.Printf("Connection #%d is being closed (%d): %s\n", conn.id, code, reason)
+	if conn.ws != nil {
+		conn.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(CONN_CLOSE_TIMEOUT))
+	}
+	hub.unregisterConn(conn)
+}
+
 func (hub *MsgHub) route(rawMsg *RawMsg) {
 	payload := rawMsg.Payload
 	conn := rawMsg.Conn
+	if !hub.checkMessageSize(conn, payload) {
+		return
+	}
 
 	msg := Msg{}
 	err := json.Unmarshal(payload, &msg)
 	if err != nil {
-		log.Fatalln("Msg router could not marshal json of an incoming msg", err)
+		// Anything that isn't json can't be answered, since it has no ack
+		hub.closeConn(conn, websocket.CloseInvalidFramePayloadData, "Messages must be json")
 		return
 	}
+	msg.size = len(payload)
+	// The conn's worker runs its msgs one at a time, in the order they came in
+	conn.inbox <- &msg
+}
 
+func (hub *MsgHub) dispatch(msg *Msg, conn *Conn) {
+	hub.metrics.received(msg.Cmd)
+	conn.observeClock(msg.Timestamp)
+	if sizeErr := hub.checkLimits(msg); sizeErr != nil {
+		log.Printf("Connection #%d sent an oversized cmd #%d: %s\n", conn.id, msg.Cmd, sizeErr.Message)
+		hub.sendAck(conn, msg.Ack, sizeErr, nil, 0)
+		return
+	}
+	if takesPath(msg.Cmd) {
+		if pathErr := checkPaths(msg); pathErr != nil {
+			log.Printf("Connection #%d sent cmd #%d with a bad path: '%s'\n", conn.id, msg.Cmd, msg.Path)
+			hub.sendAck(conn, msg.Ack, pathErr, nil, 0)
+			return
+		}
+	}
+	if (msg.Cmd == MSG_CMD_ON || msg.Cmd == MSG_CMD_OFF) && msg.Event >= EVENT_TYPES {
+		log.Printf("Connection #%d sent cmd #%d with unknown event #%d\n", conn.id, msg.Cmd, msg.Event)
+		hub.sendAck(conn, msg.Ack, NewError(MSG_ERR_INVALID_DATA, "Unknown event type #"+strconv.Itoa(int(msg.Event))), nil, 0)
+		return
+	}
+	if limitErr := hub.limit(msg, conn); limitErr != nil {
+		hub.sendRateLimited(conn, msg, limitErr)
+		return
+	}
 	switch msg.Cmd {
 	case MSG_CMD_ON:
 		log.Printf("Connection #%d subscribed to: '%s', event: '%d'\n", conn.id, msg.Path, msg.Event)
-		hub.bus.subscribe(msg.Event, msg.Path, conn)
+		hub.handleOn(msg, conn)
 	case MSG_CMD_OFF:
 		log.Printf("Connection #%d unsubscribed from: '%s', event: '%d'\n", conn.id, msg.Path, msg.Event)
 		hub.bus.unsubscribe(msg.Event, msg.Path, conn)
+		if msg.Event == EVENT_TYPE_VALUE {
+			conn.untrackDelta(msg.Path)
+		}
 	case MSG_CMD_SET:
 		log.Printf("Connection #%d has set a value to path: '%s'\n", conn.id, msg.Path)
-		go hub.handleSet(&msg, conn)
+		hub.handleSet(msg, conn)
 	case MSG_CMD_UPDATE:
 		log.Printf("Connection #%d has updated path: '%s'\n", conn.id, msg.Path)
-		go hub.handleUpdate(&msg, conn)
+		hub.handleUpdate(msg, conn)
 	case MSG_CMD_REMOVE:
 		log.Printf("Connection #%d has removed path: '%s'\n", conn.id, msg.Path)
-		go hub.handleRemove(&msg, conn)
+		hub.handleRemove(msg, conn)
 	case MSG_CMD_TRANS_SET:
 		log.Printf("Connection #%d has done trans-set on path: '%s'\n", conn.id, msg.Path)
-		go hub.handleTransSet(&msg, conn)
+		hub.handleTransSet(msg, conn)
 	case MSG_CMD_PUSH:
 		log.Printf("Connection #%d has done a push on path: '%s'\n", conn.id, msg.Path)
-		// go hub.handlePush(&msg, conn)
+		hub.handlePush(msg, conn)
 	case MSG_CMD_TRANS_GET:
 		log.Printf("Connection #%d has done trans-get on path: '%s'\n", conn.id, msg.Path)
-		go hub.handleTransGet(&msg, conn)
+		hub.handleTransGet(msg, conn)
 	case MSG_CMD_AUTH:
 		log.Printf("Connection #%d has done an auth on path: '%s'\n", conn.id, msg.Path)
-		// go hub.handleAuth(&msg, conn)
+		hub.handleAuth(msg, conn)
 	case MSG_CMD_UNAUTH:
 		log.Printf("Connection #%d has done an unauth on path: '%s'\n", conn.id, msg.Path)
-		// go hub.handleUnauth(&msg, conn)
+		hub.handleUnauth(msg, conn)
+	case MSG_CMD_GET:
+		log.Printf("Connection #%d has done a get on path: '%s'\n", conn.id, msg.Path)
+		hub.handleGet(msg, conn)
+	case MSG_CMD_ON_DISCONNECT_SET, MSG_CMD_ON_DISCONNECT_UPDATE, MSG_CMD_ON_DISCONNECT_REMOVE:
+		log.Printf("Connection #%d has registered a disconnect op on path: '%s'\n", conn.id, msg.Path)
+		hub.handleOnDisconnect(msg, conn)
+	case MSG_CMD_ON_DISCONNECT_CANCEL:
+		log.Printf("Connection #%d has cancelled disconnect ops on path: '%s'\n", conn.id, msg.Path)
+		hub.handleCancelOnDisconnect(msg, conn)
+	case MSG_CMD_CHMOD:
+		log.Printf("Connection #%d has done a chmod on path: '%s'\n", conn.id, msg.Path)
+		hub.handleChmod(msg, conn)
+	case MSG_CMD_CHOWN:
+		log.Printf("Connection #%d has done a chown on path: '%s'\n", conn.id, msg.Path)
+		hub.handleChown(msg, conn)
+	case MSG_CMD_PATCH:
+		log.Printf("Connection #%d has patched path: '%s'\n", conn.id, msg.Path)
+		hub.handlePatch(msg, conn)
 
 	default:
-		log.Fatalf("Connection #%d submitted a message with cmd #%d which is unsupported\n", conn.id, msg.Cmd)
+		log.Printf("Connection #%d submitted a message with cmd #%d which is unsupported\n", conn.id, msg.Cmd)
+		hub.sendAck(conn, msg.Ack, NewError(MSG_ERR_INVALID_DATA, "Unsupported cmd #"+strconv.Itoa(int(msg.Cmd))), nil, 0)
 	}
 }
 
-// TODO: db should delete, then set new value
+// Runs a handler, turning a panic into an internal error for this msg alone
+func (hub *MsgHub) safely(handler func(*Msg, *Conn), msg *Msg, conn *Conn) {
+	defer func() {
+		if problem := recover(); problem != nil {
+			log.Printf("Connection #%d's cmd #%d on path '%s' panicked: %v\n%s", conn.id, msg.Cmd, msg.Path, problem, debug.Stack())
+			hub.sendAck(conn, msg.Ack, NewError(MSG_ERR_INTERNAL, "The server could not handle this message"), nil, 0)
+		}
+	}()
+	handler(msg, conn)
+}
+
+func (hub *MsgHub) handleOn(msg *Msg, conn *Conn) {
+	if !hub.canRead(conn, msg.Path) {
+		hub.sendPermissionDenied(conn, msg)
+		return
+	}
+	if msg.Delta && msg.Event == EVENT_TYPE_VALUE {
+		conn.trackDelta(msg.Path)
+	}
+	// Hold off writers until the snapshot is queued, so it can't cross any events
+	hub.locker.rlock(msg.Path)
+	defer hub.locker.runlock(msg.Path)
+
+	hub.bus.subscribe(msg.Event, msg.Path, conn)
+	err, val, _ := hub.read(msg, conn)
+	if err != nil {
+		// Without a snapshot the client would take the first event for the whole value
+		log.Println("Couldn't fetch the initial value of", msg.Path, err)
+		hub.bus.unsubscribe(msg.Event, msg.Path, conn)
+		if msg.Delta && msg.Event == EVENT_TYPE_VALUE {
+			conn.untrackDelta(msg.Path)
+		}
+		hub.sendAck(conn, msg.Ack, asError(err), nil, 0)
+		return
+	}
+
+	switch msg.Event {
+	case EVENT_TYPE_VALUE:
+		hub.sendEvent(conn, &ValueEvent{
+			Path:  msg.Path,
+			Event: EVENT_TYPE_VALUE,
+			Data:  val,
+		})
+	case EVENT_TYPE_CHILD_ADDED:
+		for _, child := range sortedChildren(val) {
+			hub.sendEvent(conn, &ValueEvent{
+				Path:  msg.Path,
+				Event: EVENT_TYPE_CHILD_ADDED,
+				Name:  child.key,
+				Data:  child.value,
+			})
+		}
+	}
+	// After the snapshot, so the client knows it has everything there was
+	hub.sendAck(conn, msg.Ack, nil, nil, 0)
+}
+
 func (hub *MsgHub) handleSet(msg *Msg, conn *Conn) {
-	var unmarshalledValue interface{}
-	jsonErr := json.Unmarshal(msg.Data, &unmarshalledValue)
-	if jsonErr != nil {
-		errStr := jsonErr.Error()
-		hub.sendAck(conn, msg.Ack, &errStr, nil, 0)
-	} else {
-		log.Println("Now setting value to path ", msg.Path)
-		// Notify all listeners of recursive value change
-		hub.publishAndDestroy(msg.Path)
-		// Set the new value
-		setErr := hub.db.set(msg.Path, unmarshalledValue)
-		if setErr != nil {
-			log.Fatalln("Couldn't set node value", setErr)
-			errStr := setErr.Error()
-			hub.sendAck(conn, msg.Ack, &errStr, nil, 0)
-		} else {
-			hub.sendAck(conn, msg.Ack, nil, nil, 0)
-			hub.publishValueEvent(msg.Path, &msg.Data, conn)
+	setErr := hub.write(msg.Path, msg.Data, func() *Error {
+		if !hub.canWriteData(conn, msg.Path, msg.Data) {
+			return hub.permissionDenied(conn, msg)
 		}
+		return hub.invalidData(conn, msg, hub.validateData(msg.Path, msg.Data))
+	})
+	if setErr != nil {
+		hub.sendAck(conn, msg.Ack, asError(setErr), nil, 0)
+	} else {
+		hub.sendAck(conn, msg.Ack, nil, nil, 0)
 	}
 }
 
-// TODO add "remove with null" support
 func (hub *MsgHub) handleUpdate(msg *Msg, conn *Conn) {
 	if msg.DataMap == nil {
 		return
 	}
-	propertyMap := make(map[string]json.RawMessage)
-	json.Unmarshal(msg.DataMap, &propertyMap)
-	responses := make(chan *error, 256)
-	for property, value := range propertyMap {
-		go (func(path string, val json.RawMessage) {
-			var unmarshalledValue interface{}
-			newPath := hub.joinPaths(msg.Path, path)
-			jsonErr := json.Unmarshal(val, &unmarshalledValue)
-			if jsonErr != nil {
-				log.Fatalln("Couldn't marshal new value json", jsonErr)
-				responses <- &jsonErr
-				return // ಠ_ಠ
-			} else {
-				hub.locker.lock(newPath)
-				setErr := hub.db.set(newPath, unmarshalledValue)
-				hub.locker.unlock(newPath)
-				if setErr != nil {
-					log.Fatalln("Couldn't set node value", setErr)
-					responses <- &setErr
-					return
-				}
-			}
-			responses <- nil
-			hub.publishValueEvent(newPath, &val, conn)
-		})(property, value)
-	}
-	// Collect the callbacks
-	i := 1
-	problems := ""
-	for {
-		select {
-		case err := <-responses:
-			if err != nil {
-				problems += (*err).Error() + "\n"
-			}
-
-			if i == len(propertyMap) {
-				// We're done - send the response
-				if problems == "" {
-					hub.sendAck(conn, msg.Ack, nil, nil, 0)
-				} else {
-					hub.sendAck(conn, msg.Ack, &problems, nil, 0)
-				}
-				close(responses)
-				return
-			} else {
-				i = i + 1
-			}
+	updateErr := hub.update(msg.Path, msg.DataMap, func() *Error {
+		if !hub.canUpdate(conn, msg.Path, msg.DataMap) {
+			return hub.permissionDenied(conn, msg)
 		}
+		return hub.invalidData(conn, msg, hub.validateUpdate(msg.Path, msg.DataMap))
+	})
+	if updateErr != nil {
+		hub.sendAck(conn, msg.Ack, asError(updateErr), nil, 0)
+	} else {
+		hub.sendAck(conn, msg.Ack, nil, nil, 0)
 	}
 }
 
 func (hub *MsgHub) handleRemove(msg *Msg, conn *Conn) {
-	// Remove children first
-	node := hub.bus.pathTree.get(msg.Path)
-	if node == nil {
-		err := "Path does not exist"
-		hub.sendAck(conn, msg.Ack, &err, nil, 0)
-		return
-	}
-	// Depth first traversal of path
-	hub.publishAndDestroy(node.path)
-	hub.locker.lock(node.path)
-	setErr := hub.db.set(node.path, nil)
-	hub.locker.unlock(node.path)
+	// Whether anyone is subscribed has no bearing on whether there is anything to remove
+	path := msg.Path
+	setErr := hub.remove(path, func() *Error {
+		if err, value, _ := hub.db.get(path); err == nil && value == nil {
+			return NewError(MSG_ERR_NOT_FOUND, "Path does not exist")
+		}
+		if !hub.canWrite(conn, path, nil) {
+			return hub.permissionDenied(conn, msg)
+		}
+		return hub.invalidData(conn, msg, hub.validateWrite(path, nil))
+	})
 	if setErr != nil {
-		log.Fatalln("Couldn't set node value", setErr)
-		errStr := setErr.Error()
-		hub.sendAck(conn, msg.Ack, &errStr, nil, 0)
+		hub.sendAck(conn, msg.Ack, asError(setErr), nil, 0)
 	} else {
 		hub.sendAck(conn, msg.Ack, nil, nil, 0)
 	}
 }
 
 func (hub *MsgHub) handleTransSet(msg *Msg, conn *Conn) {
+	var unmarshalledValue interface{}
+	jsonErr := json.Unmarshal(msg.Data, &unmarshalledValue)
+	if jsonErr != nil {
+		hub.sendAck(conn, msg.Ack, NewError(MSG_ERR_INVALID_DATA, jsonErr.Error()), nil, 0)
+		return
+	}
+
 	hub.locker.lock(msg.Path)
+	defer hub.locker.unlock(msg.Path)
+	if !hub.canWrite(conn, msg.Path, unmarshalledValue) {
+		hub.sendPermissionDenied(conn, msg)
+		return
+	}
+	if violations := hub.validateWrite(msg.Path, unmarshalledValue); len(violations) > 0 {
+		hub.sendInvalidData(conn, msg, violations)
+		return
+	}
 	err, value, rev := hub.db.get(msg.Path)
 	if err != nil {
-		errStr := err.Error()
-		hub.sendAck(conn, msg.Ack, &errStr, nil, 0)
+		hub.sendAck(conn, msg.Ack, asError(err), nil, 0)
+		return
 	}
 
 	// compare revisions
 	if msg.Revision == rev {
-		hub.locker.unlock(msg.Path)
-		hub.handleSet(msg, conn)
+		setErr := hub.commit(msg.Path, unmarshalledValue, msg.Data)
+		if setErr != nil {
+			hub.sendAck(conn, msg.Ack, asError(setErr), nil, 0)
+		} else {
+			hub.sendAck(conn, msg.Ack, nil, nil, 0)
+		}
+	} else {
+		hub.metrics.conflicted()
+		hub.sendAck(conn, msg.Ack, NewError(MSG_ERR_TRANS_CONFLICT, "The revision has moved on"), value, 0)
+	}
+}
+
+func (hub *MsgHub) handlePush(msg *Msg, conn *Conn) {
+	key := newPushKey()
+	path := msg.Path.child(key)
+	setErr := hub.write(path, msg.Data, func() *Error {
+		if !hub.canWriteData(conn, path, msg.Data) {
+			return hub.permissionDenied(conn, msg)
+		}
+		return hub.invalidData(conn, msg, hub.validateData(path, msg.Data))
+	})
+	if setErr != nil {
+		hub.sendAck(conn, msg.Ack, asError(setErr), nil, 0)
 	} else {
-		hub.locker.unlock(msg.Path)
-		errStr := MSG_ERR_TRANS_CONFLICT
-		hub.sendAck(conn, msg.Ack, &errStr, value, 0)
+		hub.sendAck(conn, msg.Ack, nil, key, 0)
 	}
 }
 
 func (hub *MsgHub) handleTransGet(msg *Msg, conn *Conn) {
-	err, val, rev := hub.db.get(msg.Path)
+	if !hub.canRead(conn, msg.Path) {
+		hub.sendPermissionDenied(conn, msg)
+		return
+	}
+	err, val, rev := hub.read(msg, conn)
 
 	if err != nil {
-		errStr := err.Error()
-		hub.sendAck(conn, msg.Ack, &errStr, nil, 0)
+		hub.sendAck(conn, msg.Ack, asError(err), nil, 0)
 	} else {
 		hub.sendAck(conn, msg.Ack, nil, val, rev)
 	}
 }
 
-func (hub *MsgHub) publishAndDestroy(path string) {
-	node := hub.bus.pathTree.get(path)
+func (hub *MsgHub) handleGet(msg *Msg, conn *Conn) {
+	if !hub.canRead(conn, msg.Path) {
+		hub.sendPermissionDenied(conn, msg)
+		return
+	}
+	hub.locker.rlock(msg.Path)
+	err, val, rev := hub.read(msg, conn)
+	hub.locker.runlock(msg.Path)
 
-	if node != nil {
-		node.cascade(func(child *PathTreeNode) {
-			evt := ValueEvent{}
-			evt.Event = EVENT_TYPE_VALUE
-			evt.Data = nil
-			evt.Path = child.path
-			evtJson, jsonErr := json.Marshal(evt)
-			if jsonErr != nil {
-				log.Fatalln("Couldn't marshal event json", jsonErr)
-			} else {
-				hub.bus.publish(EVENT_TYPE_VALUE, child.path, evtJson)
-			}
-			// Check any parents for the child removed
-			if child.hasImmediateParent() {
-				// We need to get the child value
-				getErr, childVal, _ := hub.db.get(child.path)
-				if getErr != nil {
-					log.Fatalln("Couldn't fetch node value", getErr)
-					return
-				}
-				evt.Event = EVENT_TYPE_CHILD_REMOVED
-				evt.Data = childVal
-				evtJson, jsonErr = json.Marshal(evt)
-				if jsonErr != nil {
-					log.Fatalln("Couldn't marshal event json", jsonErr)
-				} else {
-					hub.bus.publish(EVENT_TYPE_CHILD_REMOVED, child.parent.path, evtJson)
-				}
-			}
-		})
+	if err != nil {
+		hub.sendAck(conn, msg.Ack, asError(err), nil, 0)
+		return
+	}
+	if msg.Query != nil {
+		val = msg.Query.apply(val)
+	}
+	if msg.Shallow {
+		val = shallow(val)
+	}
+	hub.sendAck(conn, msg.Ack, nil, val, rev)
+}
+
+// Reads the value at msg.Path, which may live in the .info subtree rather than the db
+func (hub *MsgHub) read(msg *Msg, conn *Conn) (error, interface{}, int) {
+	if isInfoPath(msg.Path) {
+		return nil, hub.infoValue(msg.Path, conn), 0
 	}
+	return hub.db.get(msg.Path)
 }
 
-func (hub *MsgHub) publishValueEvent(path string, value *json.RawMessage, conn *Conn) {
-	var hasValueSubs bool
-	var hasChildChangedSubs bool
-	var parentPath string
+// Whether a conn may make a write, asked once the lock on its path is held so the answer
+// can't go stale before the write lands. Writes the hub makes for itself pass nil.
+type writeCheck func() *Error
 
-	if hub.hasParent(path) {
-		parentPath = hub.parentOf(path)
+// Holds the lock on path while check runs, if there is one
+func (hub *MsgHub) lockChecked(path Path, check writeCheck) *Error {
+	hub.locker.lock(path)
+	if check == nil {
+		return nil
 	}
-	// Check if anyone is event subscribed to this
-	hasValueSubs = hub.bus.hasSubscribers(EVENT_TYPE_VALUE, path)
-	if parentPath != "" {
-		hasChildChangedSubs = hub.bus.hasSubscribers(EVENT_TYPE_CHILD_CHANGED, path)
+	if checkErr := check(); checkErr != nil {
+		hub.locker.unlock(path)
+		return checkErr
 	}
-	// Do not continue if there are no subscribers
-	if !hasValueSubs && !hasChildChangedSubs {
+	return nil
+}
+
+// Sets the value at path, holding its lock until every subscriber has been notified
+func (hub *MsgHub) write(path Path, data json.RawMessage, check writeCheck) error {
+	var unmarshalledValue interface{}
+	jsonErr := json.Unmarshal(data, &unmarshalledValue)
+	if jsonErr != nil {
+		return NewError(MSG_ERR_INVALID_DATA, jsonErr.Error())
+	}
+	if checkErr := hub.lockChecked(path, check); checkErr != nil {
+		return checkErr
+	}
+	defer hub.locker.unlock(path)
+	return hub.commit(path, unmarshalledValue, data)
+}
+
+// Writes every property of dataMap beneath path in one db transaction, so either all of them
+// land or none do. The lock on path covers every property, so they are checked and written as one.
+func (hub *MsgHub) update(path Path, dataMap json.RawMessage, check writeCheck) error {
+	propertyMap := make(map[string]json.RawMessage)
+	jsonErr := json.Unmarshal(dataMap, &propertyMap)
+	if jsonErr != nil {
+		return NewError(MSG_ERR_INVALID_DATA, jsonErr.Error())
+	}
+	values := make(map[Path]interface{}, len(propertyMap))
+	data := make(map[Path]json.RawMessage, len(propertyMap))
+	for property, propertyData := range propertyMap {
+		var value interface{}
+		if jsonErr := json.Unmarshal(propertyData, &value); jsonErr != nil {
+			return NewError(MSG_ERR_INVALID_DATA, jsonErr.Error())
+		}
+		values[path.join(property)] = value
+		data[path.join(property)] = propertyData
+	}
+
+	if checkErr := hub.lockChecked(path, check); checkErr != nil {
+		return checkErr
+	}
+	defer hub.locker.unlock(path)
+	return hub.commitAll(values, data)
+}
+
+func (hub *MsgHub) remove(path Path, check writeCheck) error {
+	if isInfoPath(path) {
+		return errInfoReadOnly
+	}
+	if checkErr := hub.lockChecked(path, check); checkErr != nil {
+		return checkErr
+	}
+	defer hub.locker.unlock(path)
+	children := hub.snapshotChildren(path)
+	// Depth first traversal of path
+	hub.publishAndDestroy(path)
+	if setErr := hub.db.set(path, nil); setErr != nil {
+		return setErr
+	}
+	hub.publishChildChanges(children)
+	hub.publishAncestorValues(path)
+	return nil
+}
+
+// Writes to the db and publishes the change; the caller must hold the lock on path
+// TODO: db should delete, then set new value
+func (hub *MsgHub) commit(path Path, value interface{}, data json.RawMessage) error {
+	return hub.commitAll(map[Path]interface{}{path: value}, map[Path]json.RawMessage{path: data})
+}
+
+// Writes every value to the db in one transaction, then publishes the changes; the caller must hold the lock on every path
+func (hub *MsgHub) commitAll(values map[Path]interface{}, data map[Path]json.RawMessage) error {
+	children := make(map[Path]*childSnapshot, len(values))
+	for path := range values {
+		if isInfoPath(path) {
+			return errInfoReadOnly
+		}
+		children[path] = hub.snapshotChildren(path)
+	}
+	log.Println("Now setting values at", len(values), "paths")
+	setErr := hub.db.setAll(values)
+	if setErr != nil {
+		log.Println("Couldn't set node value", setErr)
+		return setErr
+	}
+	for path := range values {
+		// Notify all listeners of recursive value change
+		hub.publishAndDestroy(path)
+		hub.publishChildChanges(children[path])
+		pathData := data[path]
+		hub.publishValueEvent(path, &pathData)
+		hub.publishAncestorValues(path)
+		hub.publishDescendantValues(path)
+	}
+	return nil
+}
+
+func (hub *MsgHub) handleAuth(msg *Msg, conn *Conn) {
+	identity, err := hub.config.Auth.verify(msg.Cred)
+	if err != nil {
+		hub.sendAck(conn, msg.Ack, NewError(MSG_ERR_PERMISSION_DENIED, err.Error()), nil, 0)
+		return
+	}
+	conn.authenticate(identity)
+	log.Printf("Connection #%d is now authenticated as '%s'\n", conn.id, identity.Uid)
+	hub.sendAck(conn, msg.Ack, nil, identity.Claims, 0)
+	hub.recheckReads(conn)
+}
+
+func (hub *MsgHub) handleUnauth(msg *Msg, conn *Conn) {
+	conn.unauthenticate()
+	hub.sendAck(conn, msg.Ack, nil, nil, 0)
+	hub.recheckReads(conn)
+}
+
+// Drops every subscription and delta stream conn may no longer read, now that it is someone else
+func (hub *MsgHub) recheckReads(conn *Conn) {
+	for _, sub := range hub.bus.subscriptionsOf(conn) {
+		if !hub.canRead(conn, sub.path) {
+			log.Printf("Connection #%d can no longer read path '%s', dropping its subscription\n", conn.id, sub.path)
+			hub.bus.unsubscribe(sub.evt, sub.path, conn)
+		}
+	}
+	for _, path := range conn.deltaPaths() {
+		if !hub.canRead(conn, path) {
+			conn.untrackDelta(path)
+		}
+	}
+}
+
+// Tells the client its token ran out; it will need to auth again
+func (hub *MsgHub) sendAuthRevoked(conn *Conn) {
+	payload, err := json.Marshal(Ack{Type: MSG_CMD_AUTH_REVOKED})
+	if err == nil {
+		conn.outbox.push(payload)
+	}
+}
+
+func (hub *MsgHub) handleOnDisconnect(msg *Msg, conn *Conn) {
+	if msg.Cmd == MSG_CMD_ON_DISCONNECT_UPDATE && msg.DataMap == nil {
+		hub.sendAck(conn, msg.Ack, NewError(MSG_ERR_INVALID_DATA, "Update requires a data map"), nil, 0)
+		return
+	}
+	// Checked now, while we still know who is asking
+	allowed := true
+	switch msg.Cmd {
+	case MSG_CMD_ON_DISCONNECT_SET:
+		allowed = hub.canWriteData(conn, msg.Path, msg.Data)
+	case MSG_CMD_ON_DISCONNECT_UPDATE:
+		allowed = hub.canUpdate(conn, msg.Path, msg.DataMap)
+	case MSG_CMD_ON_DISCONNECT_REMOVE:
+		allowed = hub.canWrite(conn, msg.Path, nil)
+	}
+	if !allowed {
+		hub.sendPermissionDenied(conn, msg)
 		return
 	}
-	// This is what we are sending subscribers to a value related event
-	evt := ValueEvent{
-		Path: path,
-		Data: value,
+	if violations := hub.validateDisconnectOp(msg); len(violations) > 0 {
+		hub.sendInvalidData(conn, msg, violations)
+		return
 	}
-	// Send the event to value listeners
-	if hasValueSubs {
-		// Set the event type; jsonify
-		evt.Event = EVENT_TYPE_VALUE
-		evtJson, err := json.Marshal(evt)
+	conn.addDisconnectOp(msg)
+	hub.sendAck(conn, msg.Ack, nil, nil, 0)
+}
+
+func (hub *MsgHub) handleCancelOnDisconnect(msg *Msg, conn *Conn) {
+	conn.cancelDisconnectOps(msg.Path)
+	hub.sendAck(conn, msg.Ack, nil, nil, 0)
+}
+
+// The schema violations a disconnect op would cause if it ran against the tree as it is now
+func (hub *MsgHub) validateDisconnectOp(op *Msg) []*ErrorDetail {
+	switch op.Cmd {
+	case MSG_CMD_ON_DISCONNECT_SET:
+		return hub.validateData(op.Path, op.Data)
+	case MSG_CMD_ON_DISCONNECT_UPDATE:
+		return hub.validateUpdate(op.Path, op.DataMap)
+	case MSG_CMD_ON_DISCONNECT_REMOVE:
+		return hub.validateWrite(op.Path, nil)
+	}
+	return nil
+}
+
+// Applies the ops of a departed conn in the order they were registered
+func (hub *MsgHub) runDisconnectOps(conn *Conn, ops []*Msg) {
+	defer func() {
+		if problem := recover(); problem != nil {
+			log.Printf("Disconnect ops panicked: %v\n%s", problem, debug.Stack())
+		}
+	}()
+	for _, op := range ops {
+		op := op
+		// The tree may have moved on since the op was registered, so its schema is checked again
+		check := func() *Error {
+			return hub.invalidData(conn, op, hub.validateDisconnectOp(op))
+		}
+		var err error
+		switch op.Cmd {
+		case MSG_CMD_ON_DISCONNECT_SET:
+			err = hub.write(op.Path, op.Data, check)
+		case MSG_CMD_ON_DISCONNECT_UPDATE:
+			err = hub.update(op.Path, op.DataMap, check)
+		case MSG_CMD_ON_DISCONNECT_REMOVE:
+			err = hub.remove(op.Path, check)
+		}
 		if err != nil {
-			problem := "Couldn't marshal msg value json\n"
-			log.Fatalln(problem, err)
-			return
+			log.Printf("Disconnect op #%d on path '%s' failed: %s\n", op.Cmd, op.Path, err)
 		}
-		hub.bus.publish(EVENT_TYPE_VALUE, path, evtJson)
 	}
-	// Send the event to child changed listeners
-	if hasChildChangedSubs && hub.hasParent(path) {
-		// Set the event type, parent path; jsonify
-		if value == nil {
-			evt.Event = EVENT_TYPE_CHILD_REMOVED
+}
+
+func (hub *MsgHub) publishAndDestroy(path Path) {
+	hub.bus.cascade(path, func(childPath Path) {
+		evt := ValueEvent{}
+		evt.Event = EVENT_TYPE_VALUE
+		evt.Data = nil
+		evt.Path = childPath
+		evtJson, jsonErr := json.Marshal(evt)
+		if jsonErr != nil {
+			log.Println("Couldn't marshal event json", jsonErr)
 		} else {
-			evt.Event = EVENT_TYPE_CHILD_CHANGED
+			hub.bus.publish(EVENT_TYPE_VALUE, childPath, evtJson)
+		}
+	})
+}
+
+func (hub *MsgHub) publishValueEvent(path Path, value *json.RawMessage) {
+	if !hub.bus.hasSubscribers(EVENT_TYPE_VALUE, path) {
+		return
+	}
+	evtJson, err := json.Marshal(ValueEvent{Path: path, Event: EVENT_TYPE_VALUE, Data: value})
+	if err != nil {
+		log.Println("Couldn't marshal event json", err)
+		return
+	}
+	hub.bus.publish(EVENT_TYPE_VALUE, path, evtJson)
+}
+
+// How the nodes a write to path reaches looked beforehand, for whoever watches their children
+type childSnapshot struct {
+	// The highest node anyone needs, and its value; everything else is read out of it
+	top    Path
+	before interface{}
+	// The nodes with child subscribers: ancestors of path, then path and what lies beneath it
+	ancestors []Path
+	nodes     []Path
+}
+
+// Nil if nobody is watching the children of anything the write touches
+func (hub *MsgHub) snapshotChildren(path Path) *childSnapshot {
+	snapshot := childSnapshot{top: path}
+	for _, ancestor := range hub.bus.watchedAncestors(path) {
+		if hub.bus.hasChildSubscribers(ancestor) {
+			snapshot.ancestors = append(snapshot.ancestors, ancestor)
+			// The child of the ancestor on the way down to path
+			snapshot.top = ancestor.child(path.keys()[len(ancestor.keys())])
+		}
+	}
+	for _, node := range append([]Path{path}, hub.bus.watchedDescendants(path)...) {
+		if hub.bus.hasChildSubscribers(node) {
+			snapshot.nodes = append(snapshot.nodes, node)
+		}
+	}
+	if len(snapshot.ancestors) == 0 && len(snapshot.nodes) == 0 {
+		return nil
+	}
+	getErr, before, _ := hub.db.get(snapshot.top)
+	if getErr != nil {
+		log.Println("Couldn't fetch node value", getErr)
+		return nil
+	}
+	snapshot.before = before
+	return &snapshot
+}
+
+// Tells child subscribers what a write added, changed or removed, comparing against the snapshot taken before it
+func (hub *MsgHub) publishChildChanges(snapshot *childSnapshot) {
+	if snapshot == nil {
+		return
+	}
+	getErr, after, _ := hub.db.get(snapshot.top)
+	if getErr != nil {
+		log.Println("Couldn't fetch node value", getErr)
+		return
+	}
+	topKeys := len(snapshot.top.keys())
+	valuesAt := func(path Path) (interface{}, interface{}) {
+		relative := path.keys()[topKeys:]
+		return valueAt(snapshot.before, relative), valueAt(after, relative)
+	}
+	for _, node := range snapshot.nodes {
+		before, after := valuesAt(node)
+		hub.publishChildEvents(node, before, after)
+	}
+	// Above the write only one child of each ancestor can have changed
+	for _, ancestor := range snapshot.ancestors {
+		child := snapshot.top.keys()[len(ancestor.keys())]
+		before, after := valuesAt(ancestor.child(child))
+		hub.publishChildEvents(ancestor, map[string]interface{}{child: before}, map[string]interface{}{child: after})
+	}
+}
+
+// Tells child subscribers of path which of its children a write added, changed or removed
+func (hub *MsgHub) publishChildEvents(path Path, before interface{}, after interface{}) {
+	beforeMap, _ := before.(map[string]interface{})
+	afterMap, _ := after.(map[string]interface{})
+	publish := func(eventType byte, name string, value interface{}) {
+		if !hub.bus.hasSubscribers(eventType, path) {
+			return
 		}
-		evt.Path = hub.parentOf(path)
-		evtJson, err := json.Marshal(evt)
+		evtJson, err := json.Marshal(ValueEvent{Path: path, Event: eventType, Name: name, Data: value})
 		if err != nil {
-			problem := "Couldn't marshal msg value json\n"
-			log.Fatalln(problem, err)
+			log.Println("Couldn't marshal event json", err)
 			return
 		}
-		hub.bus.publish(EVENT_TYPE_CHILD_CHANGED, path, evtJson)
+		hub.bus.publish(eventType, path, evtJson)
+	}
+	for name, value := range afterMap {
+		if previous := beforeMap[name]; value == nil {
+			continue
+		} else if previous == nil {
+			publish(EVENT_TYPE_CHILD_ADDED, name, value)
+		} else if !reflect.DeepEqual(previous, value) {
+			publish(EVENT_TYPE_CHILD_CHANGED, name, value)
+		}
+	}
+	for name, value := range beforeMap {
+		if value != nil && afterMap[name] == nil {
+			publish(EVENT_TYPE_CHILD_REMOVED, name, value)
+		}
 	}
 }
 
-func (hub *MsgHub) hasParent(path string) bool {
-	return path != "/"
+// Sends fresh values to the subscribers of every path above a change.
+// Writers hold the lock on each ancestor, so these go out in the order the writes happened.
+func (hub *MsgHub) publishAncestorValues(path Path) {
+	for _, ancestor := range hub.bus.watchedAncestors(path) {
+		hub.publishStoredValue(ancestor)
+	}
 }
 
-func (hub *MsgHub) parentOf(path string) string {
-	lastIndex := strings.LastIndex(path, "/")
-	return path[0:lastIndex]
+// Sends the values a write left beneath path to their subscribers, after publishAndDestroy cleared them
+func (hub *MsgHub) publishDescendantValues(path Path) {
+	for _, descendant := range hub.bus.watchedDescendants(path) {
+		hub.publishStoredValue(descendant)
+	}
 }
 
-func (hub *MsgHub) joinPaths(base string, extension string) string {
-	if !strings.HasSuffix(base, "/") {
-		base = base + "/"
+func (hub *MsgHub) publishStoredValue(path Path) {
+	if !hub.bus.hasSubscribers(EVENT_TYPE_VALUE, path) {
+		return
 	}
-	if strings.HasPrefix(extension, "/") {
-		if len(extension) > 1 {
-			extension = extension[1:]
-		} else {
-			extension = ""
-		}
+	getErr, value, _ := hub.db.get(path)
+	if getErr != nil {
+		log.Println("Couldn't fetch node value", getErr)
+		return
+	}
+	evtJson, err := json.Marshal(ValueEvent{Path: path, Event: EVENT_TYPE_VALUE, Data: value})
+	if err != nil {
+		log.Println("Couldn't marshal event json", err)
+		return
 	}
-	return base + extension
+	hub.bus.publish(EVENT_TYPE_VALUE, path, evtJson)
+}
+
+func (hub *MsgHub) sendPermissionDenied(conn *Conn, msg *Msg) {
+	hub.sendAck(conn, msg.Ack, hub.permissionDenied(conn, msg), nil, 0)
 }
 
-func (hub *MsgHub) sendAck(conn *Conn, ack int, errString *string, result interface{}, rev int) {
+func (hub *MsgHub) permissionDenied(conn *Conn, msg *Msg) *Error {
+	log.Printf("Connection #%d was denied cmd #%d on path: '%s'\n", conn.id, msg.Cmd, msg.Path)
+	return NewError(MSG_ERR_PERMISSION_DENIED, "Permission denied")
+}
+
+// Queues an event for conn alone
+func (hub *MsgHub) sendEvent(conn *Conn, evt *ValueEvent) {
+	evtJson, err := json.Marshal(evt)
+	if err != nil {
+		log.Println("Couldn't marshal event json", err)
+		return
+	}
+	if evt.Event == EVENT_TYPE_VALUE {
+		conn.deliver(evtJson, string(evt.Path))
+	} else {
+		conn.deliver(evtJson, "")
+	}
+}
+
+func (hub *MsgHub) sendAck(conn *Conn, ack int, ackErr *Error, result interface{}, rev int) {
 	response := Ack{
 		Type:     MSG_CMD_ACK,
 		Ack:      ack,
@@ -360,16 +862,13 @@ func (hub *MsgHub) sendAck(conn *Conn, ack int, errString *string, result interf
 		Revision: rev,
 	}
 
-	if errString != nil {
-		log.Println("Sending problem back to client in ack form:", *errString)
-		response.Error = *errString
+	hub.metrics.acked(ackErr)
+	if ackErr != nil {
+		log.Println("Sending problem back to client in ack form:", ackErr)
+		response.Error = ackErr
 	}
 	payload, err := json.Marshal(response)
 	if err == nil {
-		select {
-		case conn.outbox <- payload:
-		default:
-			hub.unregisterConn(conn)
-		}
+		conn.outbox.push(payload)
 	}
 }
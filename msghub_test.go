@@ -1,41 +1,72 @@
 package turbo
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
 	"testing"
+	"time"
 )
 
-func TestJoinPaths(t *testing.T) {
-	hub := NewMsgHub(nil, nil)
+// A conn with no socket behind it, for driving the bus or hub straight from a test; hub may be nil
+func newTestConn(hub *MsgHub, id uint64) *Conn {
+	return &Conn{
+		id:            id,
+		outbox:        newOutbox(BackpressureConfig{}, nil),
+		subscriptions: make(map[*map[*Conn]bool]bool),
+		hub:           hub,
+	}
+}
 
-	str1 := hub.joinPaths("/", "/dfdf/dsfsdf/ds")
-	str2 := hub.joinPaths("/234/45/", "/dfdf/dsfsdf/ds")
-	str3 := hub.joinPaths("/234/45", "dfdf/dsfsdf/ds")
+// Waits for the next message
+func nextPayload(outbox *Outbox) []byte {
+	payload, _ := outbox.pop()
+	return payload
+}
 
-	if str1 != "/dfdf/dsfsdf/ds" {
-		t.Error("The path join with str1 failed", str1)
+// The next message if there is one already, without waiting
+func tryPop(outbox *Outbox) []byte {
+	outbox.lock.Lock()
+	empty := len(outbox.items) == 0
+	outbox.lock.Unlock()
+	if empty {
+		return nil
 	}
-	if str2 != "/234/45/dfdf/dsfsdf/ds" {
-		t.Error("The path join with str2 failed", str2)
+	return nextPayload(outbox)
+}
+
+func closedWithin(outbox *Outbox, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		outbox.lock.Lock()
+		closed := outbox.closed
+		outbox.lock.Unlock()
+		if closed {
+			return true
+		}
+		time.Sleep(time.Millisecond)
 	}
-	if str3 != "/234/45/dfdf/dsfsdf/ds" {
-		t.Error("The path join with str3 failed", str3)
+	return false
+}
+
+// The error code of an ack, or "" if it succeeded
+func ackCode(ack Ack) string {
+	if ack.Error == nil {
+		return ""
 	}
+	return ack.Error.Code
 }
 
 func TestSendAck(t *testing.T) {
 	bus := NewMsgBus()
-	hub := NewMsgHub(bus, nil)
-	conn := Conn{
-		id:            1,
-		ws:            nil,
-		outbox:        make(chan []byte, 256),
-		subscriptions: make(map[*map[*Conn]bool]bool),
-		hub:           nil,
-	}
+	hub := NewMsgHub(bus, nil, nil)
+	conn := newTestConn(nil, 1)
 	// Test error
-	errStr := "This is an error"
-	hub.sendAck(&conn, 1, &errStr, nil, 0)
+	ackErr := NewError(MSG_ERR_NOT_FOUND, "This is an error")
+	ackErr.Details = []*ErrorDetail{{Path: "/a", Message: "Missing"}}
+	hub.sendAck(conn, 1, ackErr, nil, 0)
 	// Test regular w/ empty hash
 	testVal := map[string]interface{}{
 		"key1": "value1",
@@ -46,18 +77,391 @@ func TestSendAck(t *testing.T) {
 		},
 		"key4": [...]int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10},
 	}
-	jsonErr, jsonVal := json.Marshal(testVal)
-	if jsonErr != nil {
-		t.Error("Could not serialize testVal", jsonErr)
-		t.FailNow()
-		return
+	hub.sendAck(conn, 2, nil, testVal, 0)
+
+	ack := Ack{}
+	json.Unmarshal(nextPayload(conn.outbox), &ack)
+	if ack.Ack != 1 || ackCode(ack) != MSG_ERR_NOT_FOUND || ack.Error.Message != "This is an error" {
+		t.Error("Error ack was wrong", ack.Ack, ack.Error)
+	}
+	if len(ack.Error.Details) != 1 || ack.Error.Details[0].Path != "/a" {
+		t.Error("Error ack lost its details", ack.Error.Details)
+	}
+	ack = Ack{}
+	json.Unmarshal(nextPayload(conn.outbox), &ack)
+	if ack.Ack != 2 || ack.Error != nil {
+		t.Error("Regular ack was wrong", ack.Ack, ack.Error)
+	}
+	if data, isMap := ack.Data.(map[string]interface{}); !isMap || data["key1"] != "value1" {
+		t.Error("Regular ack lost its data", ack.Data)
+	}
+}
+
+func TestErrorAcks(t *testing.T) {
+	db := newTestDb(t)
+	rules, _ := ParseRules([]byte(`{"rules": {".read": true, "users": {".write": true}}}`))
+	schemas, _ := ParseSchemas([]byte(testSchemas))
+	hub := NewMsgHub(NewMsgBus(), db, &Config{Rules: rules, Schemas: schemas})
+	conn := newTestConn(hub, 1)
+	// The code of each ack, and the paths of its details
+	send := func(msg *Msg) (string, map[string]bool) {
+		hub.dispatch(msg, conn)
+		ack := Ack{}
+		json.Unmarshal(nextPayload(conn.outbox), &ack)
+		paths := map[string]bool{}
+		if ack.Error != nil {
+			for _, detail := range ack.Error.Details {
+				paths[detail.Path] = true
+			}
+		}
+		return ackCode(ack), paths
+	}
+
+	if code, _ := send(&Msg{Cmd: MSG_CMD_REMOVE, Path: "/users/nobody", Ack: 1}); code != MSG_ERR_NOT_FOUND {
+		t.Error("Removing nothing was not a not found", code)
+	}
+	if code, _ := send(&Msg{Cmd: MSG_CMD_SET, Path: "/closed", Data: json.RawMessage(`1`), Ack: 2}); code != MSG_ERR_PERMISSION_DENIED {
+		t.Error("Denied write was not a permission denied", code)
+	}
+	if code, _ := send(&Msg{Cmd: MSG_CMD_SET, Path: "/users/bob", Data: json.RawMessage(`{"name": `), Ack: 3}); code != MSG_ERR_INVALID_DATA {
+		t.Error("Bad json was not invalid data", code)
+	}
+
+	// Every schema violation comes back as a detail
+	code, paths := send(&Msg{Cmd: MSG_CMD_SET, Path: "/users/bob", Data: json.RawMessage(`{"age": -1.5, "email": "bob"}`), Ack: 4})
+	if code != MSG_ERR_INVALID_DATA || !paths["/users/bob"] || !paths["/users/bob/age"] || !paths["/users/bob/email"] {
+		t.Error("Schema violations were not all detailed", code, paths)
+	}
+	code, paths = send(&Msg{Cmd: MSG_CMD_UPDATE, Path: "/users/bob", DataMap: json.RawMessage(`{"name": "bob", "age": -1}`), Ack: 5})
+	if code != MSG_ERR_INVALID_DATA || len(paths) != 1 || !paths["/users/bob/age"] {
+		t.Error("Update's schema violation was not detailed", code, paths)
+	}
+	// As is every bad key, wherever in the data it is
+	code, paths = send(&Msg{Cmd: MSG_CMD_SET, Path: "/users/bob", Data: json.RawMessage(`{"a.b": 1, "c": {"d$": 2}}`), Ack: 6})
+	if code != MSG_ERR_INVALID_DATA || !paths["/users/bob/a%2Eb"] || !paths["/users/bob/c/d%24"] {
+		t.Error("Bad keys were not all detailed", code, paths)
+	}
+	if _, val, _ := db.get("/users/bob"); val != nil {
+		t.Error("Refused writes were applied", val)
+	}
+
+	// Errors from outside the hub are internal
+	if err := asError(errors.New("disk on fire")); err.Code != MSG_ERR_INTERNAL || err.Message != "disk on fire" {
+		t.Error("Foreign error was not internal", err)
+	}
+	if notFound := NewError(MSG_ERR_NOT_FOUND, "gone"); asError(notFound) != notFound || asError(nil) != nil {
+		t.Error("asError changed an error that was already ours")
 	}
-	hub.sendAck(&conn, 2, nil, jsonVal, 0)
-	// With hash
-	// hub.sendAck(&conn, 3, nil, jsonVal, hash(testVal))
-	// TODO read through outbox to check the acks
 }
 
 func TestObjHash(t *testing.T) {
 	// TODO check our hash actually fucking works
 }
+
+func TestSubscribeSnapshot(t *testing.T) {
+	db := newTestDb(t)
+	hub := NewMsgHub(NewMsgBus(), db, nil)
+	conn := newTestConn(hub, 1)
+	hub.write("/a", json.RawMessage(`{"x": 1, "y": 2}`), nil)
+
+	hub.handleOn(&Msg{Cmd: MSG_CMD_ON, Path: "/a", Event: EVENT_TYPE_VALUE}, conn)
+	hub.handleOn(&Msg{Cmd: MSG_CMD_ON, Path: "/a", Event: EVENT_TYPE_CHILD_ADDED}, conn)
+
+	// Each snapshot ends with an ack
+	done, _ := json.Marshal(Ack{Type: MSG_CMD_ACK})
+	expected := []string{
+		`{"path":"/a","eventType":0,"data":{"x":1,"y":2}}`,
+		string(done),
+		`{"path":"/a","eventType":1,"name":"x","data":1}`,
+		`{"path":"/a","eventType":1,"name":"y","data":2}`,
+		string(done),
+	}
+	for _, evt := range expected {
+		if msg := tryPop(conn.outbox); msg == nil {
+			t.Error("Snapshot event was never sent", evt)
+		} else if string(msg) != evt {
+			t.Error("Snapshot event was wrong", string(msg))
+		}
+	}
+	if !hub.bus.hasSubscribers(EVENT_TYPE_VALUE, "/a") {
+		t.Error("Snapshot did not subscribe the conn")
+	}
+
+	// A snapshot that can't be read undoes the subscription and says why
+	db.dbMap.Insert(&Entry{Path: "/b", Type: ENTRY_TYPE_FLOAT, Value: sql.NullString{String: "not a float", Valid: true}})
+	hub.handleOn(&Msg{Cmd: MSG_CMD_ON, Path: "/b", Event: EVENT_TYPE_VALUE, Delta: true, Ack: 1}, conn)
+	ack := Ack{}
+	json.Unmarshal(nextPayload(conn.outbox), &ack)
+	if ack.Ack != 1 || ackCode(ack) != MSG_ERR_INTERNAL {
+		t.Error("Failed snapshot was not acked with its error", ack.Ack, ack.Error)
+	}
+	if hub.bus.hasSubscribers(EVENT_TYPE_VALUE, "/b") || len(conn.deltaPaths()) != 0 {
+		t.Error("Failed snapshot left the conn subscribed")
+	}
+}
+
+func TestChildEvents(t *testing.T) {
+	db := newTestDb(t)
+	hub := NewMsgHub(NewMsgBus(), db, nil)
+	conn := newTestConn(hub, 1)
+	writer := newTestConn(nil, 0)
+	for _, evt := range []byte{EVENT_TYPE_CHILD_ADDED, EVENT_TYPE_CHILD_CHANGED, EVENT_TYPE_CHILD_REMOVED} {
+		hub.handleOn(&Msg{Cmd: MSG_CMD_ON, Path: "/a", Event: evt}, conn)
+		// Just the ack, as /a is empty
+		tryPop(conn.outbox)
+	}
+	// Every kind of write, straight onto a child or from further up or down
+	expect := func(msg *Msg, expected ...string) {
+		hub.dispatch(msg, writer)
+		for _, evt := range expected {
+			if payload := tryPop(conn.outbox); string(payload) != evt {
+				t.Error("Expected", evt, "but got", string(payload))
+			}
+		}
+		if payload := tryPop(conn.outbox); payload != nil {
+			t.Error("Unexpected event", string(payload))
+		}
+	}
+	expect(&Msg{Cmd: MSG_CMD_SET, Path: "/a/x", Data: json.RawMessage(`1`)},
+		`{"path":"/a","eventType":1,"name":"x","data":1}`)
+	expect(&Msg{Cmd: MSG_CMD_SET, Path: "/a/x", Data: json.RawMessage(`2`)},
+		`{"path":"/a","eventType":2,"name":"x","data":2}`)
+	expect(&Msg{Cmd: MSG_CMD_UPDATE, Path: "/a", DataMap: json.RawMessage(`{"y/z": 3}`)},
+		`{"path":"/a","eventType":1,"name":"y","data":{"z":3}}`)
+	expect(&Msg{Cmd: MSG_CMD_SET, Path: "/a/y/z", Data: json.RawMessage(`4`)},
+		`{"path":"/a","eventType":2,"name":"y","data":{"z":4}}`)
+	expect(&Msg{Cmd: MSG_CMD_REMOVE, Path: "/a/x"},
+		`{"path":"/a","eventType":4,"name":"x","data":2}`)
+	expect(&Msg{Cmd: MSG_CMD_SET, Path: "/", Data: json.RawMessage(`{"a": {"y": {"z": 4}}}`)})
+	expect(&Msg{Cmd: MSG_CMD_SET, Path: "/", Data: json.RawMessage(`{"b": 1}`)},
+		`{"path":"/a","eventType":4,"name":"y","data":{"z":4}}`)
+
+	hub.dispatch(&Msg{Cmd: MSG_CMD_PUSH, Path: "/a", Data: json.RawMessage(`5`)}, writer)
+	evt := ValueEvent{}
+	json.Unmarshal(tryPop(conn.outbox), &evt)
+	if evt.Path != "/a" || evt.Event != EVENT_TYPE_CHILD_ADDED || evt.Name == "" || evt.Data != 5.0 {
+		t.Error("Push was not announced", evt)
+	}
+}
+
+func TestDisconnectOps(t *testing.T) {
+	db := newTestDb(t)
+	hub := NewMsgHub(NewMsgBus(), db, nil)
+	conn := newTestConn(hub, 1)
+
+	hub.handleOnDisconnect(&Msg{Cmd: MSG_CMD_ON_DISCONNECT_SET, Path: "/presence/1", Data: json.RawMessage(`"offline"`)}, conn)
+	hub.handleOnDisconnect(&Msg{Cmd: MSG_CMD_ON_DISCONNECT_SET, Path: "/typing/1", Data: json.RawMessage(`true`)}, conn)
+	hub.handleOnDisconnect(&Msg{Cmd: MSG_CMD_ON_DISCONNECT_UPDATE, Path: "/users/1", DataMap: json.RawMessage(`{"online": false}`)}, conn)
+	hub.handleCancelOnDisconnect(&Msg{Cmd: MSG_CMD_ON_DISCONNECT_CANCEL, Path: "/typing"}, conn)
+
+	hub.runDisconnectOps(conn, conn.takeDisconnectOps())
+
+	if _, val, _ := hub.db.get("/presence/1"); val != "offline" {
+		t.Error("Disconnect set was not applied", val)
+	}
+	if _, val, _ := hub.db.get("/users/1/online"); val != false {
+		t.Error("Disconnect update was not applied", val)
+	}
+	if _, val, _ := hub.db.get("/typing/1"); val != nil {
+		t.Error("Cancelled disconnect op was applied", val)
+	}
+	if len(conn.takeDisconnectOps()) != 0 {
+		t.Error("Disconnect ops were handed over twice")
+	}
+}
+
+func TestInfo(t *testing.T) {
+	db := newTestDb(t)
+	hub := NewMsgHub(NewMsgBus(), db, nil)
+	conn := newTestConn(hub, 7)
+
+	hub.handleOn(&Msg{Cmd: MSG_CMD_ON, Path: "/.info/connected", Event: EVENT_TYPE_VALUE}, conn)
+	if msg := tryPop(conn.outbox); string(msg) != `{"path":"/.info/connected","eventType":0,"data":false}` {
+		t.Error("Conn was connected before the handshake", string(msg))
+	}
+	tryPop(conn.outbox)
+	if _, val, _ := hub.read(&Msg{Path: "/.info/serverTimeOffset"}, conn); val != nil {
+		t.Error("Offset was made up without a timestamp", val)
+	}
+
+	// Welcoming the conn tells its subscription, and the hello's timestamp sets the offset
+	hub.handshake(conn, []byte(fmt.Sprintf(`{"cmd": 20, "version": "1.0", "timestamp": %d}`, time.Now().UnixNano()/int64(time.Millisecond)-5000)))
+	tryPop(conn.outbox)
+	event := ValueEvent{}
+	json.Unmarshal(tryPop(conn.outbox), &event)
+	if event.Path != "/.info/connected" || event.Data != true {
+		t.Error(".info/connected was not sent on connecting", event)
+	}
+	if _, val, _ := hub.read(&Msg{Path: "/.info/serverTimeOffset"}, conn); val == nil || val.(int64) < 5000 || val.(int64) > 6000 {
+		t.Error(".info/serverTimeOffset was wrong", val)
+	}
+
+	_, val, _ := hub.read(&Msg{Path: "/.info/connectionId"}, conn)
+	if val != conn.id {
+		t.Error(".info/connectionId was wrong", val)
+	}
+
+	if err := hub.write("/.info/connected", json.RawMessage(`false`), nil); err == nil {
+		t.Error(".info was writable")
+	}
+	if _, val, _ := hub.db.get("/.info/connected"); val != nil {
+		t.Error(".info was persisted", val)
+	}
+}
+
+func TestPermissionDenied(t *testing.T) {
+	db := newTestDb(t)
+	rules, _ := ParseRules([]byte(`{"rules": {"open": {".read": true, ".write": true}}}`))
+	hub := NewMsgHub(NewMsgBus(), db, &Config{Rules: rules})
+	conn := newTestConn(hub, 1)
+
+	hub.handleSet(&Msg{Cmd: MSG_CMD_SET, Path: "/closed", Data: json.RawMessage(`1`), Ack: 1}, conn)
+	hub.handleSet(&Msg{Cmd: MSG_CMD_SET, Path: "/open", Data: json.RawMessage(`1`), Ack: 2}, conn)
+	hub.handleGet(&Msg{Cmd: MSG_CMD_GET, Path: "/closed", Ack: 3}, conn)
+
+	for _, expected := range []string{MSG_ERR_PERMISSION_DENIED, "", MSG_ERR_PERMISSION_DENIED} {
+		ack := Ack{}
+		json.Unmarshal(nextPayload(conn.outbox), &ack)
+		if ackCode(ack) != expected {
+			t.Error("Ack", ack.Ack, "had the wrong error", ack.Error)
+		}
+	}
+	if _, val, _ := hub.db.get("/closed"); val != nil {
+		t.Error("Denied write was applied", val)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	db := newTestDb(t)
+	rules, _ := ParseRules([]byte(`{"rules": {"rooms": {"$room": {".read": true, ".write": true,
+		"b": {".validate": "newData.parent().child('a').val() == 1"}}}}}`))
+	hub := NewMsgHub(NewMsgBus(), db, &Config{Rules: rules})
+	conn := newTestConn(hub, 1)
+
+	// Each property's rules see the others written alongside it
+	hub.handleUpdate(&Msg{Cmd: MSG_CMD_UPDATE, Path: "/rooms/r", DataMap: json.RawMessage(`{"a": 1, "b": 2}`), Ack: 1}, conn)
+	hub.handleUpdate(&Msg{Cmd: MSG_CMD_UPDATE, Path: "/rooms/r", DataMap: json.RawMessage(`{"a": 2, "b": 3}`), Ack: 2}, conn)
+	for _, expected := range []string{"", MSG_ERR_PERMISSION_DENIED} {
+		ack := Ack{}
+		json.Unmarshal(nextPayload(conn.outbox), &ack)
+		if ackCode(ack) != expected {
+			t.Error("Ack", ack.Ack, "had the wrong error", ack.Error)
+		}
+	}
+	if _, val, _ := db.get("/rooms/r"); !reflect.DeepEqual(val, map[string]interface{}{"a": 1.0, "b": 2.0}) {
+		t.Error("Update was not applied as a whole", val)
+	}
+
+	// A property that can't be written stops the others too
+	if err := hub.update("/", json.RawMessage(`{"z": 1, ".info/x": 2}`), nil); err == nil {
+		t.Error("Update into .info was allowed")
+	}
+	if _, val, _ := db.get("/z"); val != nil {
+		t.Error("Failed update was partly applied", val)
+	}
+}
+
+func TestRouteErrors(t *testing.T) {
+	hub := NewMsgHub(NewMsgBus(), nil, nil)
+	go hub.listen()
+	conn := newTestConn(hub, 1)
+	hub.registerConn(conn)
+
+	// Unknown commands are refused, not fatal
+	hub.dispatch(&Msg{Cmd: 99, Ack: 1}, conn)
+	ack := Ack{}
+	json.Unmarshal(nextPayload(conn.outbox), &ack)
+	if ack.Ack != 1 || ackCode(ack) != MSG_ERR_INVALID_DATA {
+		t.Error("Unknown cmd was not refused", ack.Ack, ack.Error)
+	}
+
+	// So are unknown events, before they reach the bus
+	hub.dispatch(&Msg{Cmd: MSG_CMD_ON, Path: "/a", Event: EVENT_TYPES + 4, Ack: 3}, conn)
+	ack = Ack{}
+	json.Unmarshal(nextPayload(conn.outbox), &ack)
+	if ack.Ack != 3 || ackCode(ack) != MSG_ERR_INVALID_DATA {
+		t.Error("Unknown event was not refused", ack.Ack, ack.Error)
+	}
+	if hub.bus.pathTree.get("/a") != nil {
+		t.Error("Unknown event left a node in the path tree")
+	}
+
+	// Panics only cost the message that caused them
+	hub.safely(func(*Msg, *Conn) { panic("boom") }, &Msg{Ack: 2}, conn)
+	ack = Ack{}
+	json.Unmarshal(nextPayload(conn.outbox), &ack)
+	if ack.Ack != 2 || ackCode(ack) != MSG_ERR_INTERNAL {
+		t.Error("Panic was not reported", ack.Ack, ack.Error)
+	}
+
+	// Garbage closes the conn
+	hub.route(&RawMsg{Conn: conn, Payload: []byte(`{not json`)})
+	if !closedWithin(conn.outbox, time.Second) {
+		t.Error("Conn was not closed after sending garbage")
+	}
+}
+
+func TestOrderedWrites(t *testing.T) {
+	db := newTestDb(t)
+	hub := NewMsgHub(NewMsgBus(), db, nil)
+	conns := make([]*Conn, 2)
+	for i := range conns {
+		conns[i] = newTestConn(hub, uint64(i+1))
+		conns[i].inbox = make(chan *Msg, 256)
+		go conns[i].worker()
+	}
+
+	// Both conns hammer their own path at once
+	count := 100
+	for i := 0; i < count; i++ {
+		for c, conn := range conns {
+			payload := fmt.Sprintf(`{"cmd": %d, "path": "/ordered/%d", "data": %d, "ack": %d}`, MSG_CMD_SET, c, i, i)
+			hub.route(&RawMsg{Conn: conn, Payload: []byte(payload)})
+		}
+	}
+	for c, conn := range conns {
+		for i := 0; i < count; i++ {
+			ack := Ack{}
+			json.Unmarshal(nextPayload(conn.outbox), &ack)
+			if ack.Ack != i || ack.Error != nil {
+				t.Error("Conn", c, "expected ack", i, "but got", ack.Ack, ack.Error)
+				t.FailNow()
+			}
+		}
+		close(conn.inbox)
+		if _, val, _ := db.get(Path(fmt.Sprintf("/ordered/%d", c))); val != float64(count-1) {
+			t.Error("Conn", c, "ended up with the wrong value", val)
+		}
+	}
+}
+
+func TestAncestorAndDescendantEvents(t *testing.T) {
+	db := newTestDb(t)
+	hub := NewMsgHub(NewMsgBus(), db, nil)
+	conn := newTestConn(hub, 1)
+	nextEvent := func() ValueEvent {
+		evt := ValueEvent{}
+		json.Unmarshal(nextPayload(conn.outbox), &evt)
+		return evt
+	}
+
+	// Writing beneath a subscribed path sends it its new value
+	hub.handleOn(&Msg{Cmd: MSG_CMD_ON, Path: "/list", Event: EVENT_TYPE_VALUE}, conn)
+	// The snapshot, then its ack
+	nextEvent()
+	nextEvent()
+	hub.write("/list/a", json.RawMessage(`1`), nil)
+	if evt := nextEvent(); evt.Path != "/list" || !reflect.DeepEqual(evt.Data, map[string]interface{}{"a": 1.0}) {
+		t.Error("Ancestor was not sent its new value", evt)
+	}
+
+	// Writing above a subscribed path reaches it, even if nobody watches the path written
+	hub.handleOn(&Msg{Cmd: MSG_CMD_ON, Path: "/x/y/z", Event: EVENT_TYPE_VALUE}, conn)
+	// The snapshot, then its ack
+	nextEvent()
+	nextEvent()
+	hub.write("/x", json.RawMessage(`{"y": {"z": 2}}`), nil)
+	if evt := nextEvent(); evt.Path != "/x/y/z" || evt.Data != 2.0 {
+		t.Error("Descendant was not sent its new value", evt)
+	}
+}
@@ -0,0 +1,263 @@
+package turbo
+
+import (
+	"github.com/gorilla/websocket"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Give up on the conn as soon as it falls behind; the client can resume its session and catch up
+	BACKPRESSURE_DISCONNECT = 0
+	// Make room by throwing away the oldest pending event
+	BACKPRESSURE_DROP_OLDEST = 1
+	// Wait for room, and give up on the conn if none turns up in time.
+	// Events are queued while the path locks are held, so one slow conn holds up writers for as long as it waits.
+	BACKPRESSURE_BLOCK = 2
+
+	OUTBOX_CAPACITY_DEFAULT = 256
+	OUTBOX_TIMEOUT_DEFAULT  = 5 * time.Second
+	// Clients closed for being too slow may reconnect and resume
+	OUTBOX_CLOSE_CODE_DEFAULT = websocket.CloseTryAgainLater
+)
+
+// How a conn that can't keep up with its messages is dealt with
+type BackpressureConfig struct {
+	Policy   int
+	Capacity int
+	// How long BACKPRESSURE_BLOCK waits for room
+	Timeout time.Duration
+	// The close code sent to conns that are given up on
+	CloseCode int
+}
+
+// Counts across every conn, updated atomically
+type BackpressureStats struct {
+	Dropped      uint64 `json:"dropped"`
+	Coalesced    uint64 `json:"coalesced"`
+	Disconnected uint64 `json:"disconnected"`
+}
+
+// Messages waiting to be written to a conn.
+// A value event replaces any unsent one for the same path, since only the latest value matters.
+type Outbox struct {
+	items []*outboxItem
+	// The pending value event for each path
+	values   map[string]*outboxItem
+	closed   bool
+	overflow func()
+	// Has the last say on value events as they are written
+	encode func(valuePath string, payload []byte) []byte
+	config BackpressureConfig
+	stats  *BackpressureStats
+	lock   sync.Mutex
+	// Signalled when items are added, and when room is made
+	ready chan bool
+	room  chan bool
+}
+
+type outboxItem struct {
+	payload []byte
+	// Events can be dropped to make room, acks can't
+	event bool
+	// Set on value events, which a newer value event for the same path supersedes
+	valuePath string
+}
+
+func newOutbox(config BackpressureConfig, stats *BackpressureStats) *Outbox {
+	if config.Capacity == 0 {
+		config.Capacity = OUTBOX_CAPACITY_DEFAULT
+	}
+	if config.Timeout == 0 {
+		config.Timeout = OUTBOX_TIMEOUT_DEFAULT
+	}
+	if config.CloseCode == 0 {
+		config.CloseCode = OUTBOX_CLOSE_CODE_DEFAULT
+	}
+	if stats == nil {
+		stats = &BackpressureStats{}
+	}
+	return &Outbox{
+		config: config,
+		stats:  stats,
+		values: make(map[string]*outboxItem),
+		ready:  make(chan bool, 1),
+		room:   make(chan bool, 1),
+	}
+}
+
+// Queues an ack, or anything else that must not be dropped
+func (outbox *Outbox) push(payload []byte) bool {
+	return outbox.enqueue(&outboxItem{payload: payload})
+}
+
+// Queues an event; valuePath is set for value events
+func (outbox *Outbox) pushEvent(payload []byte, valuePath string) bool {
+	return outbox.enqueue(&outboxItem{payload: payload, event: true, valuePath: valuePath})
+}
+
+// Adds item once there is room for it, as the policy sees fit.
+// Every policy coalesces value events first, since a value that replaces a pending one needs no room.
+// Returns false if it was not queued.
+func (outbox *Outbox) enqueue(item *outboxItem) bool {
+	var deadline <-chan time.Time
+	outbox.lock.Lock()
+	for !outbox.closed && !outbox.fits(item) && !outbox.makeRoom() {
+		if outbox.config.Policy != BACKPRESSURE_BLOCK {
+			outbox.lock.Unlock()
+			outbox.giveUp()
+			return false
+		}
+		if deadline == nil {
+			deadline = time.After(outbox.config.Timeout)
+		}
+		outbox.lock.Unlock()
+		select {
+		case <-outbox.room:
+		case <-deadline:
+			outbox.giveUp()
+			return false
+		}
+		outbox.lock.Lock()
+	}
+	defer outbox.lock.Unlock()
+	if outbox.closed {
+		return false
+	}
+	// Only now that item is sure to be queued can the value it supersedes go
+	outbox.coalesce(item)
+	outbox.items = append(outbox.items, item)
+	if item.valuePath != "" {
+		outbox.values[item.valuePath] = item
+	}
+	signal(outbox.ready)
+	return true
+}
+
+// Whether item can be queued without going over capacity; the caller must hold the lock
+func (outbox *Outbox) fits(item *outboxItem) bool {
+	pending := len(outbox.items)
+	if item.valuePath != "" && outbox.values[item.valuePath] != nil {
+		// It takes the place of the one it supersedes
+		pending--
+	}
+	return pending < outbox.config.Capacity
+}
+
+// Takes out the pending value event item supersedes; the caller must hold the lock.
+// item goes to the back of the queue, so it can't overtake anything sent before it.
+func (outbox *Outbox) coalesce(item *outboxItem) {
+	superseded := outbox.values[item.valuePath]
+	if item.valuePath == "" || superseded == nil {
+		return
+	}
+	delete(outbox.values, item.valuePath)
+	outbox.remove(superseded)
+	atomic.AddUint64(&outbox.stats.Coalesced, 1)
+}
+
+// The caller must hold the lock
+func (outbox *Outbox) remove(item *outboxItem) {
+	for i, pending := range outbox.items {
+		if pending == item {
+			outbox.items = append(outbox.items[:i], outbox.items[i+1:]...)
+			break
+		}
+	}
+	if item.valuePath != "" && outbox.values[item.valuePath] == item {
+		delete(outbox.values, item.valuePath)
+	}
+}
+
+// Frees up space if the policy allows it; the caller must hold the lock
+func (outbox *Outbox) makeRoom() bool {
+	switch outbox.config.Policy {
+	case BACKPRESSURE_DROP_OLDEST:
+		for _, pending := range outbox.items {
+			if pending.event {
+				outbox.remove(pending)
+				atomic.AddUint64(&outbox.stats.Dropped, 1)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Hands the conn over to overflow, which will close it
+func (outbox *Outbox) giveUp() {
+	outbox.lock.Lock()
+	overflow := outbox.overflow
+	outbox.overflow = nil
+	outbox.lock.Unlock()
+	if overflow != nil {
+		atomic.AddUint64(&outbox.stats.Disconnected, 1)
+		go overflow()
+	}
+}
+
+// Waits for the next message; false once the outbox is closed
+func (outbox *Outbox) pop() ([]byte, bool) {
+	for {
+		outbox.lock.Lock()
+		if len(outbox.items) > 0 {
+			item := outbox.items[0]
+			outbox.items[0] = nil
+			outbox.items = outbox.items[1:]
+			if item.valuePath != "" && outbox.values[item.valuePath] == item {
+				delete(outbox.values, item.valuePath)
+			}
+			signal(outbox.room)
+			encode := outbox.encode
+			outbox.lock.Unlock()
+			if encode != nil && item.valuePath != "" {
+				return encode(item.valuePath, item.payload), true
+			}
+			return item.payload, true
+		}
+		closed := outbox.closed
+		outbox.lock.Unlock()
+		if closed {
+			return nil, false
+		}
+		<-outbox.ready
+	}
+}
+
+// Drops whatever is pending and wakes everyone waiting on the outbox
+func (outbox *Outbox) close() {
+	outbox.lock.Lock()
+	defer outbox.lock.Unlock()
+	if outbox.closed {
+		return
+	}
+	outbox.closed = true
+	outbox.items = nil
+	outbox.values = nil
+	close(outbox.ready)
+	close(outbox.room)
+}
+
+// How many msgs are waiting to be written
+func (outbox *Outbox) depth() int {
+	outbox.lock.Lock()
+	defer outbox.lock.Unlock()
+	return len(outbox.items)
+}
+
+// Non-blocking send on a channel used as a wake-up flag
+func signal(flag chan bool) {
+	select {
+	case flag <- true:
+	default:
+	}
+}
+
+func (stats *BackpressureStats) snapshot() BackpressureStats {
+	return BackpressureStats{
+		Dropped:      atomic.LoadUint64(&stats.Dropped),
+		Coalesced:    atomic.LoadUint64(&stats.Coalesced),
+		Disconnected: atomic.LoadUint64(&stats.Disconnected),
+	}
+}
@@ -0,0 +1,132 @@
+package turbo
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOutboxPolicies(t *testing.T) {
+	full := func(policy int) (*Outbox, *BackpressureStats, chan bool) {
+		stats := &BackpressureStats{}
+		outbox := newOutbox(BackpressureConfig{Policy: policy, Capacity: 3, Timeout: 10 * time.Millisecond}, stats)
+		gaveUp := make(chan bool, 1)
+		outbox.overflow = func() { gaveUp <- true }
+		outbox.push([]byte("ack"))
+		outbox.pushEvent([]byte("a1"), "/a")
+		outbox.pushEvent([]byte("b1"), "/b")
+		return outbox, stats, gaveUp
+	}
+	drain := func(outbox *Outbox) []string {
+		var payloads []string
+		for msg := tryPop(outbox); msg != nil; msg = tryPop(outbox) {
+			payloads = append(payloads, string(msg))
+		}
+		return payloads
+	}
+	expect := func(policy string, actual []string, expected ...string) {
+		if len(actual) != len(expected) {
+			t.Error(policy, "left", actual, "instead of", expected)
+			return
+		}
+		for i := range expected {
+			if actual[i] != expected[i] {
+				t.Error(policy, "left", actual, "instead of", expected)
+				return
+			}
+		}
+	}
+
+	// Dropping oldest spares the ack
+	outbox, stats, _ := full(BACKPRESSURE_DROP_OLDEST)
+	outbox.pushEvent([]byte("c1"), "")
+	expect("Drop oldest", drain(outbox), "ack", "b1", "c1")
+	if stats.snapshot().Dropped != 1 {
+		t.Error("Drop was not counted", stats.snapshot())
+	}
+
+	// Under any policy, a value that supersedes a pending one takes its place rather than needing room
+	outbox, stats, gaveUp := full(BACKPRESSURE_DISCONNECT)
+	if !outbox.pushEvent([]byte("a2"), "/a") {
+		t.Error("Coalesced value was not queued")
+	}
+	expect("Coalesce", drain(outbox), "ack", "b1", "a2")
+	if stats.snapshot().Coalesced != 1 || stats.snapshot().Disconnected != 0 {
+		t.Error("Coalesce was not counted, or gave up on the conn", stats.snapshot())
+	}
+
+	// Blocking waits for the writer to make room
+	outbox, _, gaveUp = full(BACKPRESSURE_BLOCK)
+	go func() {
+		time.Sleep(time.Millisecond)
+		outbox.pop()
+	}()
+	if !outbox.pushEvent([]byte("c1"), "") {
+		t.Error("Block did not wait for room")
+	}
+	// ...but only for so long
+	if outbox.pushEvent([]byte("d1"), "") {
+		t.Error("Block queued past its capacity")
+	}
+	select {
+	case <-gaveUp:
+	case <-time.After(time.Second):
+		t.Error("Block never gave up on the conn")
+	}
+
+	// Disconnecting gives up straight away, and only once
+	outbox, stats, gaveUp = full(BACKPRESSURE_DISCONNECT)
+	outbox.pushEvent([]byte("c1"), "")
+	outbox.pushEvent([]byte("d1"), "")
+	<-gaveUp
+	if stats.snapshot().Disconnected != 1 {
+		t.Error("Disconnect was not counted once", stats.snapshot())
+	}
+	outbox.close()
+	if outbox.push([]byte("ack")) {
+		t.Error("Closed outbox took a message")
+	}
+	if _, open := outbox.pop(); open {
+		t.Error("Closed outbox is still open")
+	}
+}
+
+func TestOutboxCoalesce(t *testing.T) {
+	outbox := newOutbox(BackpressureConfig{}, nil)
+	outbox.pushEvent([]byte("a1"), "/a")
+	outbox.pushEvent([]byte("child1"), "")
+	outbox.push([]byte("ack1"))
+	outbox.pushEvent([]byte("b1"), "/b")
+	outbox.pushEvent([]byte("a2"), "/a")
+	outbox.pushEvent([]byte("a3"), "/a")
+
+	// Only the latest value for /a is left, after everything sent before it
+	expected := []string{"child1", "ack1", "b1", "a3"}
+	for _, payload := range expected {
+		if msg := tryPop(outbox); string(msg) != payload {
+			t.Error("Expected", payload, "but got", string(msg))
+		}
+	}
+	if msg := tryPop(outbox); msg != nil {
+		t.Error("Superseded value was sent", string(msg))
+	}
+	if outbox.stats.snapshot().Coalesced != 2 {
+		t.Error("Coalesced values were not counted", outbox.stats.snapshot())
+	}
+
+	// Once a value has been sent, the next one is queued as normal
+	outbox.pushEvent([]byte("a4"), "/a")
+	if msg := tryPop(outbox); string(msg) != "a4" {
+		t.Error("Value after a sent one went missing", string(msg))
+	}
+}
+
+func TestOutboxDefaultPolicy(t *testing.T) {
+	// Publishers hold path locks, so by default nothing waits on a slow conn
+	outbox := newOutbox(BackpressureConfig{Capacity: 1, Timeout: time.Minute}, nil)
+	outbox.overflow = func() {}
+	outbox.pushEvent([]byte("a1"), "")
+	start := time.Now()
+	if outbox.pushEvent([]byte("b1"), "") || time.Since(start) > time.Second {
+		t.Error("Full outbox waited for room by default")
+	}
+}
@@ -0,0 +1,270 @@
+package turbo
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// Characters keys can't hold as they are, since storage and rules give them meaning
+	PATH_RESERVED_CHARS = ".#$[]"
+	// Starts a percent escape, as in %2E for a dot
+	PATH_ESCAPE = '%'
+	// The one key allowed to break the rules, and only at the top
+	PATH_INFO_KEY = ".info"
+
+	PATH_HEX_DIGITS = "0123456789ABCDEF"
+)
+
+// A path in canonical form: "/" for the root, otherwise each key preceded by a slash.
+// Keys are non-empty, valid utf-8, free of control and reserved characters, and only use % to escape.
+// Anything a client sends goes through ParsePath before the hub will act on it.
+type Path string
+
+const ROOT_PATH Path = SLASH
+
+// Checks raw against the path grammar, returning it as a Path if it passes
+func ParsePath(raw string) (Path, *Error) {
+	if raw == "" {
+		return "", NewError(MSG_ERR_INVALID_DATA, "Paths can't be empty")
+	}
+	if raw[0] != SLASH[0] {
+		return "", NewError(MSG_ERR_INVALID_DATA, "Paths must start with '/'")
+	}
+	if raw == SLASH {
+		return ROOT_PATH, nil
+	}
+	for i, key := range strings.Split(raw[1:], SLASH) {
+		if i == 0 && key == PATH_INFO_KEY {
+			continue
+		}
+		if problem := checkKey(key); problem != "" {
+			return "", NewError(MSG_ERR_INVALID_DATA, "Bad key #"+strconv.Itoa(i)+" in '"+raw+"': "+problem)
+		}
+	}
+	return Path(raw), nil
+}
+
+// Why key can't be used as it is, or "" if it can
+func checkKey(key string) string {
+	if key == "" {
+		return "Keys can't be empty"
+	}
+	if !utf8.ValidString(key) {
+		return "Keys must be valid utf-8"
+	}
+	for i := 0; i < len(key); i++ {
+		char := key[i]
+		switch {
+		case char < 0x20 || char == 0x7f:
+			return "Keys can't contain control characters"
+		case char == SLASH[0]:
+			return "Keys can't contain '/'; escape it as %2F"
+		case strings.IndexByte(PATH_RESERVED_CHARS, char) >= 0:
+			return "Keys can't contain '" + string(char) + "'; escape it as %" + hexByte(char)
+		case char == PATH_ESCAPE:
+			if i+2 >= len(key) || !isHex(key[i+1]) || !isHex(key[i+2]) {
+				return "'%' must start an escape like %2E"
+			}
+		}
+	}
+	return ""
+}
+
+// Percent escapes whatever would stop key from being a valid key; the empty key can't be escaped
+func EscapeKey(key string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(key); i++ {
+		char := key[i]
+		if char < 0x20 || char == 0x7f || char == PATH_ESCAPE || char == SLASH[0] || strings.IndexByte(PATH_RESERVED_CHARS, char) >= 0 {
+			escaped.WriteByte(PATH_ESCAPE)
+			escaped.WriteString(hexByte(char))
+		} else {
+			escaped.WriteByte(char)
+		}
+	}
+	return escaped.String()
+}
+
+// Undoes EscapeKey
+func UnescapeKey(key string) (string, error) {
+	var unescaped strings.Builder
+	for i := 0; i < len(key); i++ {
+		if key[i] != PATH_ESCAPE {
+			unescaped.WriteByte(key[i])
+			continue
+		}
+		if i+2 >= len(key) || !isHex(key[i+1]) || !isHex(key[i+2]) {
+			return "", NewError(MSG_ERR_INVALID_DATA, "Bad escape in '"+key+"'")
+		}
+		value, _ := strconv.ParseUint(key[i+1:i+3], 16, 8)
+		unescaped.WriteByte(byte(value))
+		i += 2
+	}
+	return unescaped.String(), nil
+}
+
+func hexByte(char byte) string {
+	return string([]byte{PATH_HEX_DIGITS[char>>4], PATH_HEX_DIGITS[char&0xf]})
+}
+
+func isHex(char byte) bool {
+	return (char >= '0' && char <= '9') || (char >= 'a' && char <= 'f') || (char >= 'A' && char <= 'F')
+}
+
+// Every key in the object keys of value that breaks the grammar, by the path it would land at
+func checkDataKeys(path Path, value interface{}) []*ErrorDetail {
+	var problems []*ErrorDetail
+	switch value.(type) {
+	case map[string]interface{}:
+		for key, child := range value.(map[string]interface{}) {
+			if problem := checkKey(key); problem != "" {
+				problems = append(problems, &ErrorDetail{Path: string(path.child(EscapeKey(key))), Message: problem})
+				continue
+			}
+			problems = append(problems, checkDataKeys(path.child(key), child)...)
+		}
+	case []interface{}:
+		for i, child := range value.([]interface{}) {
+			problems = append(problems, checkDataKeys(path.child(strconv.Itoa(i)), child)...)
+		}
+	}
+	return problems
+}
+
+// The keys along path, empty for the root
+func (path Path) keys() []string {
+	return splitKeys(string(path))
+}
+
+// The non-empty keys of a slash separated string, such as a schema pattern or a relative path
+func splitKeys(raw string) []string {
+	segments := strings.Split(raw, SLASH)
+	keys := segments[:0]
+	for _, segment := range segments {
+		if segment != "" {
+			keys = append(keys, segment)
+		}
+	}
+	return keys
+}
+
+func (path Path) child(key string) Path {
+	if path == ROOT_PATH {
+		return Path(SLASH + key)
+	}
+	return path + Path(SLASH+key)
+}
+
+// Follows the slash separated keys of relative down from path
+func (path Path) join(relative string) Path {
+	for _, key := range splitKeys(relative) {
+		path = path.child(key)
+	}
+	return path
+}
+
+// The path above this one, if this isn't the root
+func (path Path) parent() (Path, bool) {
+	if path == ROOT_PATH {
+		return path, false
+	}
+	index := strings.LastIndex(string(path), SLASH)
+	if index <= 0 {
+		return ROOT_PATH, true
+	}
+	return path[:index], true
+}
+
+// Whether path is base or lies beneath it
+func (path Path) within(base Path) bool {
+	return path == base || base == ROOT_PATH || strings.HasPrefix(string(path), string(base)+SLASH)
+}
+
+// Calls iterator with path (unless parentsOnly), then with each of its parents up to the root
+func (path Path) cascade(parentsOnly bool, iterator func(Path)) {
+	if !parentsOnly {
+		iterator(path)
+	}
+	parentPath, hasParent := path.parent()
+	for hasParent {
+		iterator(parentPath)
+		parentPath, hasParent = parentPath.parent()
+	}
+}
+
+// Whether cmd is aimed at a path; auth and unknown cmds aren't
+func takesPath(cmd byte) bool {
+	switch cmd {
+	case MSG_CMD_ON, MSG_CMD_OFF, MSG_CMD_SET, MSG_CMD_UPDATE, MSG_CMD_REMOVE, MSG_CMD_TRANS_SET, MSG_CMD_PUSH,
+		MSG_CMD_TRANS_GET, MSG_CMD_GET, MSG_CMD_ON_DISCONNECT_SET, MSG_CMD_ON_DISCONNECT_UPDATE,
+		MSG_CMD_ON_DISCONNECT_REMOVE, MSG_CMD_ON_DISCONNECT_CANCEL, MSG_CMD_CHMOD, MSG_CMD_CHOWN, MSG_CMD_PATCH:
+		return true
+	}
+	return false
+}
+
+// Checks every path msg carries, along with the keys of its data, before the hub acts on any of them
+func checkPaths(msg *Msg) *Error {
+	path, err := ParsePath(string(msg.Path))
+	if err != nil {
+		return err
+	}
+	msg.Path = path
+
+	var problems []*ErrorDetail
+	if len(msg.DataMap) > 0 {
+		properties := make(map[string]json.RawMessage)
+		if json.Unmarshal(msg.DataMap, &properties) == nil {
+			for property, value := range properties {
+				propertyPath, err := ParsePath(strings.TrimSuffix(string(path), SLASH) + SLASH + property)
+				if err != nil || isInfoPath(propertyPath) != isInfoPath(path) {
+					problems = append(problems, &ErrorDetail{Path: property, Message: "Not a valid relative path"})
+					continue
+				}
+				problems = append(problems, rawDataKeys(propertyPath, value)...)
+			}
+		}
+	}
+	problems = append(problems, rawDataKeys(path, msg.Data)...)
+	for i, op := range msg.Ops {
+		// Whatever a pointer names may become a key; malformed pointers are left for applyPatch to refuse
+		pointers := []string{op.Path}
+		if op.Op == PATCH_OP_MOVE || op.Op == PATCH_OP_COPY {
+			pointers = append(pointers, op.From)
+		}
+		for _, pointer := range pointers {
+			tokens, _ := parsePointer(pointer)
+			for _, token := range tokens {
+				if problem := checkKey(token); problem != "" {
+					problems = append(problems, &ErrorDetail{Path: pointer, Message: "Op #" + strconv.Itoa(i) + ": " + problem})
+				}
+			}
+		}
+		target := path
+		tokens, _ := parsePointer(op.Path)
+		for _, token := range tokens {
+			target = target.child(token)
+		}
+		problems = append(problems, rawDataKeys(target, op.Value)...)
+	}
+	if len(problems) > 0 {
+		return &Error{Code: MSG_ERR_INVALID_DATA, Message: "Data has keys that are not valid", Details: problems}
+	}
+	return nil
+}
+
+// checkDataKeys for data that hasn't been unmarshalled; data that isn't json is left for the handler to refuse
+func rawDataKeys(path Path, data json.RawMessage) []*ErrorDetail {
+	// Only objects have keys
+	if len(data) == 0 || !strings.ContainsRune(string(data), '{') {
+		return nil
+	}
+	var value interface{}
+	if json.Unmarshal(data, &value) != nil {
+		return nil
+	}
+	return checkDataKeys(path, value)
+}
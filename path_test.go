@@ -0,0 +1,128 @@
+package turbo
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParsePath(t *testing.T) {
+	valid := []string{"/", "/a", "/a/b/c", "/.info/connected", "/users/bob%2Esmith", "/ünïcödé", "/-Kx_9"}
+	for _, raw := range valid {
+		if path, err := ParsePath(raw); err != nil || string(path) != raw {
+			t.Error("Valid path", raw, "was refused", err)
+		}
+	}
+	invalid := []string{"", "a/b", "/a/", "//a", "/a//b", "/a.b", "/a#", "/$a", "/a[0]", "/a]", "/a\x00b", "/a\nb", "/a%", "/a%2", "/a%zz", "/x/.info", "/\xff"}
+	for _, raw := range invalid {
+		if _, err := ParsePath(raw); err == nil || err.Code != MSG_ERR_INVALID_DATA {
+			t.Errorf("Invalid path %q was let through", raw)
+		}
+	}
+}
+
+func TestEscapeKey(t *testing.T) {
+	keys := map[string]string{
+		"plain":       "plain",
+		"bob.smith":   "bob%2Esmith",
+		"#$[]":        "%23%24%5B%5D",
+		"50%/2":       "50%25%2F2",
+		"tab\there":   "tab%09here",
+		"ünïcödé.org": "ünïcödé%2Eorg",
+	}
+	for key, expected := range keys {
+		escaped := EscapeKey(key)
+		if escaped != expected {
+			t.Error("Key", key, "escaped to", escaped)
+		}
+		if problem := checkKey(escaped); problem != "" {
+			t.Error("Escaped key", escaped, "is not valid:", problem)
+		}
+		if unescaped, err := UnescapeKey(escaped); err != nil || unescaped != key {
+			t.Error("Key", escaped, "unescaped to", unescaped, err)
+		}
+	}
+	if _, err := UnescapeKey("bad%2"); err == nil {
+		t.Error("Truncated escape was unescaped")
+	}
+}
+
+func TestPathHelpers(t *testing.T) {
+	if path := ROOT_PATH.join("/dfdf/dsfsdf/ds"); path != "/dfdf/dsfsdf/ds" {
+		t.Error("Joining onto the root failed", path)
+	}
+	if path := Path("/234/45").join("dfdf//dsfsdf/ds/"); path != "/234/45/dfdf/dsfsdf/ds" {
+		t.Error("Joining stray slashes failed", path)
+	}
+	if parent, hasParent := Path("/a/b").parent(); !hasParent || parent != "/a" {
+		t.Error("Wrong parent", parent)
+	}
+	if parent, hasParent := Path("/a").parent(); !hasParent || parent != ROOT_PATH {
+		t.Error("Top level path should be under the root", parent)
+	}
+	if _, hasParent := ROOT_PATH.parent(); hasParent {
+		t.Error("The root has no parent")
+	}
+	if !Path("/a/b").within("/a") || Path("/ab").within("/a") || !Path("/a").within(ROOT_PATH) {
+		t.Error("Paths were placed wrongly")
+	}
+	var visited []Path
+	Path("/a/b").cascade(false, func(path Path) {
+		visited = append(visited, path)
+	})
+	if len(visited) != 3 || visited[0] != "/a/b" || visited[2] != ROOT_PATH {
+		t.Error("Wrong cascade", visited)
+	}
+}
+
+func TestBadPathsRefused(t *testing.T) {
+	db := newTestDb(t)
+	hub := NewMsgHub(NewMsgBus(), db, nil)
+	go hub.listen()
+	conn := newTestConn(hub, 1)
+	hub.registerConn(conn)
+
+	cases := []*Msg{
+		{Cmd: MSG_CMD_SET, Path: "", Data: json.RawMessage(`1`)},
+		{Cmd: MSG_CMD_SET, Path: "/a.b", Data: json.RawMessage(`1`)},
+		{Cmd: MSG_CMD_ON, Path: "/a//b", Event: EVENT_TYPE_VALUE},
+		{Cmd: MSG_CMD_SET, Path: "/a", Data: json.RawMessage(`{"ok": {"not.ok": 1}}`)},
+		{Cmd: MSG_CMD_PUSH, Path: "/a", Data: json.RawMessage(`[{"$ref": 1}]`)},
+		{Cmd: MSG_CMD_UPDATE, Path: "/a", DataMap: json.RawMessage(`{"b": 1, "c[0]": 2}`)},
+		{Cmd: MSG_CMD_UPDATE, Path: "/", DataMap: json.RawMessage(`{".info/connected": false}`)},
+		{Cmd: MSG_CMD_PATCH, Path: "/a", Ops: []*PatchOp{{Op: PATCH_OP_ADD, Path: "/b#c", Value: json.RawMessage(`1`)}}},
+		{Cmd: MSG_CMD_PATCH, Path: "/a", Ops: []*PatchOp{{Op: PATCH_OP_ADD, Path: "/b~1c", Value: json.RawMessage(`1`)}}},
+		{Cmd: MSG_CMD_PATCH, Path: "/a", Ops: []*PatchOp{{Op: PATCH_OP_COPY, From: "/b.c", Path: "/d"}}},
+	}
+	for i, msg := range cases {
+		msg.Ack = i
+		hub.dispatch(msg, conn)
+		ack := Ack{}
+		json.Unmarshal(nextPayload(conn.outbox), &ack)
+		if ack.Ack != i || ackCode(ack) != MSG_ERR_INVALID_DATA {
+			t.Error("Bad path in msg", i, "was not refused", ack.Error)
+		}
+	}
+	if conn.subscriptionCount() != 0 {
+		t.Error("Bad path reached the bus")
+	}
+	if _, value, _ := db.get("/a"); value != nil {
+		t.Error("Bad path reached the db", value)
+	}
+
+	// Details point at the keys an op's pointer decodes to
+	err := checkPaths(&Msg{Cmd: MSG_CMD_PATCH, Path: "/a", Ops: []*PatchOp{{Op: PATCH_OP_ADD, Path: "/b~0c", Value: json.RawMessage(`{"d.e": 1}`)}}})
+	if err == nil || len(err.Details) != 1 || err.Details[0].Path != "/a/b~c/d%2Ee" {
+		t.Error("Op value was checked at the wrong path", err)
+	}
+
+	// Escaped keys are just keys
+	hub.dispatch(&Msg{Cmd: MSG_CMD_SET, Path: Path("/users").child(EscapeKey("bob.smith")), Data: json.RawMessage(`{"site": "bob.example.com"}`), Ack: len(cases)}, conn)
+	ack := Ack{}
+	json.Unmarshal(nextPayload(conn.outbox), &ack)
+	if ack.Error != nil {
+		t.Error("Escaped key was refused", ack.Error)
+	}
+	if _, value, _ := db.get("/users/bob%2Esmith/site"); value != "bob.example.com" {
+		t.Error("Escaped key was not written", value)
+	}
+}
@@ -1,123 +1,128 @@
 package turbo
 
-import (
-	"strings"
-)
-
+// A trie of path segments. Paths that are put are linked to their nearest put ancestor and descendants,
+// so the tree can be walked without visiting the segments in between.
 type PathTree struct {
-	refs map[string]*PathTreeNode
+	// Put nodes by path
+	refs map[Path]*PathTreeNode
+	root *PathTreeNode
 }
 
 func NewPathTree() *PathTree {
 	tree := PathTree{
-		refs: make(map[string]*PathTreeNode),
+		refs: make(map[Path]*PathTreeNode),
 	}
 	return &tree
 }
 
 type PathTreeNode struct {
-	tree     *PathTree
+	tree *PathTree
+	// The nearest put ancestor, and the nearest put descendants
 	parent   *PathTreeNode
 	children map[*PathTreeNode]bool
-	path     string
+	path     Path
 	depth    int
+	// Subscriptions keeping this node in the tree
+	refs int
+	// Whether this node was put, rather than only being on the way to one that was
+	put bool
+	// The trie itself, one node per segment
+	segment string
+	up      *PathTreeNode
+	down    map[string]*PathTreeNode
 }
 
-func (tree *PathTree) path(path string) string {
-	return "/" + strings.Trim(path, "/")
+// path with any stray slashes tidied away
+func (tree *PathTree) path(path Path) Path {
+	return ROOT_PATH.join(string(path))
 }
 
-func (tree *PathTree) get(path string) *PathTreeNode {
-	if tree.refs[path] == nil {
-		return nil
-	} else {
-		return tree.refs[path]
+// The root is always put, and is created on first use
+func (tree *PathTree) rootNode() *PathTreeNode {
+	if tree.root == nil {
+		tree.root = &PathTreeNode{
+			tree:     tree,
+			children: make(map[*PathTreeNode]bool),
+			path:     ROOT_PATH,
+			put:      true,
+			down:     make(map[string]*PathTreeNode),
+		}
+		tree.refs[ROOT_PATH] = tree.root
 	}
+	return tree.root
 }
 
-func (tree *PathTree) put(path string) *PathTreeNode {
-	path = tree.path(path)
-	// First check if this path represents a node already
-	if tree.refs[path] != nil {
-		return tree.refs[path]
+// Follows path down the trie, making the missing segments if create is set
+func (tree *PathTree) walk(path Path, create bool) *PathTreeNode {
+	node := tree.rootNode()
+	for _, segment := range path.keys() {
+		next := node.down[segment]
+		if next == nil {
+			if !create {
+				return nil
+			}
+			next = &PathTreeNode{
+				tree:     tree,
+				children: make(map[*PathTreeNode]bool),
+				path:     node.path.child(segment),
+				depth:    node.depth + 1,
+				segment:  segment,
+				up:       node,
+				down:     make(map[string]*PathTreeNode),
+			}
+			node.down[segment] = next
+		}
+		node = next
 	}
+	return node
+}
 
-	node := PathTreeNode{
-		tree:     tree,
-		parent:   nil,
-		children: make(map[*PathTreeNode]bool),
-		path:     path,
-		depth:    strings.Count(path, "/"),
-	}
-	tree.refs[path] = &node
-	// Check relationship with the heads
-	parent := tree.parent(path)
-	if parent == nil {
-		parent = &PathTreeNode{
-			parent:   nil,
-			children: make(map[*PathTreeNode]bool),
-			path:     "/",
-			depth:    0,
-		}
-		tree.refs["/"] = parent
+func (tree *PathTree) get(path Path) *PathTreeNode {
+	return tree.refs[tree.path(path)]
+}
+
+func (tree *PathTree) put(path Path) *PathTreeNode {
+	node := tree.walk(path, true)
+	if node.put {
+		return node
 	}
+	node.put = true
+	tree.refs[node.path] = node
 
+	parent := node.nearestAncestor()
 	node.parent = parent
-	// Check if new parent has any of the new node's children
-	for child, _ := range parent.children {
-		if child != nil {
-			if child.depth >= (node.depth + 1) {
-				// Potential child of new node
-				if strings.Index(child.path, node.path) == 0 {
-					// Child should have this node as a parent
-					delete(parent.children, child)
-					child.parent = &node
-					node.children[child] = true
-				}
-			}
-		}
+	// Take over the put nodes beneath this one from the old parent
+	for _, child := range node.nearestDescendants() {
+		delete(parent.children, child)
+		child.parent = node
+		node.children[child] = true
 	}
-	parent.children[&node] = true
+	parent.children[node] = true
 
-	return &node
+	return node
 }
 
-func (tree *PathTree) parent(path string) *PathTreeNode {
-	path = tree.path(path)
-	// First check if this path represents a node already
-	node := tree.refs[path]
-	if node != nil && node.parent != nil {
-		return node.parent
-	}
-	// Check if its the root path
-	if path == "/" {
+// The nearest put node above path; nil for the root
+func (tree *PathTree) parent(path Path) *PathTreeNode {
+	segments := path.keys()
+	if len(segments) == 0 {
 		return nil
 	}
-	// Establish depth to loop
-	depth := strings.Count(path, "/")
-	// Recursively check every parent path
-	for i := 0; i < depth; i++ {
-		index := strings.LastIndex(path, "/")
-		if index != -1 {
-			path = path[:index]
-			// Mitigate against surface level paths
-			if len(path) == 0 {
-				path = "/"
-			}
-			// Return the parent if it exists
-			if tree.refs[path] != nil {
-				return tree.refs[path]
-			}
-		} else {
-			return nil
+	node := tree.rootNode()
+	nearest := node
+	for _, segment := range segments[:len(segments)-1] {
+		if node = node.down[segment]; node == nil {
+			break
+		}
+		if node.put {
+			nearest = node
 		}
 	}
-
-	return nil
+	return nearest
 }
 
-func (tree *PathTree) children(path string) *map[*PathTreeNode]bool {
-	node := tree.refs[path]
+func (tree *PathTree) children(path Path) *map[*PathTreeNode]bool {
+	node := tree.get(path)
 
 	if node == nil {
 		return nil
@@ -128,6 +133,63 @@ func (tree *PathTree) children(path string) *map[*PathTreeNode]bool {
 	}
 }
 
+// Every put node above path, nearest first
+func (tree *PathTree) ancestors(path Path) []*PathTreeNode {
+	segments := path.keys()
+	found := make([]*PathTreeNode, 0, len(segments))
+	node := tree.rootNode()
+	for i := 0; i < len(segments); i++ {
+		if node.put {
+			found = append(found, node)
+		}
+		if node = node.down[segments[i]]; node == nil {
+			break
+		}
+	}
+	// Nearest first
+	for i, j := 0, len(found)-1; i < j; i, j = i+1, j-1 {
+		found[i], found[j] = found[j], found[i]
+	}
+	return found
+}
+
+// Every put node beneath path, deepest first; path itself needn't have been put
+func (tree *PathTree) descendants(path Path) []*PathTreeNode {
+	node := tree.walk(path, false)
+	if node == nil {
+		return nil
+	}
+	var found []*PathTreeNode
+	for _, child := range node.nearestDescendants() {
+		child.cascade(func(descendant *PathTreeNode) {
+			found = append(found, descendant)
+		})
+	}
+	return found
+}
+
+func (node *PathTreeNode) nearestAncestor() *PathTreeNode {
+	for above := node.up; above != nil; above = above.up {
+		if above.put {
+			return above
+		}
+	}
+	return nil
+}
+
+// The first put nodes on each branch beneath this one
+func (node *PathTreeNode) nearestDescendants() []*PathTreeNode {
+	var found []*PathTreeNode
+	for _, below := range node.down {
+		if below.put {
+			found = append(found, below)
+		} else {
+			found = append(found, below.nearestDescendants()...)
+		}
+	}
+	return found
+}
+
 func (node *PathTreeNode) remove() {
 	// Append children to parent
 	for nodeChild, _ := range node.children {
@@ -145,10 +207,15 @@ func (node *PathTreeNode) destroy() {
 	node.parent = nil
 	// Remove from refs
 	delete(node.tree.refs, node.path)
+	node.put = false
+	// Segments leading nowhere are pruned
+	for pruned := node; pruned.up != nil && !pruned.put && len(pruned.down) == 0; pruned = pruned.up {
+		delete(pruned.up.down, pruned.segment)
+	}
 }
 
 func (node *PathTreeNode) parentIsRoot() bool {
-	return node.parent.path == "/"
+	return node.parent.path == ROOT_PATH
 }
 
 func (node *PathTreeNode) cascade(iterator func(*PathTreeNode)) {
@@ -159,5 +226,5 @@ func (node *PathTreeNode) cascade(iterator func(*PathTreeNode)) {
 }
 
 func (node *PathTreeNode) hasImmediateParent() bool {
-	return strings.LastIndex(node.path, SLASH) == (len(node.parent.path) - 1)
+	return node.parent.depth == node.depth-1
 }
@@ -1,12 +1,14 @@
 package turbo
 
 import (
+	"sort"
+	"strings"
 	"testing"
 )
 
 func TestParent(t *testing.T) {
 	tree := &PathTree{
-		refs: make(map[string]*PathTreeNode),
+		refs: make(map[Path]*PathTreeNode),
 	}
 
 	tree.put("/a/b/c")
@@ -56,7 +58,7 @@ func TestParent(t *testing.T) {
 
 func TestChildren(t *testing.T) {
 	tree := &PathTree{
-		refs: make(map[string]*PathTreeNode),
+		refs: make(map[Path]*PathTreeNode),
 	}
 
 	tree.put("/a/b/c")
@@ -102,7 +104,7 @@ func TestChildren(t *testing.T) {
 
 func TestRemove(t *testing.T) {
 	tree := &PathTree{
-		refs: make(map[string]*PathTreeNode),
+		refs: make(map[Path]*PathTreeNode),
 	}
 
 	tree.put("/a/b/c")
@@ -117,9 +119,9 @@ func TestRemove(t *testing.T) {
 
 func TestCascade(t *testing.T) {
 	tree := &PathTree{
-		refs: make(map[string]*PathTreeNode),
+		refs: make(map[Path]*PathTreeNode),
 	}
-	paths := [...]string{
+	paths := [...]Path{
 		"/a/b",
 		"/a/b/c",
 		"/a/b/d",
@@ -153,3 +155,79 @@ func TestCascade(t *testing.T) {
 		t.Error("Explored did not match paths:", len(explored), "vs", len(paths))
 	}
 }
+
+func TestSiblingPrefixes(t *testing.T) {
+	tree := NewPathTree()
+	tree.put("/ab")
+	tree.put("/a/b")
+	tree.put("/a")
+
+	if parent := tree.parent("/ab"); parent == nil || parent.path != "/" {
+		t.Error("/ab was put under the wrong parent", parent)
+	}
+	children := tree.children("/a")
+	if children == nil || len(*children) != 1 || !(*children)[tree.get("/a/b")] {
+		t.Error("/a adopted the wrong children", children)
+	}
+}
+
+func TestRootAndSlashes(t *testing.T) {
+	tree := NewPathTree()
+	root := tree.put("/")
+	if root != tree.put("") || root.parent != nil || root.path != "/" {
+		t.Error("Root was not a single node")
+	}
+	node := tree.put("a//b/")
+	if node != tree.get("/a/b") || node.path != "/a/b" {
+		t.Error("Slashes were not normalised", node.path)
+	}
+	if node.parent != root || !node.parentIsRoot() {
+		t.Error("Node wasn't under the root")
+	}
+}
+
+func TestAncestorsAndDescendants(t *testing.T) {
+	tree := NewPathTree()
+	for _, path := range []Path{"/a", "/a/b/c", "/a/b/c/d", "/a/x", "/ab", "/a/b/c/d/e/f"} {
+		tree.put(path)
+	}
+	paths := func(nodes []*PathTreeNode) []string {
+		found := []string{}
+		for _, node := range nodes {
+			found = append(found, string(node.path))
+		}
+		return found
+	}
+
+	ancestors := paths(tree.ancestors("/a/b/c/d/e"))
+	if strings.Join(ancestors, " ") != "/a/b/c/d /a/b/c /a /" {
+		t.Error("Wrong ancestors", ancestors)
+	}
+	// Works for paths that were never put
+	descendants := paths(tree.descendants("/a/b"))
+	if strings.Join(descendants, " ") != "/a/b/c/d/e/f /a/b/c/d /a/b/c" {
+		t.Error("Wrong descendants, or not deepest first", descendants)
+	}
+	descendants = paths(tree.descendants("/a"))
+	sort.Strings(descendants)
+	if strings.Join(descendants, " ") != "/a/b/c /a/b/c/d /a/b/c/d/e/f /a/x" {
+		t.Error("Wrong descendants", descendants)
+	}
+	if len(tree.descendants("/nothing")) != 0 {
+		t.Error("Missing path had descendants")
+	}
+}
+
+func TestRemovePrunes(t *testing.T) {
+	tree := NewPathTree()
+	tree.put("/a/b")
+	tree.put("/a/b/c/d")
+	tree.get("/a/b").remove()
+	if tree.get("/a/b") != nil || tree.get("/a/b/c/d").parent != tree.get("/") {
+		t.Error("Removed node's child was not handed up")
+	}
+	tree.get("/a/b/c/d").remove()
+	if len(tree.root.down) != 0 || len(tree.refs) != 1 {
+		t.Error("Unused segments were left behind", tree.root.down, tree.refs)
+	}
+}
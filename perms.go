@@ -0,0 +1,165 @@
+package turbo
+
+import (
+	"log"
+	"strconv"
+)
+
+const (
+	// Unix style read/write bits for the owner, group and everyone else
+	PERM_OWNER_READ  = 0x20
+	PERM_OWNER_WRITE = 0x10
+	PERM_GROUP_READ  = 0x08
+	PERM_GROUP_WRITE = 0x04
+	PERM_OTHER_READ  = 0x02
+	PERM_OTHER_WRITE = 0x01
+	PERM_ALL         = 0x3F
+
+	// Nodes nobody has claimed are open to everyone
+	PERM_DEFAULT = PERM_ALL
+	// The owner and group of nodes nobody has claimed
+	PERM_NOBODY = 0
+)
+
+// The Owner, Group and Permissions columns of an Entry
+type NodePerms struct {
+	Owner       int64 `json:"owner"`
+	Group       int64 `json:"group"`
+	Permissions uint8 `json:"permissions"`
+}
+
+// Whether identity gets the read (or write) bit on these permissions
+func (perms *NodePerms) allows(identity *Identity, write bool) bool {
+	if identity.isAdmin() {
+		return true
+	}
+	var bit uint8
+	if uid, hasUid := identity.userId(); hasUid && perms.Owner != PERM_NOBODY && uid == perms.Owner {
+		bit = PERM_OWNER_READ
+	} else if perms.Group != PERM_NOBODY && identity.inGroup(perms.Group) {
+		bit = PERM_GROUP_READ
+	} else {
+		bit = PERM_OTHER_READ
+	}
+	// Each write bit sits just below its read bit
+	if write {
+		bit = bit >> 1
+	}
+	return perms.Permissions&bit != 0
+}
+
+// Only owners and admins may change permissions
+func (perms *NodePerms) administrableBy(identity *Identity) bool {
+	if identity.isAdmin() {
+		return true
+	}
+	uid, hasUid := identity.userId()
+	return hasUid && perms.Owner != PERM_NOBODY && uid == perms.Owner
+}
+
+// Node ownership needs a numeric uid
+func (identity *Identity) userId() (int64, bool) {
+	if identity == nil {
+		return 0, false
+	}
+	uid, err := strconv.ParseInt(identity.Uid, 10, 64)
+	return uid, err == nil
+}
+
+// Groups come from either a gid or a groups claim
+func (identity *Identity) inGroup(group int64) bool {
+	if identity == nil {
+		return false
+	}
+	if gid, isNumber := identity.Claims["gid"].(float64); isNumber && int64(gid) == group {
+		return true
+	}
+	groups, _ := identity.Claims["groups"].([]interface{})
+	for _, gid := range groups {
+		if gid, isNumber := gid.(float64); isNumber && int64(gid) == group {
+			return true
+		}
+	}
+	return false
+}
+
+func (identity *Identity) isAdmin() bool {
+	return identity != nil && identity.Claims["admin"] == true
+}
+
+// Reading or writing path reaches everything beneath it,
+// so nodes down there with permissions of their own must allow it too
+func (hub *MsgHub) hasPermission(conn *Conn, path Path, write bool) bool {
+	if isInfoPath(path) {
+		return !write
+	}
+	identity := conn.auth()
+	perms, err := hub.db.perms(path)
+	if err != nil {
+		log.Println("Couldn't fetch the permissions of", path, err)
+		return false
+	}
+	if !perms.allows(identity, write) {
+		return false
+	}
+	if identity.isAdmin() {
+		return true
+	}
+	beneath, err := hub.db.permsBeneath(path)
+	if err != nil {
+		log.Println("Couldn't fetch the permissions beneath", path, err)
+		return false
+	}
+	for _, perms := range beneath {
+		if !perms.allows(identity, write) {
+			return false
+		}
+	}
+	return true
+}
+
+func (hub *MsgHub) handleChmod(msg *Msg, conn *Conn) {
+	if msg.Permissions == nil {
+		hub.sendAck(conn, msg.Ack, NewError(MSG_ERR_INVALID_DATA, "Chmod requires permissions"), nil, 0)
+		return
+	}
+	hub.changePerms(msg, conn, func(perms *NodePerms) {
+		perms.Permissions = *msg.Permissions & PERM_ALL
+	})
+}
+
+func (hub *MsgHub) handleChown(msg *Msg, conn *Conn) {
+	hub.changePerms(msg, conn, func(perms *NodePerms) {
+		if msg.Owner != nil {
+			perms.Owner = *msg.Owner
+		}
+		if msg.Group != nil {
+			perms.Group = *msg.Group
+		}
+	})
+}
+
+func (hub *MsgHub) changePerms(msg *Msg, conn *Conn, change func(*NodePerms)) {
+	if isInfoPath(msg.Path) {
+		hub.sendAck(conn, msg.Ack, errInfoReadOnly, nil, 0)
+		return
+	}
+	hub.locker.lock(msg.Path)
+	defer hub.locker.unlock(msg.Path)
+
+	perms, err := hub.db.perms(msg.Path)
+	if err != nil {
+		hub.sendAck(conn, msg.Ack, asError(err), nil, 0)
+		return
+	}
+	if !perms.administrableBy(conn.auth()) {
+		hub.sendPermissionDenied(conn, msg)
+		return
+	}
+	change(perms)
+	if err := hub.db.setPerms(msg.Path, perms); err != nil {
+		hub.sendAck(conn, msg.Ack, asError(err), nil, 0)
+		return
+	}
+	hub.sendAck(conn, msg.Ack, nil, perms, 0)
+}
@@ -0,0 +1,100 @@
+package turbo
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestPermsAllows(t *testing.T) {
+	owner := &Identity{Uid: "10", Claims: map[string]interface{}{}}
+	member := &Identity{Uid: "11", Claims: map[string]interface{}{"groups": []interface{}{float64(5)}}}
+	stranger := &Identity{Uid: "12", Claims: map[string]interface{}{}}
+	admin := &Identity{Uid: "admin", Claims: map[string]interface{}{"admin": true}}
+	// rw-r-----
+	perms := &NodePerms{Owner: 10, Group: 5, Permissions: PERM_OWNER_READ | PERM_OWNER_WRITE | PERM_GROUP_READ}
+
+	cases := []struct {
+		identity *Identity
+		write    bool
+		allowed  bool
+	}{
+		{owner, false, true},
+		{owner, true, true},
+		{member, false, true},
+		{member, true, false},
+		{stranger, false, false},
+		{nil, false, false},
+		{admin, true, true},
+	}
+	for _, c := range cases {
+		if perms.allows(c.identity, c.write) != c.allowed {
+			t.Error("Wrong answer for", c.identity, "write:", c.write)
+		}
+	}
+
+	if !perms.administrableBy(owner) || !perms.administrableBy(admin) || perms.administrableBy(member) {
+		t.Error("Only the owner and admins should administer a node")
+	}
+	if (&NodePerms{Permissions: PERM_DEFAULT}).administrableBy(stranger) {
+		t.Error("Nobody but admins should administer unowned nodes")
+	}
+}
+
+func TestChmod(t *testing.T) {
+	db := newTestDb(t)
+	hub := NewMsgHub(NewMsgBus(), db, nil)
+	conn := newTestConn(hub, 1)
+	owner := int64(10)
+	db.setPerms("/docs", &NodePerms{Owner: owner, Permissions: PERM_ALL})
+
+	nextAck := func() Ack {
+		ack := Ack{}
+		json.Unmarshal(nextPayload(conn.outbox), &ack)
+		return ack
+	}
+
+	private := uint8(PERM_OWNER_READ | PERM_OWNER_WRITE)
+	// Strangers can't chmod
+	hub.handleChmod(&Msg{Cmd: MSG_CMD_CHMOD, Path: "/docs", Permissions: &private, Ack: 1}, conn)
+	if ack := nextAck(); ackCode(ack) != MSG_ERR_PERMISSION_DENIED {
+		t.Error("Stranger could chmod", ack.Error)
+	}
+
+	// The owner makes it private, which is inherited down the tree
+	conn.identity = &Identity{Uid: "10", Claims: map[string]interface{}{}}
+	hub.handleChmod(&Msg{Cmd: MSG_CMD_CHMOD, Path: "/docs", Ack: 2}, conn)
+	if ack := nextAck(); ackCode(ack) != MSG_ERR_INVALID_DATA {
+		t.Error("Chmod without permissions was let through", ack.Error)
+	}
+	hub.handleChmod(&Msg{Cmd: MSG_CMD_CHMOD, Path: "/docs", Permissions: &private, Ack: 2}, conn)
+	if ack := nextAck(); ackCode(ack) != "" {
+		t.Error("Owner could not chmod", ack.Error)
+	}
+	if !hub.hasPermission(conn, "/docs/a/b", true) {
+		t.Error("Owner lost access")
+	}
+
+	conn.identity = nil
+	hub.handleSet(&Msg{Cmd: MSG_CMD_SET, Path: "/docs/a/b", Data: json.RawMessage(`1`), Ack: 3}, conn)
+	if ack := nextAck(); ackCode(ack) != MSG_ERR_PERMISSION_DENIED {
+		t.Error("Stranger could write to a private node", ack.Error)
+	}
+	hub.handleGet(&Msg{Cmd: MSG_CMD_GET, Path: "/docs/a", Ack: 4}, conn)
+	if ack := nextAck(); ackCode(ack) != MSG_ERR_PERMISSION_DENIED {
+		t.Error("Stranger could read a private node", ack.Error)
+	}
+
+	// Private nodes can't be read or overwritten through their parents
+	hub.handleGet(&Msg{Cmd: MSG_CMD_GET, Path: "/", Ack: 5}, conn)
+	if ack := nextAck(); ackCode(ack) != MSG_ERR_PERMISSION_DENIED {
+		t.Error("Stranger could read a private node from above", ack.Error)
+	}
+	hub.handleSet(&Msg{Cmd: MSG_CMD_SET, Path: "/", Data: json.RawMessage(`{"pub": 1}`), Ack: 6}, conn)
+	if ack := nextAck(); ackCode(ack) != MSG_ERR_PERMISSION_DENIED {
+		t.Error("Stranger could overwrite a private node from above", ack.Error)
+	}
+	hub.handleSet(&Msg{Cmd: MSG_CMD_SET, Path: "/pub", Data: json.RawMessage(`1`), Ack: 7}, conn)
+	if ack := nextAck(); ackCode(ack) != "" {
+		t.Error("Stranger could not write beside a private node", ack.Error)
+	}
+}
@@ -0,0 +1,185 @@
+package turbo
+
+import (
+	"sort"
+	"strconv"
+)
+
+const (
+	QUERY_ORDER_BY_KEY   = "$key"
+	QUERY_ORDER_BY_VALUE = "$value"
+)
+
+// Filters the children of a read, much like the js client's query methods
+type Query struct {
+	// Either $key, $value or the name of a child property
+	OrderBy      string      `json:"orderBy"`
+	StartAt      interface{} `json:"startAt"`
+	EndAt        interface{} `json:"endAt"`
+	EqualTo      interface{} `json:"equalTo"`
+	LimitToFirst int         `json:"limitToFirst"`
+	LimitToLast  int         `json:"limitToLast"`
+}
+
+type queryChild struct {
+	key   string
+	value interface{}
+	sort  interface{}
+}
+
+func (query *Query) apply(value interface{}) interface{} {
+	children := query.children(value)
+	if children == nil {
+		return value
+	}
+	query.sort(children)
+	// Filter by range
+	filtered := make([]*queryChild, 0, len(children))
+	for _, child := range children {
+		if query.EqualTo != nil && compareValues(child.sort, query.EqualTo) != 0 {
+			continue
+		}
+		if query.StartAt != nil && compareValues(child.sort, query.StartAt) < 0 {
+			continue
+		}
+		if query.EndAt != nil && compareValues(child.sort, query.EndAt) > 0 {
+			continue
+		}
+		filtered = append(filtered, child)
+	}
+	// Apply the limits
+	if query.LimitToFirst > 0 && len(filtered) > query.LimitToFirst {
+		filtered = filtered[:query.LimitToFirst]
+	}
+	if query.LimitToLast > 0 && len(filtered) > query.LimitToLast {
+		filtered = filtered[len(filtered)-query.LimitToLast:]
+	}
+
+	result := make(map[string]interface{})
+	for _, child := range filtered {
+		result[child.key] = child.value
+	}
+	return result
+}
+
+func (query *Query) sort(children []*queryChild) {
+	sort.SliceStable(children, func(i, j int) bool {
+		if cmp := compareValues(children[i].sort, children[j].sort); cmp != 0 {
+			return cmp < 0
+		}
+		return children[i].key < children[j].key
+	})
+}
+
+func (query *Query) children(value interface{}) []*queryChild {
+	var children []*queryChild
+
+	switch value.(type) {
+	case map[string]interface{}:
+		for key, childValue := range value.(map[string]interface{}) {
+			children = append(children, &queryChild{key: key, value: childValue})
+		}
+	case []interface{}:
+		for index, childValue := range value.([]interface{}) {
+			children = append(children, &queryChild{key: strconv.Itoa(index), value: childValue})
+		}
+	default:
+		return nil
+	}
+
+	for _, child := range children {
+		switch query.OrderBy {
+		case "", QUERY_ORDER_BY_KEY:
+			child.sort = child.key
+		case QUERY_ORDER_BY_VALUE:
+			child.sort = child.value
+		default:
+			if childMap, isMap := child.value.(map[string]interface{}); isMap {
+				child.sort = childMap[query.OrderBy]
+			}
+		}
+	}
+	return children
+}
+
+// The children of value in key order, or nil if value is a leaf
+func sortedChildren(value interface{}) []*queryChild {
+	query := Query{}
+	children := query.children(value)
+	query.sort(children)
+	return children
+}
+
+// Replaces any nested objects with true, leaving only the top level keys
+func shallow(value interface{}) interface{} {
+	switch value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{})
+		for key, childValue := range value.(map[string]interface{}) {
+			result[key] = shallowChild(childValue)
+		}
+		return result
+	case []interface{}:
+		result := make(map[string]interface{})
+		for index, childValue := range value.([]interface{}) {
+			result[strconv.Itoa(index)] = shallowChild(childValue)
+		}
+		return result
+	}
+	return value
+}
+
+func shallowChild(value interface{}) interface{} {
+	switch value.(type) {
+	case map[string]interface{}, []interface{}:
+		return true
+	}
+	return value
+}
+
+// Orders values as null < false < true < numbers < strings < objects
+func compareValues(a interface{}, b interface{}) int {
+	rankA, rankB := valueRank(a), valueRank(b)
+	if rankA != rankB {
+		return rankA - rankB
+	}
+
+	switch a.(type) {
+	case bool:
+		if a.(bool) == b.(bool) {
+			return 0
+		} else if b.(bool) {
+			return -1
+		}
+		return 1
+	case float64:
+		if a.(float64) < b.(float64) {
+			return -1
+		} else if a.(float64) > b.(float64) {
+			return 1
+		}
+		return 0
+	case string:
+		if a.(string) < b.(string) {
+			return -1
+		} else if a.(string) > b.(string) {
+			return 1
+		}
+		return 0
+	}
+	return 0
+}
+
+func valueRank(value interface{}) int {
+	switch value.(type) {
+	case nil:
+		return 0
+	case bool:
+		return 1
+	case float64:
+		return 2
+	case string:
+		return 3
+	}
+	return 4
+}
@@ -0,0 +1,58 @@
+package turbo
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestQuery(t *testing.T) {
+	var value interface{}
+	json.Unmarshal([]byte(`{
+		"a": {"score": 3, "name": "x"},
+		"b": {"score": 1, "name": "y"},
+		"c": {"score": 2, "name": "z"},
+		"d": {"name": "w"}
+	}`), &value)
+
+	byScore := &Query{OrderBy: "score", LimitToLast: 2}
+	res := byScore.apply(value).(map[string]interface{})
+	if len(res) != 2 || res["a"] == nil || res["c"] == nil {
+		t.Error("limitToLast by child was wrong", res)
+	}
+
+	byKey := &Query{StartAt: "b", EndAt: "c"}
+	res = byKey.apply(value).(map[string]interface{})
+	if len(res) != 2 || res["b"] == nil || res["c"] == nil {
+		t.Error("startAt/endAt by key was wrong", res)
+	}
+
+	// Children missing the property sort first as null
+	first := &Query{OrderBy: "score", LimitToFirst: 1}
+	res = first.apply(value).(map[string]interface{})
+	if len(res) != 1 || res["d"] == nil {
+		t.Error("limitToFirst by child was wrong", res)
+	}
+
+	equal := &Query{OrderBy: "score", EqualTo: float64(1)}
+	res = equal.apply(value).(map[string]interface{})
+	if len(res) != 1 || res["b"] == nil {
+		t.Error("equalTo by child was wrong", res)
+	}
+
+	if (&Query{LimitToFirst: 1}).apply("leaf") != "leaf" {
+		t.Error("Queries should not touch leaf values")
+	}
+}
+
+func TestShallow(t *testing.T) {
+	var value interface{}
+	json.Unmarshal([]byte(`{"a": {"b": 1}, "c": [1, 2], "d": "e"}`), &value)
+
+	res := shallow(value).(map[string]interface{})
+	if res["a"] != true || res["c"] != true || res["d"] != "e" {
+		t.Error("Shallow value was wrong", res)
+	}
+	if shallow(float64(4)) != float64(4) {
+		t.Error("Shallow should not touch leaf values")
+	}
+}
@@ -0,0 +1,316 @@
+package turbo
+
+import (
+	"github.com/gorilla/websocket"
+	"log"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Rejections a conn may rack up before it is disconnected; one is forgiven each second
+	RATE_LIMIT_STRIKES_DEFAULT    = 20
+	RATE_LIMIT_CLOSE_CODE_DEFAULT = websocket.ClosePolicyViolation
+)
+
+// Limits on what one conn, or everyone signed in as one identity, may do. Zero means no limit.
+type RateLimits struct {
+	// Writes per second, and how many may arrive at once
+	Writes     float64
+	WriteBurst int
+	// Bytes written per second, and how many may arrive at once; the burst defaults to at least MaxMessageSize
+	Bytes     float64
+	ByteBurst int
+	// Subscriptions held at once
+	Subscriptions int
+}
+
+type RateLimitConfig struct {
+	PerConn     RateLimits
+	PerIdentity RateLimits
+	// How many rejections a conn may have before it is disconnected, recovering one a second
+	Strikes int
+	// The close code sent to conns that are disconnected
+	CloseCode int
+}
+
+// Refills at rate tokens a second, up to burst; the owner must hold its lock
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// What a conn or identity has left
+type quota struct {
+	limits RateLimits
+	writes *tokenBucket
+	bytes  *tokenBucket
+	// The conns sharing an identity's quota
+	conns map[*Conn]bool
+	lock  sync.Mutex
+}
+
+// What a conn has used up, and how much abuse it has left before being disconnected
+type connQuota struct {
+	*quota
+	strikes *tokenBucket
+	closing bool
+}
+
+// Nil when the bucket would never run dry
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Whether the bucket has refilled all the way, so forgetting it would change nothing
+func (bucket *tokenBucket) full() bool {
+	return bucket == nil || bucket.has(bucket.burst)
+}
+
+// How long the bucket takes to refill from empty
+func (bucket *tokenBucket) refillTime() time.Duration {
+	if bucket == nil {
+		return 0
+	}
+	return time.Duration(bucket.burst / bucket.rate * float64(time.Second))
+}
+
+func (bucket *tokenBucket) refill() {
+	now := time.Now()
+	bucket.tokens = math.Min(bucket.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*bucket.rate)
+	bucket.last = now
+}
+
+func (bucket *tokenBucket) has(cost float64) bool {
+	if bucket == nil {
+		return true
+	}
+	bucket.refill()
+	return bucket.tokens >= cost
+}
+
+func (bucket *tokenBucket) take(cost float64) {
+	if bucket != nil {
+		bucket.tokens -= cost
+	}
+}
+
+// The byte burst is never smaller than the largest msg allowed, or that msg could never be sent
+func newQuota(limits RateLimits, maxMessageSize int64) *quota {
+	byteBurst := limits.ByteBurst
+	if byteBurst <= 0 {
+		byteBurst = int(math.Max(math.Ceil(limits.Bytes), float64(maxMessageSize)))
+	}
+	return &quota{
+		limits: limits,
+		writes: newTokenBucket(limits.Writes, limits.WriteBurst),
+		bytes:  newTokenBucket(limits.Bytes, byteBurst),
+		conns:  make(map[*Conn]bool),
+	}
+}
+
+func newConnQuota(config RateLimitConfig, maxMessageSize int64) *connQuota {
+	if config.Strikes == 0 {
+		config.Strikes = RATE_LIMIT_STRIKES_DEFAULT
+	}
+	return &connQuota{
+		quota:   newQuota(config.PerConn, maxMessageSize),
+		strikes: newTokenBucket(1, config.Strikes),
+	}
+}
+
+// Takes a write of size bytes from quota, and from shared if there is one, or from neither.
+// Both are held while checking and taking, so concurrent writes can't overdraw either.
+// Returns whichever couldn't afford it.
+func (quota *quota) spend(shared *quota, size int) *quota {
+	quota.lock.Lock()
+	defer quota.lock.Unlock()
+	if shared != nil {
+		shared.lock.Lock()
+		defer shared.lock.Unlock()
+	}
+	if !quota.affords(size) {
+		return quota
+	}
+	if shared != nil && !shared.affords(size) {
+		return shared
+	}
+	quota.take(size)
+	if shared != nil {
+		shared.take(size)
+	}
+	return nil
+}
+
+// The caller must hold the lock
+func (quota *quota) affords(size int) bool {
+	return quota.writes.has(1) && quota.bytes.has(float64(size))
+}
+
+// The caller must hold the lock
+func (quota *quota) take(size int) {
+	quota.writes.take(1)
+	quota.bytes.take(float64(size))
+}
+
+// Subscriptions held across every conn sharing this quota
+func (quota *quota) subscriptions() int {
+	quota.lock.Lock()
+	defer quota.lock.Unlock()
+	count := 0
+	for conn := range quota.conns {
+		count += conn.subscriptionCount()
+	}
+	return count
+}
+
+// Kept up to date by the bus, so the count can be read from any goroutine
+func (conn *Conn) subscriptionsChanged() {
+	atomic.StoreInt64(&conn.subscribed, int64(len(conn.subscriptions)))
+}
+
+func (conn *Conn) subscriptionCount() int {
+	return int(atomic.LoadInt64(&conn.subscribed))
+}
+
+// Whether msg is a write, as far as rate limits go
+func isWrite(cmd byte) bool {
+	switch cmd {
+	case MSG_CMD_SET, MSG_CMD_UPDATE, MSG_CMD_REMOVE, MSG_CMD_TRANS_SET, MSG_CMD_PUSH, MSG_CMD_PATCH,
+		MSG_CMD_ON_DISCONNECT_SET, MSG_CMD_ON_DISCONNECT_UPDATE, MSG_CMD_ON_DISCONNECT_REMOVE,
+		MSG_CMD_CHMOD, MSG_CMD_CHOWN:
+		return true
+	}
+	return false
+}
+
+// Charges msg to conn and its identity, returning an error if either can't afford it
+func (hub *MsgHub) limit(msg *Msg, conn *Conn) *Error {
+	if conn.quota == nil {
+		return nil
+	}
+	identityQuota := hub.identityQuota(conn)
+	switch {
+	case isWrite(msg.Cmd):
+		refused := conn.quota.spend(identityQuota, msg.size)
+		if refused == conn.quota.quota {
+			return NewError(MSG_ERR_RATE_LIMITED, "Too many writes from this connection")
+		}
+		if refused != nil {
+			return NewError(MSG_ERR_RATE_LIMITED, "Too many writes from this user")
+		}
+	case msg.Cmd == MSG_CMD_ON:
+		if max := conn.quota.limits.Subscriptions; max > 0 && conn.subscriptionCount() >= max {
+			return NewError(MSG_ERR_RATE_LIMITED, "Too many subscriptions on this connection")
+		}
+		if identityQuota != nil {
+			if max := identityQuota.limits.Subscriptions; max > 0 && identityQuota.subscriptions() >= max {
+				return NewError(MSG_ERR_RATE_LIMITED, "Too many subscriptions for this user")
+			}
+		}
+	}
+	return nil
+}
+
+// Turns msg away, and disconnects conn once it has been turned away too often
+func (hub *MsgHub) sendRateLimited(conn *Conn, msg *Msg, err *Error) {
+	log.Printf("Connection #%d was rate limited on cmd #%d: %s\n", conn.id, msg.Cmd, err.Message)
+	hub.sendAck(conn, msg.Ack, err, nil, 0)
+
+	conn.quota.lock.Lock()
+	exhausted := !conn.quota.strikes.has(1) && !conn.quota.closing
+	conn.quota.strikes.take(1)
+	if exhausted {
+		conn.quota.closing = true
+	}
+	conn.quota.lock.Unlock()
+	if exhausted {
+		closeCode := hub.config.RateLimits.CloseCode
+		if closeCode == 0 {
+			closeCode = RATE_LIMIT_CLOSE_CODE_DEFAULT
+		}
+		go hub.closeConn(conn, closeCode, "Rate limit exceeded")
+	}
+}
+
+// The quota shared by everyone signed in as conn's identity, if there are identity limits
+func (hub *MsgHub) identityQuota(conn *Conn) *quota {
+	identity := conn.auth()
+	if identity == nil {
+		return nil
+	}
+	hub.quotaLock.Lock()
+	defer hub.quotaLock.Unlock()
+	return hub.quotas[identity.Uid]
+}
+
+// Counts conn against identity's quota until it signs out or goes away
+func (hub *MsgHub) joinQuota(conn *Conn, identity *Identity) {
+	if hub.config.RateLimits.PerIdentity == (RateLimits{}) {
+		return
+	}
+	hub.quotaLock.Lock()
+	defer hub.quotaLock.Unlock()
+	shared := hub.quotas[identity.Uid]
+	if shared == nil {
+		shared = newQuota(hub.config.RateLimits.PerIdentity, hub.config.Limits.MaxMessageSize)
+		hub.quotas[identity.Uid] = shared
+	}
+	shared.lock.Lock()
+	shared.conns[conn] = true
+	shared.lock.Unlock()
+}
+
+// Identity quotas outlive their last conn until they have refilled,
+// so signing out and back in doesn't start a user over with a full quota
+func (hub *MsgHub) leaveQuota(conn *Conn, identity *Identity) {
+	hub.quotaLock.Lock()
+	defer hub.quotaLock.Unlock()
+	shared := hub.quotas[identity.Uid]
+	if shared == nil {
+		return
+	}
+	shared.lock.Lock()
+	delete(shared.conns, conn)
+	empty := len(shared.conns) == 0
+	shared.lock.Unlock()
+	if empty {
+		hub.expireQuota(identity.Uid, shared)
+	}
+}
+
+// Drops shared once nobody is using it and it has refilled, so dropping it forgives nothing.
+// The caller must hold the quota lock.
+func (hub *MsgHub) expireQuota(uid string, shared *quota) {
+	if hub.quotas[uid] != shared {
+		return
+	}
+	shared.lock.Lock()
+	inUse := len(shared.conns) > 0
+	refilled := shared.writes.full() && shared.bytes.full()
+	shared.lock.Unlock()
+	if inUse {
+		// The next conn to leave will check again
+		return
+	}
+	if refilled {
+		delete(hub.quotas, uid)
+		return
+	}
+	wait := time.Duration(math.Max(float64(shared.writes.refillTime()), float64(shared.bytes.refillTime())))
+	time.AfterFunc(wait, func() {
+		hub.quotaLock.Lock()
+		defer hub.quotaLock.Unlock()
+		hub.expireQuota(uid, shared)
+	})
+}
@@ -0,0 +1,134 @@
+package turbo
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	if newTokenBucket(0, 10) != nil {
+		t.Error("Bucket without a rate should be unlimited")
+	}
+	bucket := newTokenBucket(100, 2)
+	for i := 0; i < 2; i++ {
+		if !bucket.has(1) {
+			t.Error("Burst was not allowed", i)
+		}
+		bucket.take(1)
+	}
+	if bucket.has(1) {
+		t.Error("Empty bucket allowed a token")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if !bucket.has(1) {
+		t.Error("Bucket did not refill")
+	}
+	if bucket.has(3) {
+		t.Error("Bucket refilled past its burst")
+	}
+
+	// Any msg small enough to be read must fit in the byte burst
+	if burst := newQuota(RateLimits{Bytes: 10}, 1000).bytes.burst; burst != 1000 {
+		t.Error("Byte burst was smaller than the largest msg", burst)
+	}
+}
+
+func TestRateLimits(t *testing.T) {
+	db := newTestDb(t)
+	hub := NewMsgHub(NewMsgBus(), db, &Config{RateLimits: RateLimitConfig{
+		PerConn:     RateLimits{Writes: 0.001, WriteBurst: 3, Subscriptions: 2},
+		PerIdentity: RateLimits{Writes: 0.001, WriteBurst: 4},
+		Strikes:     2,
+	}})
+	go hub.listen()
+	newConn := func(id uint64) *Conn {
+		conn := newTestConn(hub, id)
+		conn.quota = newConnQuota(hub.config.RateLimits, hub.config.Limits.MaxMessageSize)
+		hub.registerConn(conn)
+		return conn
+	}
+	// Sends msg and returns its ack, skipping any events
+	send := func(conn *Conn, msg *Msg) Ack {
+		hub.dispatch(msg, conn)
+		for {
+			ack := Ack{}
+			json.Unmarshal(nextPayload(conn.outbox), &ack)
+			if ack.Type == MSG_CMD_ACK {
+				return ack
+			}
+		}
+	}
+	set := &Msg{Cmd: MSG_CMD_SET, Path: "/limited", Data: json.RawMessage(`1`)}
+
+	conn := newConn(1)
+	for i := 0; i < 3; i++ {
+		if ack := send(conn, set); ack.Error != nil {
+			t.Error("Write within the burst was refused", i, ack.Error)
+		}
+	}
+	if ack := send(conn, set); ackCode(ack) != MSG_ERR_RATE_LIMITED {
+		t.Error("Write past the burst was let through", ack.Error)
+	}
+	// Reads aren't writes
+	if ack := send(conn, &Msg{Cmd: MSG_CMD_GET, Path: "/limited"}); ack.Error != nil {
+		t.Error("Read was rate limited", ack.Error)
+	}
+
+	// Subscribing to the same thing twice doesn't count twice
+	on := func(path Path) *Msg {
+		return &Msg{Cmd: MSG_CMD_ON, Path: path, Event: EVENT_TYPE_VALUE}
+	}
+	for _, path := range []Path{"/a", "/a", "/b"} {
+		send(conn, on(path))
+	}
+	if conn.subscriptionCount() != 2 {
+		t.Error("Subscriptions were miscounted", conn.subscriptionCount())
+	}
+	if ack := send(conn, on("/c")); ackCode(ack) != MSG_ERR_RATE_LIMITED {
+		t.Error("Subscription past the limit was let through", ack.Error)
+	}
+	hub.dispatch(&Msg{Cmd: MSG_CMD_OFF, Path: "/a", Event: EVENT_TYPE_VALUE}, conn)
+	send(conn, on("/c"))
+	if conn.subscriptionCount() != 2 {
+		t.Error("Unsubscribing did not make room", conn.subscriptionCount())
+	}
+
+	// Conns signed in as the same user share their identity's limit
+	identity := &Identity{Uid: "flooder", Expires: time.Now().Add(time.Hour)}
+	first, second := newConn(2), newConn(3)
+	first.authenticate(identity)
+	second.authenticate(identity)
+	for i := 0; i < 4; i++ {
+		if ack := send([]*Conn{first, second}[i%2], set); ack.Error != nil {
+			t.Error("Write within the identity's burst was refused", i, ack.Error)
+		}
+	}
+	if ack := send(first, set); ackCode(ack) != MSG_ERR_RATE_LIMITED {
+		t.Error("Write past the identity's burst was let through", ack.Error)
+	}
+	// Refreshing the token doesn't refill the quota...
+	first.authenticate(&Identity{Uid: "flooder", Expires: time.Now().Add(time.Hour)})
+	if ack := send(first, set); ack.Error == nil || ack.Error.Message != "Too many writes from this user" {
+		t.Error("Refreshed token reset the identity's limit", ack.Error)
+	}
+	second.unauthenticate()
+	if ack := send(second, set); ack.Error != nil {
+		t.Error("Signed out conn was held to the identity's limit", ack.Error)
+	}
+	// ...and neither does signing out everywhere and coming back
+	first.unauthenticate()
+	third := newConn(4)
+	third.authenticate(identity)
+	if ack := send(third, set); ack.Error == nil || ack.Error.Message != "Too many writes from this user" {
+		t.Error("Identity's limit was forgotten before it refilled", ack.Error)
+	}
+
+	// Keeping at it gets the conn dropped
+	for i := 0; i < 3; i++ {
+		hub.dispatch(set, conn)
+	}
+	if !closedWithin(conn.outbox, time.Second) {
+		t.Error("Abusive conn was not disconnected")
+	}
+}
@@ -0,0 +1,477 @@
+package turbo
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	RULE_TOKEN_NUMBER = iota
+	RULE_TOKEN_STRING
+	RULE_TOKEN_IDENT
+	RULE_TOKEN_PUNCT
+	RULE_TOKEN_END
+)
+
+// Operators longest first, so the lexer is greedy
+var rulePunctuation = []string{
+	"===", "!==", "==", "!=", "<=", ">=", "&&", "||",
+	"(", ")", "[", "]", ".", ",", "!", "<", ">", "+", "-", "*", "/", "%",
+}
+
+// Binary operator precedence, loosest first
+var ruleBinaryOperators = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!=", "===", "!=="},
+	{"<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+type ruleToken struct {
+	kind int
+	text string
+}
+
+// A parsed rule expression
+type ruleExpr interface {
+	eval(ctx *ruleContext) (interface{}, error)
+}
+
+type ruleLiteral struct {
+	value interface{}
+}
+
+type ruleIdent struct {
+	name string
+}
+
+type ruleMember struct {
+	object ruleExpr
+	name   string
+}
+
+type ruleCall struct {
+	callee *ruleMember
+	args   []ruleExpr
+}
+
+type ruleArray struct {
+	items []ruleExpr
+}
+
+type ruleUnary struct {
+	op      string
+	operand ruleExpr
+}
+
+type ruleBinary struct {
+	op          string
+	left, right ruleExpr
+}
+
+type ruleParser struct {
+	tokens []ruleToken
+	pos    int
+}
+
+func parseRuleExpr(source string) (ruleExpr, error) {
+	tokens, err := lexRuleExpr(source)
+	if err != nil {
+		return nil, err
+	}
+	parser := ruleParser{tokens: tokens}
+	expr, err := parser.binary(0)
+	if err != nil {
+		return nil, err
+	}
+	if parser.peek().kind != RULE_TOKEN_END {
+		return nil, errors.New("Unexpected '" + parser.peek().text + "' in rule '" + source + "'")
+	}
+	return expr, nil
+}
+
+func lexRuleExpr(source string) ([]ruleToken, error) {
+	var tokens []ruleToken
+	i := 0
+	for i < len(source) {
+		c := source[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c >= '0' && c <= '9':
+			start := i
+			for i < len(source) && (source[i] >= '0' && source[i] <= '9' || source[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, ruleToken{RULE_TOKEN_NUMBER, source[start:i]})
+		case c == '\'' || c == '"':
+			start := i + 1
+			i++
+			for i < len(source) && source[i] != c {
+				i++
+			}
+			if i >= len(source) {
+				return nil, errors.New("Unterminated string in rule '" + source + "'")
+			}
+			tokens = append(tokens, ruleToken{RULE_TOKEN_STRING, source[start:i]})
+			i++
+		case c == '$' || c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			start := i
+			for i < len(source) && (source[i] == '$' || source[i] == '_' ||
+				source[i] >= 'a' && source[i] <= 'z' || source[i] >= 'A' && source[i] <= 'Z' ||
+				source[i] >= '0' && source[i] <= '9') {
+				i++
+			}
+			tokens = append(tokens, ruleToken{RULE_TOKEN_IDENT, source[start:i]})
+		default:
+			matched := false
+			for _, punct := range rulePunctuation {
+				if strings.HasPrefix(source[i:], punct) {
+					tokens = append(tokens, ruleToken{RULE_TOKEN_PUNCT, punct})
+					i += len(punct)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, errors.New("Unexpected character '" + string(c) + "' in rule '" + source + "'")
+			}
+		}
+	}
+	return append(tokens, ruleToken{RULE_TOKEN_END, ""}), nil
+}
+
+func (parser *ruleParser) peek() ruleToken {
+	return parser.tokens[parser.pos]
+}
+
+func (parser *ruleParser) next() ruleToken {
+	token := parser.tokens[parser.pos]
+	if token.kind != RULE_TOKEN_END {
+		parser.pos++
+	}
+	return token
+}
+
+func (parser *ruleParser) accept(punct string) bool {
+	if token := parser.peek(); token.kind == RULE_TOKEN_PUNCT && token.text == punct {
+		parser.pos++
+		return true
+	}
+	return false
+}
+
+func (parser *ruleParser) expect(punct string) error {
+	if !parser.accept(punct) {
+		return errors.New("Expected '" + punct + "' but found '" + parser.peek().text + "'")
+	}
+	return nil
+}
+
+func (parser *ruleParser) binary(level int) (ruleExpr, error) {
+	if level == len(ruleBinaryOperators) {
+		return parser.unary()
+	}
+	left, err := parser.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := ""
+		for _, candidate := range ruleBinaryOperators[level] {
+			if parser.accept(candidate) {
+				op = candidate
+				break
+			}
+		}
+		if op == "" {
+			return left, nil
+		}
+		right, err := parser.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		left = &ruleBinary{op: op, left: left, right: right}
+	}
+}
+
+func (parser *ruleParser) unary() (ruleExpr, error) {
+	for _, op := range []string{"!", "-"} {
+		if parser.accept(op) {
+			operand, err := parser.unary()
+			if err != nil {
+				return nil, err
+			}
+			return &ruleUnary{op: op, operand: operand}, nil
+		}
+	}
+	return parser.postfix()
+}
+
+func (parser *ruleParser) postfix() (ruleExpr, error) {
+	expr, err := parser.primary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		if parser.accept(".") {
+			name := parser.next()
+			if name.kind != RULE_TOKEN_IDENT {
+				return nil, errors.New("Expected a name after '.' but found '" + name.text + "'")
+			}
+			expr = &ruleMember{object: expr, name: name.text}
+		} else if parser.accept("(") {
+			member, isMember := expr.(*ruleMember)
+			if !isMember {
+				return nil, errors.New("Only methods can be called in rules")
+			}
+			args, err := parser.list(")")
+			if err != nil {
+				return nil, err
+			}
+			expr = &ruleCall{callee: member, args: args}
+		} else {
+			return expr, nil
+		}
+	}
+}
+
+func (parser *ruleParser) primary() (ruleExpr, error) {
+	token := parser.next()
+	switch token.kind {
+	case RULE_TOKEN_NUMBER:
+		number, err := strconv.ParseFloat(token.text, 64)
+		if err != nil {
+			return nil, err
+		}
+		return &ruleLiteral{value: number}, nil
+	case RULE_TOKEN_STRING:
+		return &ruleLiteral{value: token.text}, nil
+	case RULE_TOKEN_IDENT:
+		switch token.text {
+		case "true":
+			return &ruleLiteral{value: true}, nil
+		case "false":
+			return &ruleLiteral{value: false}, nil
+		case "null":
+			return &ruleLiteral{value: nil}, nil
+		}
+		return &ruleIdent{name: token.text}, nil
+	case RULE_TOKEN_PUNCT:
+		if token.text == "(" {
+			expr, err := parser.binary(0)
+			if err != nil {
+				return nil, err
+			}
+			return expr, parser.expect(")")
+		} else if token.text == "[" {
+			items, err := parser.list("]")
+			if err != nil {
+				return nil, err
+			}
+			return &ruleArray{items: items}, nil
+		}
+	}
+	return nil, errors.New("Unexpected '" + token.text + "' in rule")
+}
+
+// Parses comma separated expressions up to and including the closing punctuation
+func (parser *ruleParser) list(closing string) ([]ruleExpr, error) {
+	var items []ruleExpr
+	if parser.accept(closing) {
+		return items, nil
+	}
+	for {
+		item, err := parser.binary(0)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+		if parser.accept(closing) {
+			return items, nil
+		}
+		if err := parser.expect(","); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (expr *ruleLiteral) eval(ctx *ruleContext) (interface{}, error) {
+	return expr.value, nil
+}
+
+func (expr *ruleIdent) eval(ctx *ruleContext) (interface{}, error) {
+	return ctx.lookup(expr.name)
+}
+
+func (expr *ruleMember) eval(ctx *ruleContext) (interface{}, error) {
+	object, err := expr.object.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	switch object.(type) {
+	case map[string]interface{}:
+		return object.(map[string]interface{})[expr.name], nil
+	case string:
+		if expr.name == "length" {
+			return float64(len(object.(string))), nil
+		}
+	}
+	return nil, errors.New("Cannot read '" + expr.name + "' here")
+}
+
+func (expr *ruleCall) eval(ctx *ruleContext) (interface{}, error) {
+	object, err := expr.callee.object.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	args := make([]interface{}, len(expr.args))
+	for i, arg := range expr.args {
+		if args[i], err = arg.eval(ctx); err != nil {
+			return nil, err
+		}
+	}
+	switch object.(type) {
+	case *ruleSnapshot:
+		return object.(*ruleSnapshot).call(expr.callee.name, args)
+	case string:
+		return callStringMethod(object.(string), expr.callee.name, args)
+	}
+	return nil, errors.New("Cannot call '" + expr.callee.name + "' here")
+}
+
+func (expr *ruleArray) eval(ctx *ruleContext) (interface{}, error) {
+	items := make([]interface{}, len(expr.items))
+	for i, item := range expr.items {
+		value, err := item.eval(ctx)
+		if err != nil {
+			return nil, err
+		}
+		items[i] = value
+	}
+	return items, nil
+}
+
+func (expr *ruleUnary) eval(ctx *ruleContext) (interface{}, error) {
+	operand, err := expr.operand.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if expr.op == "!" {
+		return operand != true, nil
+	}
+	if number, isNumber := operand.(float64); isNumber {
+		return -number, nil
+	}
+	return nil, errors.New("Cannot negate a non-number")
+}
+
+func (expr *ruleBinary) eval(ctx *ruleContext) (interface{}, error) {
+	left, err := expr.left.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// Short circuit the logical operators
+	switch expr.op {
+	case "&&":
+		if left != true {
+			return false, nil
+		}
+		right, err := expr.right.eval(ctx)
+		return right == true, err
+	case "||":
+		if left == true {
+			return true, nil
+		}
+		right, err := expr.right.eval(ctx)
+		return right == true, err
+	}
+
+	right, err := expr.right.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	switch expr.op {
+	case "==", "===":
+		return reflect.DeepEqual(left, right), nil
+	case "!=", "!==":
+		return !reflect.DeepEqual(left, right), nil
+	case "+":
+		leftStr, leftIsStr := left.(string)
+		rightStr, rightIsStr := right.(string)
+		if leftIsStr || rightIsStr {
+			if !leftIsStr {
+				leftStr = fmt.Sprint(left)
+			}
+			if !rightIsStr {
+				rightStr = fmt.Sprint(right)
+			}
+			return leftStr + rightStr, nil
+		}
+	}
+
+	leftNum, leftIsNum := left.(float64)
+	rightNum, rightIsNum := right.(float64)
+	if !leftIsNum || !rightIsNum {
+		// Strings compare lexically, anything else is an error
+		leftStr, leftIsStr := left.(string)
+		rightStr, rightIsStr := right.(string)
+		if !leftIsStr || !rightIsStr {
+			return nil, errors.New("Operator '" + expr.op + "' needs two numbers or two strings")
+		}
+		leftNum, rightNum = float64(strings.Compare(leftStr, rightStr)), 0
+	}
+	switch expr.op {
+	case "<":
+		return leftNum < rightNum, nil
+	case "<=":
+		return leftNum <= rightNum, nil
+	case ">":
+		return leftNum > rightNum, nil
+	case ">=":
+		return leftNum >= rightNum, nil
+	}
+	if !leftIsNum || !rightIsNum {
+		return nil, errors.New("Operator '" + expr.op + "' needs two numbers")
+	}
+	switch expr.op {
+	case "+":
+		return leftNum + rightNum, nil
+	case "-":
+		return leftNum - rightNum, nil
+	case "*":
+		return leftNum * rightNum, nil
+	case "/":
+		return leftNum / rightNum, nil
+	}
+	if rightNum == 0 {
+		return nil, errors.New("Modulo by zero")
+	}
+	// Same as javascript, fractions and all
+	return math.Mod(leftNum, rightNum), nil
+}
+
+func callStringMethod(str string, name string, args []interface{}) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, errors.New("String method '" + name + "' takes one argument")
+	}
+	arg, isString := args[0].(string)
+	if !isString {
+		return nil, errors.New("String method '" + name + "' takes a string")
+	}
+	switch name {
+	case "contains":
+		return strings.Contains(str, arg), nil
+	case "beginsWith":
+		return strings.HasPrefix(str, arg), nil
+	case "endsWith":
+		return strings.HasSuffix(str, arg), nil
+	}
+	return nil, errors.New("Unknown string method '" + name + "'")
+}
@@ -0,0 +1,418 @@
+package turbo
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+const (
+	RULE_READ     = ".read"
+	RULE_WRITE    = ".write"
+	RULE_VALIDATE = ".validate"
+)
+
+// Security rules mirroring the shape of the data tree
+type Rules struct {
+	root *ruleNode
+}
+
+type ruleNode struct {
+	read     ruleExpr
+	write    ruleExpr
+	validate ruleExpr
+	children map[string]*ruleNode
+	// Matches any key not in children, capturing it as a $variable
+	variable string
+	wildcard *ruleNode
+}
+
+// A ruleNode matched while walking down a path
+type ruleMatch struct {
+	node *ruleNode
+	path Path
+	vars map[string]string
+}
+
+// What a rule expression can see
+type ruleContext struct {
+	auth    interface{}
+	now     float64
+	vars    map[string]string
+	data    *ruleSnapshot
+	newData *ruleSnapshot
+	root    *ruleSnapshot
+	// Where data and newData come from
+	dataSource    func(Path) interface{}
+	newDataSource func(Path) interface{}
+}
+
+// A lazily loaded view of the value at path
+type ruleSnapshot struct {
+	path   Path
+	source func(Path) interface{}
+	value  interface{}
+	loaded bool
+}
+
+func LoadRules(path string) (*Rules, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRules(contents)
+}
+
+// Parses a rules document, with or without the top level "rules" key
+func ParseRules(contents []byte) (*Rules, error) {
+	document := make(map[string]interface{})
+	if err := json.Unmarshal(contents, &document); err != nil {
+		return nil, err
+	}
+	if inner, hasRules := document["rules"].(map[string]interface{}); hasRules {
+		document = inner
+	}
+	root, err := parseRuleNode(document)
+	if err != nil {
+		return nil, err
+	}
+	return &Rules{root: root}, nil
+}
+
+func parseRuleNode(raw map[string]interface{}) (*ruleNode, error) {
+	node := ruleNode{
+		children: make(map[string]*ruleNode),
+	}
+	for key, value := range raw {
+		switch key {
+		case RULE_READ, RULE_WRITE, RULE_VALIDATE:
+			expr, err := parseRule(value)
+			if err != nil {
+				return nil, errors.New("Bad " + key + " rule: " + err.Error())
+			}
+			if key == RULE_READ {
+				node.read = expr
+			} else if key == RULE_WRITE {
+				node.write = expr
+			} else {
+				node.validate = expr
+			}
+		default:
+			// Leave room for other rule types
+			if strings.HasPrefix(key, DOT) {
+				continue
+			}
+			childRaw, isMap := value.(map[string]interface{})
+			if !isMap {
+				return nil, errors.New("Rules for '" + key + "' must be an object")
+			}
+			child, err := parseRuleNode(childRaw)
+			if err != nil {
+				return nil, err
+			}
+			if strings.HasPrefix(key, "$") {
+				if node.wildcard != nil {
+					return nil, errors.New("Rules can only have one $variable per level, found '" + node.variable + "' and '" + key + "'")
+				}
+				node.variable = key
+				node.wildcard = child
+			} else {
+				node.children[key] = child
+			}
+		}
+	}
+	return &node, nil
+}
+
+func parseRule(value interface{}) (ruleExpr, error) {
+	switch value.(type) {
+	case bool:
+		return &ruleLiteral{value: value}, nil
+	case string:
+		return parseRuleExpr(value.(string))
+	}
+	return nil, errors.New("rules must be booleans or expressions")
+}
+
+func (node *ruleNode) child(key string, vars map[string]string) (*ruleNode, map[string]string) {
+	if child := node.children[key]; child != nil {
+		return child, vars
+	}
+	if node.wildcard == nil {
+		return nil, vars
+	}
+	captured := make(map[string]string, len(vars)+1)
+	for name, value := range vars {
+		captured[name] = value
+	}
+	captured[node.variable] = key
+	return node.wildcard, captured
+}
+
+// Every rule node from the root down to path, stopping where the rules do
+func (rules *Rules) walk(path Path) []*ruleMatch {
+	match := &ruleMatch{node: rules.root, path: ROOT_PATH, vars: map[string]string{}}
+	matches := []*ruleMatch{match}
+	for _, segment := range path.keys() {
+		node, vars := match.node.child(segment, match.vars)
+		if node == nil {
+			break
+		}
+		match = &ruleMatch{node: node, path: match.path.child(segment), vars: vars}
+		matches = append(matches, match)
+	}
+	return matches
+}
+
+// Reads are allowed if any .read rule on the way down to path allows them
+func (rules *Rules) canRead(ctx *ruleContext, path Path) bool {
+	for _, match := range rules.walk(path) {
+		if match.node.read != nil && ctx.at(match).check(match.node.read) {
+			return true
+		}
+	}
+	return false
+}
+
+// Writes need a .write rule on the way down to allow them, then every .validate in the new data to pass
+func (rules *Rules) canWrite(ctx *ruleContext, path Path, value interface{}) bool {
+	allowed := false
+	matches := rules.walk(path)
+	for _, match := range matches {
+		if match.node.write != nil && ctx.at(match).check(match.node.write) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return false
+	}
+	last := matches[len(matches)-1]
+	if last.path != path {
+		return true
+	}
+	return rules.validate(ctx, last, value)
+}
+
+// .validate rules only apply to data that exists, and don't cascade
+func (rules *Rules) validate(ctx *ruleContext, match *ruleMatch, value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	if match.node.validate != nil && !ctx.at(match).check(match.node.validate) {
+		return false
+	}
+	if children, isMap := value.(map[string]interface{}); isMap {
+		for key, childValue := range children {
+			node, vars := match.node.child(key, match.vars)
+			if node == nil {
+				continue
+			}
+			childMatch := &ruleMatch{node: node, path: match.path.child(key), vars: vars}
+			if !rules.validate(ctx, childMatch, childValue) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func newRuleContext(identity *Identity, dataSource func(Path) interface{}) *ruleContext {
+	ctx := ruleContext{
+		now:           float64(time.Now().UnixNano() / int64(time.Millisecond)),
+		dataSource:    dataSource,
+		newDataSource: dataSource,
+	}
+	if identity != nil {
+		auth := make(map[string]interface{}, len(identity.Claims)+1)
+		for claim, value := range identity.Claims {
+			auth[claim] = value
+		}
+		auth["uid"] = identity.Uid
+		ctx.auth = auth
+	}
+	return &ctx
+}
+
+// Makes newData show value at path, on top of what is already stored
+func (ctx *ruleContext) writing(writePath Path, value interface{}) *ruleContext {
+	writeSegments := writePath.keys()
+	ctx.newDataSource = func(currPath Path) interface{} {
+		currSegments := currPath.keys()
+		if currPath.within(writePath) {
+			return valueAt(value, currSegments[len(writeSegments):])
+		}
+		if writePath.within(currPath) {
+			return setValueAt(ctx.dataSource(currPath), writeSegments[len(currSegments):], value)
+		}
+		return ctx.dataSource(currPath)
+	}
+	return ctx
+}
+
+// A copy of ctx with data and newData positioned at match
+func (ctx *ruleContext) at(match *ruleMatch) *ruleContext {
+	located := *ctx
+	located.vars = match.vars
+	located.data = &ruleSnapshot{path: match.path, source: ctx.dataSource}
+	located.newData = &ruleSnapshot{path: match.path, source: ctx.newDataSource}
+	located.root = &ruleSnapshot{path: ROOT_PATH, source: ctx.dataSource}
+	return &located
+}
+
+// Rules only pass on exactly true; errors count as a denial
+func (ctx *ruleContext) check(expr ruleExpr) bool {
+	result, err := expr.eval(ctx)
+	return err == nil && result == true
+}
+
+func (ctx *ruleContext) lookup(name string) (interface{}, error) {
+	switch name {
+	case "auth":
+		return ctx.auth, nil
+	case "now":
+		return ctx.now, nil
+	case "data":
+		return ctx.data, nil
+	case "newData":
+		return ctx.newData, nil
+	case "root":
+		return ctx.root, nil
+	}
+	if value, exists := ctx.vars[name]; exists {
+		return value, nil
+	}
+	return nil, errors.New("Unknown variable '" + name + "'")
+}
+
+func (snapshot *ruleSnapshot) val() interface{} {
+	if !snapshot.loaded {
+		snapshot.value = snapshot.source(snapshot.path)
+		snapshot.loaded = true
+	}
+	return snapshot.value
+}
+
+func (snapshot *ruleSnapshot) child(path string) *ruleSnapshot {
+	child := ruleSnapshot{
+		path:   snapshot.path.join(path),
+		source: snapshot.source,
+	}
+	// Save a trip to the source if we have the value already
+	if snapshot.loaded {
+		child.value = valueAt(snapshot.value, splitKeys(path))
+		child.loaded = true
+	}
+	return &child
+}
+
+func (snapshot *ruleSnapshot) call(name string, args []interface{}) (interface{}, error) {
+	switch name {
+	case "val":
+		return snapshot.val(), nil
+	case "exists":
+		return snapshot.val() != nil, nil
+	case "parent":
+		parentPath, _ := snapshot.path.parent()
+		return &ruleSnapshot{path: parentPath, source: snapshot.source}, nil
+	case "isNumber":
+		_, isNumber := snapshot.val().(float64)
+		return isNumber, nil
+	case "isString":
+		_, isString := snapshot.val().(string)
+		return isString, nil
+	case "isBoolean":
+		_, isBoolean := snapshot.val().(bool)
+		return isBoolean, nil
+	case "numChildren":
+		children, _ := snapshot.val().(map[string]interface{})
+		return float64(len(children)), nil
+	case "child", "hasChild":
+		if len(args) != 1 {
+			return nil, errors.New("'" + name + "' takes one path")
+		}
+		path, isString := args[0].(string)
+		if !isString {
+			return nil, errors.New("'" + name + "' takes one path")
+		}
+		if name == "child" {
+			return snapshot.child(path), nil
+		}
+		return snapshot.child(path).val() != nil, nil
+	case "hasChildren":
+		children, _ := snapshot.val().(map[string]interface{})
+		if len(args) == 0 {
+			return len(children) > 0, nil
+		}
+		names, isList := args[0].([]interface{})
+		if !isList {
+			return nil, errors.New("'hasChildren' takes a list of names")
+		}
+		for _, childName := range names {
+			key, isString := childName.(string)
+			if !isString || children[key] == nil {
+				return false, nil
+			}
+		}
+		return true, nil
+	}
+	return nil, errors.New("Unknown snapshot method '" + name + "'")
+}
+
+// Node permissions are checked first, then the rules
+func (hub *MsgHub) canRead(conn *Conn, path Path) bool {
+	if isInfoPath(path) {
+		return true
+	}
+	if !hub.hasPermission(conn, path, false) {
+		return false
+	}
+	return hub.rules == nil || hub.rules.canRead(hub.ruleContext(conn), path)
+}
+
+func (hub *MsgHub) canWrite(conn *Conn, path Path, value interface{}) bool {
+	if !hub.hasPermission(conn, path, true) {
+		return false
+	}
+	return hub.rules == nil || hub.rules.canWrite(hub.ruleContext(conn).writing(path, value), path, value)
+}
+
+// Bad json is let through here, since the write itself will report it
+func (hub *MsgHub) canWriteData(conn *Conn, path Path, data json.RawMessage) bool {
+	var value interface{}
+	if hub.rules != nil && json.Unmarshal(data, &value) != nil {
+		return true
+	}
+	return hub.canWrite(conn, path, value)
+}
+
+// Updates are only allowed if every property may be written, with newData showing all of them written at once
+func (hub *MsgHub) canUpdate(conn *Conn, path Path, dataMap json.RawMessage) bool {
+	propertyMap := make(map[string]interface{})
+	if json.Unmarshal(dataMap, &propertyMap) != nil {
+		return true
+	}
+	var ctx *ruleContext
+	if hub.rules != nil {
+		ctx = hub.ruleContext(conn).writing(path, hub.mergeUpdate(path, propertyMap))
+	}
+	for property, value := range propertyMap {
+		propertyPath := path.join(property)
+		if !hub.hasPermission(conn, propertyPath, true) {
+			return false
+		}
+		if ctx != nil && !hub.rules.canWrite(ctx, propertyPath, value) {
+			return false
+		}
+	}
+	return true
+}
+
+func (hub *MsgHub) ruleContext(conn *Conn) *ruleContext {
+	return newRuleContext(conn.auth(), func(path Path) interface{} {
+		_, value, _ := hub.db.get(path)
+		return value
+	})
+}
@@ -0,0 +1,150 @@
+package turbo
+
+import (
+	"testing"
+	"time"
+)
+
+const testRules = `{
+	"rules": {
+		".read": "auth != null",
+		"public": {
+			".read": true
+		},
+		"users": {
+			"$uid": {
+				".write": "auth != null && auth.uid == $uid",
+				".validate": "newData.hasChildren(['name'])",
+				"name": {
+					".validate": "newData.isString() && newData.val().length < 10"
+				},
+				"age": {
+					".validate": "newData.isNumber() && newData.val() >= 0"
+				}
+			}
+		},
+		"counters": {
+			"$counter": {
+				".write": "!data.exists() || newData.val() == data.val() + 1"
+			}
+		},
+		"admin": {
+			".write": "root.child('admins').hasChild(auth.uid)"
+		}
+	}
+}`
+
+func testRuleData(values map[string]interface{}) func(Path) interface{} {
+	return func(path Path) interface{} {
+		return valueAt(values, path.keys())
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	if _, err := ParseRules([]byte(testRules)); err != nil {
+		t.Error("Could not parse the test rules", err)
+	}
+	if _, err := ParseRules([]byte(`{"a": {".read": "auth.uid =="}}`)); err == nil {
+		t.Error("Broken expression was accepted")
+	}
+	if _, err := ParseRules([]byte(`{"a": {"$x": {}, "$y": {}}}`)); err == nil {
+		t.Error("Two $variables on one level were accepted")
+	}
+}
+
+func TestRulesRead(t *testing.T) {
+	rules, _ := ParseRules([]byte(testRules))
+	data := testRuleData(map[string]interface{}{})
+	bob := &Identity{Uid: "bob", Expires: time.Now().Add(time.Hour)}
+
+	if rules.canRead(newRuleContext(nil, data), "/users/bob") {
+		t.Error("Anonymous read of /users/bob was allowed")
+	}
+	if !rules.canRead(newRuleContext(nil, data), "/public/news") {
+		t.Error("Anonymous read of /public/news was denied")
+	}
+	if !rules.canRead(newRuleContext(bob, data), "/users/bob") {
+		t.Error("Authenticated read of /users/bob was denied")
+	}
+}
+
+func TestRulesWrite(t *testing.T) {
+	rules, _ := ParseRules([]byte(testRules))
+	data := testRuleData(map[string]interface{}{
+		"counters": map[string]interface{}{"visits": float64(4)},
+		"admins":   map[string]interface{}{"alice": true},
+	})
+	bob := &Identity{Uid: "bob", Expires: time.Now().Add(time.Hour)}
+	alice := &Identity{Uid: "alice", Expires: time.Now().Add(time.Hour)}
+
+	canWrite := func(identity *Identity, path Path, value interface{}) bool {
+		return rules.canWrite(newRuleContext(identity, data).writing(path, value), path, value)
+	}
+
+	if !canWrite(bob, "/users/bob", map[string]interface{}{"name": "Bob", "age": float64(30)}) {
+		t.Error("Bob could not write his own profile")
+	}
+	if canWrite(bob, "/users/alice", map[string]interface{}{"name": "Alice"}) {
+		t.Error("Bob could write Alice's profile")
+	}
+	if canWrite(nil, "/users/bob", map[string]interface{}{"name": "Bob"}) {
+		t.Error("Anonymous write to a profile was allowed")
+	}
+	if canWrite(bob, "/users/bob", map[string]interface{}{"age": float64(30)}) {
+		t.Error("Profile without a name passed validation")
+	}
+	if canWrite(bob, "/users/bob", map[string]interface{}{"name": "Bob", "age": "old"}) {
+		t.Error("Profile with a string age passed validation")
+	}
+	if canWrite(bob, "/users/bob", map[string]interface{}{"name": "Bobbington the Third"}) {
+		t.Error("Profile with a long name passed validation")
+	}
+	if !canWrite(bob, "/users/bob/name", "Robert") {
+		t.Error("Bob could not change his name")
+	}
+	if !canWrite(bob, "/users/bob", nil) {
+		t.Error("Bob could not remove his profile")
+	}
+
+	if !canWrite(nil, "/counters/visits", float64(5)) {
+		t.Error("Counter could not be incremented")
+	}
+	if canWrite(nil, "/counters/visits", float64(7)) {
+		t.Error("Counter could be skipped ahead")
+	}
+
+	if !canWrite(alice, "/admin/motd", "hello") {
+		t.Error("Admin could not write to /admin")
+	}
+	if canWrite(bob, "/admin/motd", "hello") {
+		t.Error("Non-admin could write to /admin")
+	}
+}
+
+func TestRuleExpr(t *testing.T) {
+	ctx := newRuleContext(nil, testRuleData(map[string]interface{}{}))
+	exprs := map[string]interface{}{
+		"1 + 2 * 3":                 float64(7),
+		"(1 + 2) * 3":               float64(9),
+		"'a' + 1":                   "a1",
+		"!false && (true || false)": true,
+		"10 % 4 == 2":               true,
+		"7.5 % 2":                   1.5,
+		"5 % 0.5":                   float64(0),
+		"'abc'.beginsWith('ab')":    true,
+		"'abc' < 'abd'":             true,
+		"-3 < 2":                    true,
+		"auth == null":              true,
+	}
+	for source, expected := range exprs {
+		expr, err := parseRuleExpr(source)
+		if err != nil {
+			t.Error("Could not parse", source, err)
+			continue
+		}
+		result, err := expr.eval(ctx)
+		if err != nil || result != expected {
+			t.Error("Rule", source, "evaluated to", result, err)
+		}
+	}
+}
@@ -0,0 +1,289 @@
+package turbo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	SCHEMA_TYPE_OBJECT  = "object"
+	SCHEMA_TYPE_ARRAY   = "array"
+	SCHEMA_TYPE_STRING  = "string"
+	SCHEMA_TYPE_NUMBER  = "number"
+	SCHEMA_TYPE_INTEGER = "integer"
+	SCHEMA_TYPE_BOOLEAN = "boolean"
+	SCHEMA_TYPE_NULL    = "null"
+)
+
+// A subset of JSON Schema, checked against the data at a path
+type Schema struct {
+	Type        string             `json:"type"`
+	Required    []string           `json:"required"`
+	Properties  map[string]*Schema `json:"properties"`
+	MaxChildren int                `json:"maxChildren"`
+	Pattern     string             `json:"pattern"`
+	MinLength   *int               `json:"minLength"`
+	MaxLength   *int               `json:"maxLength"`
+	Minimum     *float64           `json:"minimum"`
+	Maximum     *float64           `json:"maximum"`
+	pattern     *regexp.Regexp
+}
+
+// Schemas attached to path patterns, where $variable segments match any key
+type Schemas struct {
+	patterns []*schemaPattern
+}
+
+type schemaPattern struct {
+	segments []string
+	schema   *Schema
+}
+
+func LoadSchemas(path string) (*Schemas, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSchemas(contents)
+}
+
+// Parses a json object of path patterns to schemas
+func ParseSchemas(contents []byte) (*Schemas, error) {
+	document := make(map[string]*Schema)
+	if err := json.Unmarshal(contents, &document); err != nil {
+		return nil, err
+	}
+	schemas := Schemas{}
+	for path, schema := range document {
+		if schema == nil {
+			return nil, errors.New("Schema for '" + path + "' is empty")
+		}
+		if err := schema.compile(); err != nil {
+			return nil, errors.New("Bad schema for '" + path + "': " + err.Error())
+		}
+		schemas.patterns = append(schemas.patterns, &schemaPattern{
+			segments: splitKeys(path),
+			schema:   schema,
+		})
+	}
+	// Keep violations in a stable order
+	sort.Slice(schemas.patterns, func(i, j int) bool {
+		return strings.Join(schemas.patterns[i].segments, SLASH) < strings.Join(schemas.patterns[j].segments, SLASH)
+	})
+	return &schemas, nil
+}
+
+func (schema *Schema) compile() error {
+	if schema.Pattern != "" {
+		pattern, err := regexp.Compile(schema.Pattern)
+		if err != nil {
+			return err
+		}
+		schema.pattern = pattern
+	}
+	for _, property := range schema.Properties {
+		if property == nil {
+			continue
+		}
+		if err := property.compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pattern *schemaPattern) matches(segments []string) bool {
+	if len(segments) != len(pattern.segments) {
+		return false
+	}
+	for i, segment := range pattern.segments {
+		if !strings.HasPrefix(segment, "$") && segment != segments[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether any schema is attached to path itself
+func (schemas *Schemas) covers(path Path) bool {
+	segments := path.keys()
+	for _, pattern := range schemas.patterns {
+		if pattern.matches(segments) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks value and everything beneath it against the schemas for their paths
+func (schemas *Schemas) validate(path Path, value interface{}) []*ErrorDetail {
+	var violations []*ErrorDetail
+	schemas.walk(path.keys(), value, &violations)
+	return violations
+}
+
+func (schemas *Schemas) walk(segments []string, value interface{}, violations *[]*ErrorDetail) {
+	// Missing data is only a problem if a parent requires it
+	if value == nil {
+		return
+	}
+	path := ROOT_PATH.join(strings.Join(segments, SLASH))
+	for _, pattern := range schemas.patterns {
+		if pattern.matches(segments) {
+			pattern.schema.check(path, value, violations)
+		}
+	}
+	for _, child := range sortedChildren(value) {
+		schemas.walk(append(segments[:len(segments):len(segments)], child.key), child.value, violations)
+	}
+}
+
+func (schema *Schema) check(path Path, value interface{}, violations *[]*ErrorDetail) {
+	violate := func(format string, args ...interface{}) {
+		*violations = append(*violations, &ErrorDetail{
+			Path:    string(path),
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	valueType := schemaTypeOf(value)
+	if schema.Type != "" && schema.Type != valueType {
+		// Integers are numbers too
+		number, isNumber := value.(float64)
+		if schema.Type != SCHEMA_TYPE_INTEGER || !isNumber || number != math.Trunc(number) {
+			violate("Expected %s but found %s", schema.Type, valueType)
+			return
+		}
+	}
+
+	switch value.(type) {
+	case string:
+		str := value.(string)
+		if schema.pattern != nil && !schema.pattern.MatchString(str) {
+			violate("Does not match the pattern '%s'", schema.Pattern)
+		}
+		if schema.MinLength != nil && len(str) < *schema.MinLength {
+			violate("Shorter than %d characters", *schema.MinLength)
+		}
+		if schema.MaxLength != nil && len(str) > *schema.MaxLength {
+			violate("Longer than %d characters", *schema.MaxLength)
+		}
+	case float64:
+		number := value.(float64)
+		if schema.Minimum != nil && number < *schema.Minimum {
+			violate("Less than the minimum of %v", *schema.Minimum)
+		}
+		if schema.Maximum != nil && number > *schema.Maximum {
+			violate("More than the maximum of %v", *schema.Maximum)
+		}
+	case []interface{}:
+		if schema.MaxChildren > 0 && len(value.([]interface{})) > schema.MaxChildren {
+			violate("Has more than %d children", schema.MaxChildren)
+		}
+	case map[string]interface{}:
+		children := value.(map[string]interface{})
+		if schema.MaxChildren > 0 && len(children) > schema.MaxChildren {
+			violate("Has more than %d children", schema.MaxChildren)
+		}
+		for _, key := range schema.Required {
+			if children[key] == nil {
+				violate("Is missing the required key '%s'", key)
+			}
+		}
+		for key, property := range schema.Properties {
+			if property != nil && children[key] != nil {
+				property.check(path.child(key), children[key], violations)
+			}
+		}
+	}
+}
+
+func schemaTypeOf(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return SCHEMA_TYPE_NULL
+	case bool:
+		return SCHEMA_TYPE_BOOLEAN
+	case float64:
+		return SCHEMA_TYPE_NUMBER
+	case string:
+		return SCHEMA_TYPE_STRING
+	case []interface{}:
+		return SCHEMA_TYPE_ARRAY
+	}
+	return SCHEMA_TYPE_OBJECT
+}
+
+// Validates what the tree will look like once value is written to path
+func (hub *MsgHub) validateWrite(path Path, value interface{}) []*ErrorDetail {
+	if hub.schemas == nil {
+		return nil
+	}
+	// Schemas above path have to see the whole subtree they cover
+	root := path
+	path.cascade(true, func(ancestor Path) {
+		if hub.schemas.covers(ancestor) {
+			root = ancestor
+		}
+	})
+	tree := value
+	if root != path {
+		_, current, _ := hub.db.get(root)
+		tree = setValueAt(current, path.keys()[len(root.keys()):], value)
+	}
+	return hub.schemas.validate(root, tree)
+}
+
+// Validates the result of merging every property of dataMap into path
+func (hub *MsgHub) validateUpdate(path Path, dataMap json.RawMessage) []*ErrorDetail {
+	if hub.schemas == nil {
+		return nil
+	}
+	propertyMap := make(map[string]interface{})
+	if json.Unmarshal(dataMap, &propertyMap) != nil {
+		return nil
+	}
+	return hub.validateWrite(path, hub.mergeUpdate(path, propertyMap))
+}
+
+// What path will hold once every property of propertyMap is written beneath it
+func (hub *MsgHub) mergeUpdate(path Path, propertyMap map[string]interface{}) interface{} {
+	_, merged, _ := hub.db.get(path)
+	for property, value := range propertyMap {
+		merged = setValueAt(merged, splitKeys(property), value)
+	}
+	return merged
+}
+
+func (hub *MsgHub) validateData(path Path, data json.RawMessage) []*ErrorDetail {
+	if hub.schemas == nil {
+		return nil
+	}
+	var value interface{}
+	if json.Unmarshal(data, &value) != nil {
+		return nil
+	}
+	return hub.validateWrite(path, value)
+}
+
+func (hub *MsgHub) sendInvalidData(conn *Conn, msg *Msg, violations []*ErrorDetail) {
+	hub.sendAck(conn, msg.Ack, hub.invalidData(conn, msg, violations), nil, 0)
+}
+
+// The error for a write with schema violations, or nil if there are none
+func (hub *MsgHub) invalidData(conn *Conn, msg *Msg, violations []*ErrorDetail) *Error {
+	if len(violations) == 0 {
+		return nil
+	}
+	log.Printf("Connection #%d sent %d schema violations for path: '%s'\n", conn.id, len(violations), msg.Path)
+	ackErr := NewError(MSG_ERR_INVALID_DATA, "The data does not match its schema")
+	ackErr.Details = violations
+	return ackErr
+}
@@ -0,0 +1,129 @@
+package turbo
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+const testSchemas = `{
+	"/users/$uid": {
+		"type": "object",
+		"required": ["name"],
+		"maxChildren": 3,
+		"properties": {
+			"name": {"type": "string", "minLength": 1, "maxLength": 10},
+			"age": {"type": "integer", "minimum": 0}
+		}
+	},
+	"/users/$uid/email": {
+		"type": "string",
+		"pattern": "^[^@]+@[^@]+$"
+	}
+}`
+
+func TestParseSchemas(t *testing.T) {
+	if _, err := ParseSchemas([]byte(testSchemas)); err != nil {
+		t.Error("Could not parse the test schemas", err)
+	}
+	if _, err := ParseSchemas([]byte(`{"/a": {"pattern": "("}}`)); err == nil {
+		t.Error("Broken pattern was accepted")
+	}
+}
+
+func TestSchemaValidate(t *testing.T) {
+	schemas, _ := ParseSchemas([]byte(testSchemas))
+
+	valid := map[string]interface{}{"name": "bob", "age": 30.0, "email": "bob@example.com"}
+	if violations := schemas.validate("/users/bob", valid); len(violations) != 0 {
+		t.Error("Valid user was rejected", violations[0].Path, violations[0].Message)
+	}
+
+	invalid := map[string]interface{}{"age": -1.5, "email": "bob"}
+	violations := schemas.validate("/users/bob", invalid)
+	paths := map[string]bool{}
+	for _, violation := range violations {
+		paths[violation.Path] = true
+	}
+	for _, path := range []string{"/users/bob", "/users/bob/age", "/users/bob/email"} {
+		if !paths[path] {
+			t.Error("Missing a violation at", path)
+		}
+	}
+
+	// Schemas below the written path are checked too
+	tree := map[string]interface{}{"bob": map[string]interface{}{"name": 1.0}}
+	if violations := schemas.validate("/users", tree); len(violations) != 1 || violations[0].Path != "/users/bob/name" {
+		t.Error("Nested data was not validated", violations)
+	}
+}
+
+func TestInvalidData(t *testing.T) {
+	db := newTestDb(t)
+	schemas, _ := ParseSchemas([]byte(testSchemas))
+	hub := NewMsgHub(NewMsgBus(), db, &Config{Schemas: schemas})
+	conn := newTestConn(hub, 1)
+
+	hub.handleSet(&Msg{Cmd: MSG_CMD_SET, Path: "/users/bob", Data: json.RawMessage(`{"name": "bob"}`), Ack: 1}, conn)
+	// Writing below a schema still has to leave the whole object valid
+	hub.handleSet(&Msg{Cmd: MSG_CMD_SET, Path: "/users/bob/name", Data: json.RawMessage(`null`), Ack: 2}, conn)
+	hub.handleUpdate(&Msg{Cmd: MSG_CMD_UPDATE, Path: "/users/bob", DataMap: json.RawMessage(`{"age": 2.5}`), Ack: 3}, conn)
+	hub.handleUpdate(&Msg{Cmd: MSG_CMD_UPDATE, Path: "/users/bob", DataMap: json.RawMessage(`{"age": 25}`), Ack: 4}, conn)
+
+	for _, expected := range []string{"", MSG_ERR_INVALID_DATA, MSG_ERR_INVALID_DATA, ""} {
+		ack := Ack{}
+		json.Unmarshal(nextPayload(conn.outbox), &ack)
+		if ackCode(ack) != expected {
+			t.Error("Ack", ack.Ack, "had the wrong error", ack.Error)
+		}
+	}
+	if _, val, _ := hub.db.get("/users/bob/name"); val != "bob" {
+		t.Error("Invalid write was applied", val)
+	}
+}
+
+func TestStoredArraySchema(t *testing.T) {
+	db := newTestDb(t)
+	schemas, _ := ParseSchemas([]byte(`{"/posts/$id": {"type": "object", "properties": {"tags": {"type": "array"}}}}`))
+	hub := NewMsgHub(NewMsgBus(), db, &Config{Schemas: schemas})
+	conn := newTestConn(hub, 1)
+
+	hub.handleSet(&Msg{Cmd: MSG_CMD_SET, Path: "/posts/p", Data: json.RawMessage(`{"tags": ["a", "b"]}`), Ack: 1}, conn)
+	// The schema sees the tags as they come back out of the db
+	hub.handleSet(&Msg{Cmd: MSG_CMD_SET, Path: "/posts/p/title", Data: json.RawMessage(`"hello"`), Ack: 2}, conn)
+	for i := 0; i < 2; i++ {
+		ack := Ack{}
+		json.Unmarshal(nextPayload(conn.outbox), &ack)
+		if ack.Error != nil {
+			t.Error("Ack", ack.Ack, "failed", ack.Error)
+		}
+	}
+}
+
+func TestDisconnectOpSchema(t *testing.T) {
+	db := newTestDb(t)
+	schemas, _ := ParseSchemas([]byte(testSchemas))
+	hub := NewMsgHub(NewMsgBus(), db, &Config{Schemas: schemas})
+	conn := newTestConn(hub, 1)
+	db.set("/users/bob", map[string]interface{}{"name": "bob"})
+
+	// Refused when it's registered
+	hub.handleOnDisconnect(&Msg{Cmd: MSG_CMD_ON_DISCONNECT_REMOVE, Path: "/users/bob/name", Ack: 1}, conn)
+	hub.handleOnDisconnect(&Msg{Cmd: MSG_CMD_ON_DISCONNECT_SET, Path: "/users/bob/email", Data: json.RawMessage(`"bob@example.com"`), Ack: 2}, conn)
+	for _, expected := range []string{MSG_ERR_INVALID_DATA, ""} {
+		ack := Ack{}
+		json.Unmarshal(nextPayload(conn.outbox), &ack)
+		if ackCode(ack) != expected {
+			t.Error("Ack", ack.Ack, "had the wrong error", ack.Error)
+		}
+	}
+
+	// Checked again when it runs, since bob has filled up in the meantime
+	db.set("/users/bob", map[string]interface{}{"name": "bob", "age": 30.0, "nick": "b"})
+	hub.runDisconnectOps(conn, conn.takeDisconnectOps())
+	if _, val, _ := db.get("/users/bob/email"); val != nil {
+		t.Error("Disconnect op that broke the schema was applied", val)
+	}
+	if _, val, _ := db.get("/users/bob/name"); val != "bob" {
+		t.Error("Refused disconnect op was applied", val)
+	}
+}
@@ -0,0 +1,206 @@
+package turbo
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// How long a dropped session waits for its client to come back
+	SESSION_TIMEOUT_DEFAULT = 2 * time.Minute
+	// How many recent events a session can replay
+	SESSION_REPLAY_SIZE_DEFAULT = 1024
+	// How long a dropped session holds off its disconnect ops
+	DISCONNECT_GRACE_DEFAULT = 5 * time.Second
+)
+
+// Outlives the Conn it was started on, so a client that reconnects can pick up where it left off
+type Session struct {
+	token string
+	// The Conn events are delivered to; while parked it is the Conn that dropped
+	conn   *Conn
+	parked bool
+	expiry *time.Timer
+	// Runs the dropped Conn's disconnect ops well before the session itself expires
+	grace *time.Timer
+	// Who the dropped Conn was authenticated as, handed on to the Conn that resumes
+	identity *Identity
+	// The seq of the last event, and a ring of the most recent ones
+	seq    uint64
+	replay []*sessionEvent
+	head   int
+	lock   sync.Mutex
+}
+
+type sessionEvent struct {
+	payload   []byte
+	valuePath string
+}
+
+func newSession(token string, replaySize int) *Session {
+	return &Session{
+		token:  token,
+		replay: make([]*sessionEvent, 0, replaySize),
+	}
+}
+
+// Stamps the next seq onto an event, remembers it and sends it on if the client is around
+func (session *Session) deliver(payload []byte, valuePath string) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+
+	session.seq++
+	// Events are json objects, so the seq can be spliced in at the front
+	stamped := make([]byte, 0, len(payload)+24)
+	stamped = append(stamped, `{"seq":`...)
+	stamped = strconv.AppendUint(stamped, session.seq, 10)
+	if len(payload) > 2 {
+		stamped = append(stamped, ',')
+	}
+	stamped = append(stamped, payload[1:]...)
+
+	event := &sessionEvent{payload: stamped, valuePath: valuePath}
+	if len(session.replay) < cap(session.replay) {
+		session.replay = append(session.replay, event)
+	} else if cap(session.replay) > 0 {
+		session.replay[session.head] = event
+		session.head = (session.head + 1) % cap(session.replay)
+	}
+	if !session.parked {
+		session.conn.outbox.pushEvent(stamped, valuePath)
+	}
+}
+
+// Whether every event after lastSeq is still in the replay buffer
+func (session *Session) canReplay(lastSeq uint64) bool {
+	oldest := session.seq - uint64(len(session.replay))
+	return lastSeq >= oldest && lastSeq <= session.seq
+}
+
+// The buffered events after lastSeq, oldest first
+func (session *Session) since(lastSeq uint64) []*sessionEvent {
+	missed := int(session.seq - lastSeq)
+	events := make([]*sessionEvent, 0, missed)
+	for i := len(session.replay) - missed; i < len(session.replay); i++ {
+		events = append(events, session.replay[(session.head+i)%len(session.replay)])
+	}
+	return events
+}
+
+// Queues an event for conn, through its session if it has one
+func (conn *Conn) deliver(payload []byte, valuePath string) {
+	if conn.session != nil {
+		conn.session.deliver(payload, valuePath)
+	} else {
+		conn.outbox.pushEvent(payload, valuePath)
+	}
+}
+
+func (hub *MsgHub) startSession(conn *Conn, token string) *Session {
+	session := newSession(token, hub.config.ReplayBufferSize)
+	session.conn = conn
+	hub.sessionLock.Lock()
+	hub.sessions[token] = session
+	hub.sessionLock.Unlock()
+	return session
+}
+
+// Moves a parked session over to conn, queueing welcome and then every event conn missed.
+// Returns nil if there is nothing to resume.
+func (hub *MsgHub) resumeSession(conn *Conn, token string, lastSeq uint64, welcome []byte) *Session {
+	// Held throughout, so the session can't expire halfway through
+	hub.sessionLock.Lock()
+	defer hub.sessionLock.Unlock()
+	session := hub.sessions[token]
+	if session == nil {
+		return nil
+	}
+
+	session.lock.Lock()
+	// Everything the session holds was read as its identity, so it can't outlive it
+	expired := session.identity != nil && !hub.config.Auth.expiry(session.identity).After(time.Now())
+	if !session.parked || !session.canReplay(lastSeq) || expired {
+		session.lock.Unlock()
+		return nil
+	}
+	session.expiry.Stop()
+	session.grace.Stop()
+	dropped := session.conn
+	session.conn = conn
+	session.parked = false
+	identity := session.identity
+	session.identity = nil
+	// Patches start over from whole values, since we can't know which ones the client saw
+	conn.resyncDeltas(dropped)
+	conn.outbox.push(welcome)
+	for _, event := range session.since(lastSeq) {
+		conn.outbox.pushEvent(event.payload, event.valuePath)
+	}
+	session.lock.Unlock()
+
+	// The dropped Conn kept listening on the session's behalf; conn takes over from here,
+	// as whoever it was, and with whatever it left to run once the client is gone for good
+	conn.session = session
+	if identity != nil {
+		conn.authenticate(identity)
+	}
+	hub.bus.transfer(dropped, conn)
+	conn.addDisconnectOps(dropped.takeDisconnectOps())
+	log.Printf("Connection #%d resumed the session of connection #%d from seq %d.\n", conn.id, dropped.id, lastSeq)
+	return session
+}
+
+// Holds onto a dropped Conn's session and subscriptions until it comes back or times out
+func (hub *MsgHub) parkSession(conn *Conn) {
+	session := conn.session
+	session.lock.Lock()
+	defer session.lock.Unlock()
+
+	if session.conn != conn {
+		return
+	}
+	session.parked = true
+	session.identity = conn.auth()
+	session.expiry = time.AfterFunc(hub.config.SessionTimeout, func() {
+		hub.expireSession(session)
+	})
+	session.grace = time.AfterFunc(hub.config.DisconnectGrace, func() {
+		hub.endGrace(session, conn)
+	})
+}
+
+// Runs conn's disconnect ops if its client hasn't come back for the session by now.
+// The session stays parked, so a client that comes back later still gets its events.
+func (hub *MsgHub) endGrace(session *Session, conn *Conn) {
+	session.lock.Lock()
+	var ops []*Msg
+	if session.parked && session.conn == conn {
+		ops = conn.takeDisconnectOps()
+	}
+	session.lock.Unlock()
+	if len(ops) > 0 {
+		log.Printf("Connection #%d did not come back in time, running its disconnect ops.\n", conn.id)
+		hub.runDisconnectOps(conn, ops)
+	}
+}
+
+func (hub *MsgHub) expireSession(session *Session) {
+	hub.sessionLock.Lock()
+	session.lock.Lock()
+	parked := session.parked
+	if parked {
+		delete(hub.sessions, session.token)
+		session.identity = nil
+	}
+	session.lock.Unlock()
+	hub.sessionLock.Unlock()
+	if !parked {
+		return
+	}
+	hub.bus.unsubscribeAll(session.conn)
+	log.Printf("Connection #%d's session expired.\n", session.conn.id)
+	// The client isn't coming back, so whatever the grace period left has to run now
+	go hub.runDisconnectOps(session.conn, session.conn.takeDisconnectOps())
+}
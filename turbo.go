@@ -11,25 +11,59 @@ type Turbo struct {
 }
 
 func (t *Turbo) Handler(res http.ResponseWriter, req *http.Request) {
+	// Refused before anything is allocated for the conn
+	metadata, admitted := t.hub.admit(res, req)
+	if !admitted {
+		return
+	}
 	conn, err := NewConn(t.hub, res, req)
 	if err != nil {
 		log.Println("Could not setup incoming Conn", err)
 		return
 	}
+	conn.metadata = metadata
 	t.hub.registerConn(conn)
 	defer t.hub.unregisterConn(conn)
 	go conn.writer()
+	go conn.worker()
+	go conn.pinger()
 	conn.reader() // Left outside go routine to block
 }
 
-// TODO this should take config
-func New(connectionString, dbName, colName string) (error, *Turbo) {
+// Counts of messages dropped or coalesced, and conns disconnected, for falling behind
+func (t *Turbo) Stats() BackpressureStats {
+	return t.hub.stats.snapshot()
+}
+
+// Serves the hub's metrics in the Prometheus text format
+func (t *Turbo) MetricsHandler(res http.ResponseWriter, req *http.Request) {
+	res.Header().Set("Content-Type", METRICS_CONTENT_TYPE)
+	if err := t.hub.writeMetrics(res); err != nil {
+		log.Println("Could not write metrics", err)
+	}
+}
+
+func New(config *Config) (error, *Turbo) {
+	if config.RulesFile != "" {
+		rules, err := LoadRules(config.RulesFile)
+		if err != nil {
+			return err, nil
+		}
+		config.Rules = rules
+	}
+	if config.SchemasFile != "" {
+		schemas, err := LoadSchemas(config.SchemasFile)
+		if err != nil {
+			return err, nil
+		}
+		config.Schemas = schemas
+	}
 	bus := NewMsgBus()
-	db, err := NewDatabase(connectionString, dbName, colName)
+	db, err := NewDatabase(config.ConnectionString, config.DbName, config.DbType)
 	if err != nil {
 		return err, nil
 	}
-	hub := NewMsgHub(bus, db)
+	hub := NewMsgHub(bus, db, config)
 	turbo := Turbo{
 		bus: bus,
 		hub: hub,
@@ -0,0 +1,81 @@
+package turbo
+
+import (
+	"github.com/gorilla/websocket"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Allows every origin when listed in Config.AllowedOrigins
+const ORIGIN_ANY = "*"
+
+// Builds the upgrader for a hub, so each Turbo has its own origins and subprotocols
+func newUpgrader(config *Config) *websocket.Upgrader {
+	upgrader := &websocket.Upgrader{
+		ReadBufferSize:  UPGRADER_READ_BUF_SIZE,
+		WriteBufferSize: UPGRADER_WRITE_BUF_SIZE,
+		Subprotocols:    config.Subprotocols,
+	}
+	// Without a list, gorilla's same origin check applies
+	if len(config.AllowedOrigins) > 0 {
+		upgrader.CheckOrigin = func(req *http.Request) bool {
+			return originAllowed(req.Header.Get("Origin"), config.AllowedOrigins)
+		}
+	}
+	return upgrader
+}
+
+// Requests without an origin don't come from browsers, so they are let through
+func originAllowed(origin string, allowed []string) bool {
+	if origin == "" {
+		return true
+	}
+	for _, candidate := range allowed {
+		if candidate == ORIGIN_ANY || strings.EqualFold(candidate, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Runs Config.BeforeUpgrade, answering the request itself if it is turned away.
+// Foreign origins are turned away first, so the hook never sees them.
+func (hub *MsgHub) admit(res http.ResponseWriter, req *http.Request) (interface{}, bool) {
+	if check := hub.upgrader.CheckOrigin; check != nil && !check(req) {
+		log.Printf("Upgrade from %s was refused: origin '%s' is not allowed\n", req.RemoteAddr, req.Header.Get("Origin"))
+		http.Error(res, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return nil, false
+	}
+	if hub.config.BeforeUpgrade == nil {
+		return nil, true
+	}
+	metadata, err := hub.config.BeforeUpgrade(req)
+	if err != nil {
+		log.Printf("Upgrade from %s was refused: %s\n", req.RemoteAddr, err)
+		http.Error(res, err.Error(), upgradeStatus(err))
+		return nil, false
+	}
+	return metadata, true
+}
+
+// The http status for a refused upgrade; errors other than *Error are taken as permission denied
+func upgradeStatus(err error) int {
+	turboErr, ok := err.(*Error)
+	if !ok {
+		return http.StatusForbidden
+	}
+	switch turboErr.Code {
+	case MSG_ERR_INVALID_DATA:
+		return http.StatusBadRequest
+	case MSG_ERR_NOT_FOUND:
+		return http.StatusNotFound
+	case MSG_ERR_TOO_LARGE:
+		return http.StatusRequestEntityTooLarge
+	case MSG_ERR_RATE_LIMITED:
+		return http.StatusTooManyRequests
+	case MSG_ERR_INTERNAL:
+		return http.StatusInternalServerError
+	}
+	return http.StatusForbidden
+}
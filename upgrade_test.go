@@ -0,0 +1,92 @@
+package turbo
+
+import (
+	"errors"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	allowed := []string{"https://app.example.com", "http://localhost:8080"}
+	cases := map[string]bool{
+		"":                        true,
+		"https://app.example.com": true,
+		"HTTPS://APP.EXAMPLE.COM": true,
+		"http://localhost:8080":   true,
+		"https://evil.com":        false,
+		"http://app.example.com":  false,
+	}
+	for origin, expected := range cases {
+		if originAllowed(origin, allowed) != expected {
+			t.Error("Origin", origin, "should be allowed:", expected)
+		}
+	}
+	if !originAllowed("https://evil.com", []string{ORIGIN_ANY}) {
+		t.Error("Wildcard did not allow every origin")
+	}
+}
+
+func TestUpgradePolicy(t *testing.T) {
+	var seen *http.Request
+	hub := NewMsgHub(NewMsgBus(), nil, &Config{
+		AllowedOrigins: []string{"https://app.example.com"},
+		Subprotocols:   []string{"turbo.v1"},
+		BeforeUpgrade: func(req *http.Request) (interface{}, error) {
+			seen = req
+			switch req.Header.Get("X-Test") {
+			case "banned":
+				return nil, errors.New("Go away")
+			case "flood":
+				return nil, NewError(MSG_ERR_RATE_LIMITED, "Slow down")
+			}
+			return "meta", nil
+		},
+	})
+	go hub.listen()
+	turbo := &Turbo{bus: hub.bus, hub: hub}
+	server := httptest.NewServer(http.HandlerFunc(turbo.Handler))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	dial := func(origin string, test string) (*websocket.Conn, int) {
+		header := http.Header{}
+		header.Set("Origin", origin)
+		header.Set("X-Test", test)
+		dialer := websocket.Dialer{Subprotocols: []string{"other", "turbo.v1"}}
+		ws, res, _ := dialer.Dial(url, header)
+		if res == nil {
+			return ws, 0
+		}
+		return ws, res.StatusCode
+	}
+
+	ws, status := dial("https://app.example.com", "")
+	if ws == nil || status != http.StatusSwitchingProtocols {
+		t.Error("Allowed origin was refused", status)
+		t.FailNow()
+	}
+	if ws.Subprotocol() != "turbo.v1" {
+		t.Error("Subprotocol was not negotiated", ws.Subprotocol())
+	}
+	ws.Close()
+
+	seen = nil
+	if ws, status = dial("https://evil.com", ""); ws != nil || status != http.StatusForbidden {
+		t.Error("Foreign origin was let in", status)
+	}
+	if seen != nil {
+		t.Error("Hook ran for a foreign origin")
+	}
+	if _, status = dial("https://app.example.com", "banned"); status != http.StatusForbidden {
+		t.Error("Hook refusal was not a 403", status)
+	}
+	if seen == nil {
+		t.Error("Hook never saw the request")
+	}
+	if _, status = dial("https://app.example.com", "flood"); status != http.StatusTooManyRequests {
+		t.Error("Rate limited refusal was not a 429", status)
+	}
+}
@@ -1,65 +1,95 @@
 package turbo
 
 import (
-	"strings"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
 )
 
 const (
 	SLASH = "/"
 	DOT   = "."
+
+	// Push keys sort in the order they were made
+	PUSH_KEY_CHARS = "-0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ_abcdefghijklmnopqrstuvwxyz"
 )
 
-func joinPaths(basePath string, extension string) string {
-	if strings.HasSuffix(basePath, SLASH) {
-		if strings.HasPrefix(extension, SLASH) {
-			return basePath + extension[1:]
-		} else {
-			return basePath + extension
-		}
-	} else {
-		if strings.HasPrefix(extension, SLASH) {
-			return basePath + extension
-		} else {
-			return basePath + SLASH + extension
+var (
+	lastPushTime   int64
+	lastPushRandom [12]int
+	pushKeyMutex   = &sync.Mutex{}
+)
+
+// Navigates a decoded json value by keys
+func valueAt(value interface{}, keys []string) interface{} {
+	for _, key := range keys {
+		switch value.(type) {
+		case map[string]interface{}:
+			value = value.(map[string]interface{})[key]
+		case []interface{}:
+			index, err := strconv.Atoi(key)
+			list := value.([]interface{})
+			if err != nil || index < 0 || index >= len(list) {
+				return nil
+			}
+			value = list[index]
+		default:
+			return nil
 		}
 	}
+	return value
 }
 
-func mongoizePath(path string) string {
-	return strings.Replace(strings.Trim(path, SLASH), SLASH, DOT, -1)
-}
-
-func standardizePath(path string) string {
-	if path[0] != SLASH[0] {
-		if path[len(path)-1] == SLASH[0] {
-			return SLASH + path[:(len(path)-1)]
-		} else {
-			return SLASH + path
+// Returns a copy of value with newValue placed at keys; value itself is left untouched
+func setValueAt(value interface{}, keys []string, newValue interface{}) interface{} {
+	if len(keys) == 0 {
+		return newValue
+	}
+	result := make(map[string]interface{})
+	if children, isMap := value.(map[string]interface{}); isMap {
+		for key, childValue := range children {
+			result[key] = childValue
 		}
+	}
+	child := setValueAt(result[keys[0]], keys[1:], newValue)
+	if child == nil {
+		delete(result, keys[0])
 	} else {
-		if path[len(path)-1] == SLASH[0] {
-			return path[:(len(path) - 1)]
-		} else {
-			return path
-		}
+		result[keys[0]] = child
 	}
+	return result
 }
 
-func parentOf(path string) (string, bool) {
-	index := strings.LastIndex(path, SLASH)
-	if index <= 0 {
-		return path, false
+// Makes a unique key from the time and some randomness, bumping the randomness
+// when two keys are made in the same millisecond so they still sort in order
+func newPushKey() string {
+	pushKeyMutex.Lock()
+	defer pushKeyMutex.Unlock()
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	if now == lastPushTime {
+		i := len(lastPushRandom) - 1
+		for ; i >= 0 && lastPushRandom[i] == len(PUSH_KEY_CHARS)-1; i-- {
+			lastPushRandom[i] = 0
+		}
+		if i >= 0 {
+			lastPushRandom[i]++
+		}
+	} else {
+		for i := range lastPushRandom {
+			lastPushRandom[i] = rand.Intn(len(PUSH_KEY_CHARS))
+		}
 	}
-	return path[:index], true
-}
+	lastPushTime = now
 
-func cascadePath(path string, parentsOnly bool, iterator func(string)) {
-	if !parentsOnly {
-		iterator(path)
+	key := make([]byte, 20)
+	for i := 7; i >= 0; i-- {
+		key[i] = PUSH_KEY_CHARS[now%int64(len(PUSH_KEY_CHARS))]
+		now = now / int64(len(PUSH_KEY_CHARS))
 	}
-	var parentPath, isDone = parentOf(path)
-	for !isDone {
-		iterator(parentPath)
-		parentPath, isDone = parentOf(path)
+	for i, index := range lastPushRandom {
+		key[8+i] = PUSH_KEY_CHARS[index]
 	}
+	return string(key)
 }